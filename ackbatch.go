@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// ackBatcher acknowledges the dumped messages together with a multiple ack
+// on every tick (every -ack-interval) instead of one by one, which saves a
+// round-trip per message. Only the last saved message is kept: acking it
+// with multiple set also acks every earlier delivery of its channel. The ack
+// is sent early once maxPending messages are waiting, so that a consumer
+// doesn't stall on its prefetch limit.
+type ackBatcher struct {
+	maxPending int
+
+	mu      sync.Mutex
+	last    *amqp091.Delivery
+	pending int
+	err     error
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newAckBatcher starts acking on every value received from ticks; with a
+// maxPending of 0 there is no limit of waiting messages.
+func newAckBatcher(ticks <-chan time.Time, maxPending int) *ackBatcher {
+	b := &ackBatcher{
+		maxPending: maxPending,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go func() {
+		defer close(b.stopped)
+		for {
+			select {
+			case <-ticks:
+				b.mu.Lock()
+				b.flushLocked()
+				b.mu.Unlock()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return b
+}
+
+// add records a saved message to be acked with the next batch. It returns
+// the error of the previous batch, if any.
+func (b *ackBatcher) add(msg amqp091.Delivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last = &msg
+	b.pending++
+	if b.maxPending > 0 && b.pending >= b.maxPending {
+		b.flushLocked()
+	}
+	err := b.err
+	b.err = nil
+	return err
+}
+
+func (b *ackBatcher) flushLocked() {
+	if b.last == nil {
+		return
+	}
+	err := b.last.Ack(true)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	verboseLog("Acked a batch of messages")
+	b.last = nil
+	b.pending = 0
+}
+
+// Close stops the ticks and acks the messages still waiting.
+func (b *ackBatcher) Close() error {
+	if b == nil {
+		return nil
+	}
+	close(b.done)
+	<-b.stopped
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+	return b.err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// multipleAcks records the multiple acks of an ackBatcher.
+type multipleAcks struct {
+	mu   sync.Mutex
+	tags []uint64
+}
+
+func (a *multipleAcks) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !multiple {
+		return fmt.Errorf("Expected a multiple ack of tag %d", tag)
+	}
+	a.tags = append(a.tags, tag)
+	return nil
+}
+
+func (a *multipleAcks) Nack(tag uint64, multiple bool, requeue bool) error {
+	return fmt.Errorf("Unexpected nack of tag %d", tag)
+}
+
+func (a *multipleAcks) Reject(tag uint64, requeue bool) error {
+	return fmt.Errorf("Unexpected reject of tag %d", tag)
+}
+
+func (a *multipleAcks) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return fmt.Sprint(a.tags)
+}
+
+func TestAckBatcherInterval(t *testing.T) {
+	acks := &multipleAcks{}
+	ticks := make(chan time.Time)
+	// The second tick is only received once the first one was handled.
+	tick := func() {
+		ticks <- time.Time{}
+		ticks <- time.Time{}
+	}
+	b := newAckBatcher(ticks, 0)
+	tag := uint64(0)
+	add := func(n int) {
+		for i := 0; i < n; i++ {
+			tag++
+			err := b.add(amqp091.Delivery{Acknowledger: acks, DeliveryTag: tag})
+			if err != nil {
+				t.Fatalf("add: %s", err)
+			}
+		}
+	}
+
+	add(3)
+	if acks.String() != "[]" {
+		t.Errorf("Expected no acks before the interval, got %s", acks)
+	}
+	tick()
+	if acks.String() != "[3]" {
+		t.Errorf("Expected one ack of the first 3 messages, got %s", acks)
+	}
+	tick()
+	if acks.String() != "[3]" {
+		t.Errorf("Expected no ack without new messages, got %s", acks)
+	}
+	add(2)
+	if acks.String() != "[3]" {
+		t.Errorf("Expected no acks before the interval, got %s", acks)
+	}
+	tick()
+	add(1)
+	if acks.String() != "[3 5]" {
+		t.Errorf("Expected one ack of the next 2 messages, got %s", acks)
+	}
+	err := b.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if acks.String() != "[3 5 6]" {
+		t.Errorf("Expected the final ack on Close, got %s", acks)
+	}
+}
+
+func TestAckBatcherMaxPending(t *testing.T) {
+	broker := newTestBroker(5)
+	b := newAckBatcher(nil, 2)
+	loop := &dumpLoop{
+		fetch:     getMessages(broker, testQueueName, false),
+		writer:    &testWriter{},
+		manualAck: true,
+		acks:      b,
+	}
+	messagesReceived, err := loop.run()
+	if err != nil || messagesReceived != 5 {
+		t.Fatalf("Expected 5 messages, got %d (%v)", messagesReceived, err)
+	}
+	if fmt.Sprint(broker.acked) != "[2 4]" {
+		t.Errorf("Expected an ack every 2 messages, got %v", broker.acked)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if fmt.Sprint(broker.acked) != "[2 4 5]" {
+		t.Errorf("Expected the final ack on Close, got %v", broker.acked)
+	}
+}
+
+func TestAckIntervalRejectsSkippedMessages(t *testing.T) {
+	*ack = true
+	*ackInterval = time.Second
+	defer func() {
+		*ack = false
+		*ackInterval = 0
+	}()
+	for _, set := range []func() func(){
+		func() func() { *filterRoutingKey = "orders"; return func() { *filterRoutingKey = "" } },
+		func() func() { *rulesFile = "rules.yaml"; return func() { *rulesFile = "" } },
+		func() func() { *maxPerRoutingKey = 5; return func() { *maxPerRoutingKey = 0 } },
+		func() func() { *afterID = "msgid-3"; return func() { *afterID = "" } },
+	} {
+		reset := set()
+		err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, "tmp-test", false)
+		reset()
+		if err == nil || !strings.Contains(err.Error(), "-ack-interval can't be combined with filters") {
+			t.Errorf("Expected -ack-interval to be rejected, got %v", err)
+		}
+	}
+}
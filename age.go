@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// messageAges collects how long the messages of a dump waited in the queue,
+// from their timestamp property to when they were received, for -age-stats.
+// Messages without a timestamp are only counted.  A nil messageAges ignores
+// the messages.
+type messageAges struct {
+	ages    []time.Duration
+	missing uint
+}
+
+func (a *messageAges) add(timestamp time.Time, receivedAt time.Time) {
+	if a == nil {
+		return
+	}
+	if timestamp.IsZero() {
+		a.missing++
+		return
+	}
+	a.ages = append(a.ages, receivedAt.Sub(timestamp))
+}
+
+// stats returns the minimum, median and maximum age, and false when no
+// message had a timestamp.  The median of an even number of ages is the mean
+// of the two middle ones.  Publisher clocks running ahead give negative ages.
+func (a *messageAges) stats() (min, median, max time.Duration, ok bool) {
+	if len(a.ages) == 0 {
+		return 0, 0, 0, false
+	}
+	sorted := append([]time.Duration(nil), a.ages...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	middle := len(sorted) / 2
+	median = sorted[middle]
+	if len(sorted)%2 == 0 {
+		median = (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[0], median, sorted[len(sorted)-1], true
+}
+
+// String formats the stats rounded to the second, the resolution of AMQP
+// timestamps.
+func (a *messageAges) String() string {
+	s := "no timestamps"
+	if min, median, max, ok := a.stats(); ok {
+		s = fmt.Sprintf("min %s, median %s, max %s", min.Round(time.Second), median.Round(time.Second), max.Round(time.Second))
+	}
+	if a.missing > 0 {
+		s += fmt.Sprintf(" (%d messages without timestamp)", a.missing)
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageAges(t *testing.T) {
+	receivedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ages := &messageAges{}
+	for _, age := range []time.Duration{90 * time.Second, 10 * time.Second, 2 * time.Hour, 30 * time.Second} {
+		ages.add(receivedAt.Add(-age), receivedAt)
+	}
+	ages.add(time.Time{}, receivedAt)
+	ages.add(time.Time{}, receivedAt)
+
+	min, median, max, ok := ages.stats()
+	if !ok || min != 10*time.Second || median != time.Minute || max != 2*time.Hour {
+		t.Errorf("Wrong stats: min %s, median %s, max %s (%v)", min, median, max, ok)
+	}
+	expected := "min 10s, median 1m0s, max 2h0m0s (2 messages without timestamp)"
+	if ages.String() != expected {
+		t.Errorf("Wrong ages: expected %q, got %q", expected, ages.String())
+	}
+
+	ages.add(receivedAt.Add(-5*time.Minute), receivedAt)
+	if _, median, _, _ := ages.stats(); median != 90*time.Second {
+		t.Errorf("Wrong median of an odd number of ages: %s", median)
+	}
+
+	none := &messageAges{}
+	none.add(time.Time{}, receivedAt)
+	if s := none.String(); s != "no timestamps (1 messages without timestamp)" {
+		t.Errorf("Wrong ages without timestamps: %q", s)
+	}
+}
+
+func TestDumpSummaryAges(t *testing.T) {
+	*ageStats = true
+	defer func() { *ageStats = false }()
+
+	s := newDumpSummary("/tmp/dump")
+	s.started = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.saved(100)
+	s.received(s.started.Add(-time.Hour), s.started)
+
+	var out bytes.Buffer
+	err := s.write(&out, s.started.Add(time.Second))
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if !strings.Contains(out.String(), "Message age:      min 1h0m0s, median 1h0m0s, max 1h0m0s\n") {
+		t.Errorf("Missing message age in summary:\n%s", out.String())
+	}
+}
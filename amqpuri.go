@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// usesURIComponents reports whether any of -host, -port, -user, -password,
+// -vhost or -tls is given.
+func usesURIComponents() bool {
+	return *amqpHost != "" || *amqpPort != 0 || *amqpUser != "" || *amqpPassword != "" || *amqpVhost != "" || *amqpTLS
+}
+
+// isFlagSet reports whether the flag name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// amqpURIFromFlags returns the AMQP URI to connect to: -uri, or, when any of
+// the URI component flags is given instead, the URI composed from them. The
+// two can't be mixed, so that it is always clear which one is used.
+func amqpURIFromFlags(uriGiven bool) (string, error) {
+	if !usesURIComponents() {
+		return *uri, nil
+	}
+	if uriGiven {
+		return "", fmt.Errorf("-uri can't be combined with -host, -port, -user, -password, -vhost or -tls")
+	}
+	return composeAMQPURI(*amqpHost, *amqpPort, *amqpUser, *amqpPassword, *amqpVhost, *amqpTLS), nil
+}
+
+// composeAMQPURI builds an AMQP URI, escaping each component as needed.
+// Empty components get the defaults of the -uri flag: localhost, port 5672
+// (5671 with TLS), user and password guest, and vhost "/".
+func composeAMQPURI(host string, port uint, user, password, vhost string, useTLS bool) string {
+	u := url.URL{Scheme: "amqp", Path: "/"}
+	if useTLS {
+		u.Scheme = "amqps"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if port == 0 {
+		port = 5672
+		if useTLS {
+			port = 5671
+		}
+	}
+	u.Host = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	if user == "" {
+		user = "guest"
+		if password == "" {
+			password = "guest"
+		}
+	}
+	u.User = url.UserPassword(user, password)
+	if vhost != "" && vhost != "/" {
+		u.Path = "/" + vhost
+		u.RawPath = "/" + url.PathEscape(vhost)
+	}
+	return u.String()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestComposeAMQPURI(t *testing.T) {
+	tests := []struct {
+		host     string
+		port     uint
+		user     string
+		password string
+		vhost    string
+		tls      bool
+		expected amqp091.URI
+	}{
+		{"", 0, "", "", "", false, amqp091.URI{Scheme: "amqp", Host: "localhost", Port: 5672, Username: "guest", Password: "guest", Vhost: "/"}},
+		{"rabbitmq.example.com", 0, "dumper", "p@ss:w/rd", "", true, amqp091.URI{Scheme: "amqps", Host: "rabbitmq.example.com", Port: 5671, Username: "dumper", Password: "p@ss:w/rd", Vhost: "/"}},
+		{"10.0.0.1", 5673, "user@corp", "a/b@c:d%20 e", "/prod", false, amqp091.URI{Scheme: "amqp", Host: "10.0.0.1", Port: 5673, Username: "user@corp", Password: "a/b@c:d%20 e", Vhost: "/prod"}},
+		{"::1", 0, "dumper", "", "orders/eu", false, amqp091.URI{Scheme: "amqp", Host: "::1", Port: 5672, Username: "dumper", Vhost: "orders/eu"}},
+	}
+	for _, test := range tests {
+		composed := composeAMQPURI(test.host, test.port, test.user, test.password, test.vhost, test.tls)
+		parsed, err := amqp091.ParseURI(composed)
+		if err != nil {
+			t.Errorf("ParseURI(%q): %s", composed, err)
+			continue
+		}
+		if parsed != test.expected {
+			t.Errorf("Wrong URI %q: expected %#v but got %#v", composed, test.expected, parsed)
+		}
+	}
+}
+
+func TestAMQPURIFromFlags(t *testing.T) {
+	composed, err := amqpURIFromFlags(true)
+	if err != nil || composed != *uri {
+		t.Errorf("Expected -uri without component flags, got %q (%v)", composed, err)
+	}
+
+	*amqpPassword = "s3cr@t/:"
+	defer func() { *amqpPassword = "" }()
+	_, err = amqpURIFromFlags(true)
+	if err == nil {
+		t.Errorf("Expected an error combining -uri and -password")
+	}
+	composed, err = amqpURIFromFlags(false)
+	if err != nil {
+		t.Fatalf("amqpURIFromFlags: %s", err)
+	}
+	parsed, err := amqp091.ParseURI(composed)
+	if err != nil || parsed.Username != "guest" || parsed.Password != "s3cr@t/:" {
+		t.Errorf("Wrong URI %q: %#v (%v)", composed, parsed, err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// brokerProperties are the server properties the broker advertised in the
+// connection handshake, recorded in the manifest to tell which broker a dump
+// was taken from.
+type brokerProperties struct {
+	Product      string          `json:"product,omitempty"`
+	Version      string          `json:"version,omitempty"`
+	Platform     string          `json:"platform,omitempty"`
+	ClusterName  string          `json:"cluster_name,omitempty"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+}
+
+// newBrokerProperties picks the well-known entries of the server properties
+// of a connection.
+func newBrokerProperties(serverProperties amqp091.Table) *brokerProperties {
+	b := &brokerProperties{
+		Product:     tableString(serverProperties, "product"),
+		Version:     tableString(serverProperties, "version"),
+		Platform:    tableString(serverProperties, "platform"),
+		ClusterName: tableString(serverProperties, "cluster_name"),
+	}
+	if capabilities, ok := serverProperties["capabilities"].(amqp091.Table); ok {
+		b.Capabilities = make(map[string]bool, len(capabilities))
+		for name, value := range capabilities {
+			if enabled, ok := value.(bool); ok {
+				b.Capabilities[name] = enabled
+			}
+		}
+	}
+	return b
+}
+
+func tableString(table amqp091.Table, key string) string {
+	switch v := table[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// String describes the broker in one line, for the verbose output.
+func (b *brokerProperties) String() string {
+	s := strings.TrimSpace(b.Product + " " + b.Version)
+	if s == "" {
+		s = "unknown broker"
+	}
+	if b.Platform != "" {
+		s += " on " + b.Platform
+	}
+	if b.ClusterName != "" {
+		s += fmt.Sprintf(" (cluster %s)", b.ClusterName)
+	}
+	var enabled []string
+	for name, on := range b.Capabilities {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	if len(enabled) > 0 {
+		s += ", capabilities: " + strings.Join(enabled, ", ")
+	}
+	return s
+}
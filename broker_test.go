@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// testServerProperties are the server properties of a RabbitMQ 3.12 broker.
+var testServerProperties = amqp091.Table{
+	"product":      "RabbitMQ",
+	"version":      "3.12.1",
+	"platform":     "Erlang/OTP 26.0.2",
+	"cluster_name": "rabbit@rabbitmq-0",
+	"copyright":    "Copyright (c) 2007-2023 VMware, Inc. or its affiliates.",
+	"capabilities": amqp091.Table{
+		"publisher_confirms":           true,
+		"consumer_priorities":          true,
+		"per_consumer_qos":             true,
+		"direct_reply_to":              false,
+		"authentication_failure_close": true,
+	},
+}
+
+func TestBrokerProperties(t *testing.T) {
+	broker := newBrokerProperties(testServerProperties)
+	expected := &brokerProperties{
+		Product:     "RabbitMQ",
+		Version:     "3.12.1",
+		Platform:    "Erlang/OTP 26.0.2",
+		ClusterName: "rabbit@rabbitmq-0",
+		Capabilities: map[string]bool{
+			"publisher_confirms":           true,
+			"consumer_priorities":          true,
+			"per_consumer_qos":             true,
+			"direct_reply_to":              false,
+			"authentication_failure_close": true,
+		},
+	}
+	if !reflect.DeepEqual(broker, expected) {
+		t.Errorf("Wrong broker properties: %#v", broker)
+	}
+
+	description := "RabbitMQ 3.12.1 on Erlang/OTP 26.0.2 (cluster rabbit@rabbitmq-0), capabilities: authentication_failure_close, consumer_priorities, per_consumer_qos, publisher_confirms"
+	if broker.String() != description {
+		t.Errorf("Wrong description: expected %q, got %q", description, broker.String())
+	}
+	if s := newBrokerProperties(nil).String(); s != "unknown broker" {
+		t.Errorf("Wrong description without properties: %q", s)
+	}
+}
+
+func TestManifestBrokerProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-manifest")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &dumpManifest{Queue: "incoming_1", Output: "files", Broker: newBrokerProperties(testServerProperties)}
+	m.finish(0, 0)
+	err = writeManifest(dir, m)
+	if err != nil {
+		t.Fatalf("writeManifest: %s", err)
+	}
+	loaded, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+	if !reflect.DeepEqual(loaded.Broker, m.Broker) {
+		t.Errorf("Wrong broker in manifest: %#v", loaded.Broker)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// bufferedFile buffers writes to a single output file. Without a flush
+// interval it is flushed after every record, so that the file is complete up
+// to the last message at any time. With -flush-interval it is instead flushed
+// and synced to disk periodically by a background goroutine, trading a
+// bounded amount of lost output on a crash for throughput.
+type bufferedFile struct {
+	mu       sync.Mutex
+	file     io.WriteCloser
+	writer   *bufio.Writer
+	interval time.Duration
+	done     chan struct{}
+	stopped  sync.WaitGroup
+}
+
+func newBufferedFile(file io.WriteCloser, interval time.Duration) *bufferedFile {
+	b := &bufferedFile{
+		file:     file,
+		writer:   bufio.NewWriter(file),
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	if interval > 0 {
+		b.stopped.Add(1)
+		go b.flushPeriodically()
+	}
+	return b
+}
+
+func (b *bufferedFile) flushPeriodically() {
+	defer b.stopped.Done()
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			b.flushAndSync()
+			b.mu.Unlock()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// flushAndSync must be called with mu held.
+func (b *bufferedFile) flushAndSync() error {
+	err := b.writer.Flush()
+	if err != nil {
+		return err
+	}
+	if syncer, ok := b.file.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// writeRecord writes a complete record, never splitting it across flushes
+// done by the background goroutine.
+func (b *bufferedFile) writeRecord(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.writer.Write(data)
+	if err == nil && b.interval <= 0 {
+		err = b.writer.Flush()
+	}
+	return err
+}
+
+func (b *bufferedFile) Close() error {
+	close(b.done)
+	b.stopped.Wait()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.writer.Flush()
+	closeErr := b.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func createTestOutputFile(t *testing.T) (string, *os.File, func()) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-buffered")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	filePath := path.Join(dir, "dump.ndjson")
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	return filePath, file, func() { os.RemoveAll(dir) }
+}
+
+func countLines(t *testing.T, filePath string) int {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Error reading %s: %s", filePath, err)
+	}
+	lines := 0
+	for _, c := range content {
+		if c == '\n' {
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestNdjsonFlushesEachMessageByDefault(t *testing.T) {
+	filePath, file, cleanup := createTestOutputFile(t)
+	defer cleanup()
+
+	writer := newNdjsonWriter(file, 0)
+	for i := 0; i < 3; i++ {
+		err := writer.WriteMessage(amqp091.Delivery{Body: []byte("body")}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+
+	// Simulate a crash: the writer is never closed.
+	if lines := countLines(t, filePath); lines != 3 {
+		t.Errorf("Expected 3 lines before closing, got %d", lines)
+	}
+	file.Close()
+}
+
+func TestNdjsonFlushInterval(t *testing.T) {
+	filePath, file, cleanup := createTestOutputFile(t)
+	defer cleanup()
+
+	writer := newNdjsonWriter(file, 20*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		err := writer.WriteMessage(amqp091.Delivery{Body: []byte("body")}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+
+	if lines := countLines(t, filePath); lines != 0 {
+		t.Errorf("Expected output to be buffered, got %d lines", lines)
+	}
+
+	// Simulate a crash after the flush interval: the writer is never closed.
+	time.Sleep(100 * time.Millisecond)
+	if lines := countLines(t, filePath); lines != 3 {
+		t.Errorf("Expected 3 lines after the flush interval, got %d", lines)
+	}
+
+	err := writer.Close()
+	if err != nil {
+		t.Errorf("Close: %s", err)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	a := []byte(`{"b": [1, 2.50, {"y": true, "x": null}], "a": "<tag> & é"}`)
+	b := []byte("{\n  \"a\":\"<tag> & é\",\n  \"b\":[ 1,2.50,{\"x\":null,\"y\":true} ]\n}\n")
+	expected := `{"a":"<tag> & é","b":[1,2.50,{"x":null,"y":true}]}`
+
+	if got := string(canonicalJSON(a)); got != expected {
+		t.Errorf("Wrong canonical JSON: expected %s, got %s", expected, got)
+	}
+	if got := string(canonicalJSON(b)); got != expected {
+		t.Errorf("Wrong canonical JSON: expected %s, got %s", expected, got)
+	}
+}
+
+func TestCanonicalJSONLeavesOtherBodies(t *testing.T) {
+	for _, body := range []string{"", "plain text", `{"truncated": `, "{} {}"} {
+		if got := string(canonicalJSON([]byte(body))); got != body {
+			t.Errorf("Expected %q to be unchanged, got %q", body, got)
+		}
+	}
+}
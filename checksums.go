@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checksumsFileName is the -checksum-manifest file, in the format of
+// sha256sum, so that `sha256sum -c SHA256SUMS` checks it too.
+const checksumsFileName = "SHA256SUMS"
+
+func checksumsFilePath(outputDir string) string {
+	return path.Join(outputDir, checksumsFileName)
+}
+
+// fileChecksums maps the slash-separated paths of the files of a dump,
+// relative to its directory, to the hex SHA-256 of their content.
+type fileChecksums map[string]string
+
+// hashDumpFiles computes the checksums of every regular file under
+// outputDir, except the checksums file itself.  -checksum-manifest requires
+// outputDir to be empty before the dump, so these are the dump's files.
+func hashDumpFiles(outputDir string) (fileChecksums, error) {
+	checksums := make(fileChecksums)
+	err := filepath.Walk(outputDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == checksumsFileName {
+			return nil
+		}
+		sum, err := hashFile(filePath)
+		if err != nil {
+			return err
+		}
+		checksums[rel] = sum
+		return nil
+	})
+	return checksums, err
+}
+
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// hashReader returns the hex SHA-256 of everything read from r.
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// isEmptyDir reports whether dir has no entries, or doesn't exist yet.
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// marshal formats the checksums as sha256sum lines sorted by path.
+func (c fileChecksums) marshal() []byte {
+	paths := make([]string, 0, len(c))
+	for p := range c {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s  %s\n", c[p], p)
+	}
+	return b.Bytes()
+}
+
+// root is the SHA-256 of the sorted checksum lines: it changes when any file
+// of the dump is added, removed or modified, so recording it elsewhere, e.g.
+// in an archive log, detects a checksums file that was rewritten to match
+// tampered files.
+func (c fileChecksums) root() string {
+	return fmt.Sprintf("%x", sha256.Sum256(c.marshal()))
+}
+
+func parseChecksums(data []byte) (fileChecksums, error) {
+	checksums := make(fileChecksums)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size || fields[1] == "" {
+			return nil, fmt.Errorf("line %d: expected a SHA-256 checksum, two spaces and a file name", line)
+		}
+		checksums[fields[1]] = fields[0]
+	}
+	return checksums, scanner.Err()
+}
+
+// writeChecksumManifest writes the checksums of every file of the dump in
+// outputDir, once they are all written, and prints their root.
+func writeChecksumManifest(outputDir string) error {
+	checksums, err := hashDumpFiles(outputDir)
+	if err != nil {
+		return err
+	}
+	filePath := checksumsFilePath(outputDir)
+	err = writeFile(filePath, checksums.marshal())
+	if err != nil {
+		return err
+	}
+	fmt.Println(filePath)
+	noticeLog("Checksum root of %d files: %s", len(checksums), checksums.root())
+	return nil
+}
+
+// compareChecksums describes the differences between the recorded and the
+// actual checksums of a dump, sorted by file name.
+func compareChecksums(recorded, actual fileChecksums) []string {
+	var problems []string
+	for p, sum := range recorded {
+		actualSum, ok := actual[p]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing", p))
+		} else if actualSum != sum {
+			problems = append(problems, fmt.Sprintf("%s: modified", p))
+		}
+	}
+	for p := range actual {
+		if _, ok := recorded[p]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: added", p))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// verifyDumpChecksums checks every file of the dump in outputDir against its
+// -checksum-manifest, and the manifest itself against expectedRoot if given.
+// It doesn't connect to RabbitMQ.
+func verifyDumpChecksums(outputDir string, expectedRoot string) error {
+	data, err := ioutil.ReadFile(checksumsFilePath(outputDir))
+	if err != nil {
+		return fmt.Errorf("Verify dump: %s", err)
+	}
+	recorded, err := parseChecksums(data)
+	if err != nil {
+		return fmt.Errorf("Verify dump: %s: %s", checksumsFileName, err)
+	}
+	actual, err := hashDumpFiles(outputDir)
+	if err != nil {
+		return fmt.Errorf("Verify dump: %s", err)
+	}
+
+	problems := compareChecksums(recorded, actual)
+	root := recorded.root()
+	if expectedRoot != "" && root != strings.ToLower(expectedRoot) {
+		problems = append(problems, fmt.Sprintf("%s: checksum root %s doesn't match -checksum-root", checksumsFileName, root))
+	}
+	for _, problem := range problems {
+		warningLog("%s", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Verify dump: %d problems found in %q", len(problems), outputDir)
+	}
+	noticeLog("%d files match the checksums, root %s", len(recorded), root)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChecksumManifestIntactDump(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := writeChecksumManifest(dir)
+	if err != nil {
+		t.Fatalf("writeChecksumManifest: %s", err)
+	}
+	data, err := ioutil.ReadFile(checksumsFilePath(dir))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 6 || !strings.HasSuffix(lines[0], "  msg-0000") || !strings.HasSuffix(lines[1], "  msg-0000-headers+properties.json") {
+		t.Errorf("Expected the sorted checksums of the 6 dump files, got:\n%s", data)
+	}
+
+	recorded, err := parseChecksums(data)
+	if err != nil {
+		t.Fatalf("parseChecksums: %s", err)
+	}
+	err = verifyDumpChecksums(dir, recorded.root())
+	if err != nil {
+		t.Errorf("Expected an intact dump, got %s", err)
+	}
+}
+
+func TestChecksumManifestTamperedDump(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	err := writeChecksumManifest(dir)
+	if err != nil {
+		t.Fatalf("writeChecksumManifest: %s", err)
+	}
+	recorded, err := hashDumpFiles(dir)
+	if err != nil {
+		t.Fatalf("hashDumpFiles: %s", err)
+	}
+	root := recorded.root()
+
+	err = ioutil.WriteFile(generateFilePath(dir, 0), []byte("tampered body"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = os.Remove(generateFilePath(dir, 1))
+	if err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "msg-0003"), []byte("injected body"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	actual, err := hashDumpFiles(dir)
+	if err != nil {
+		t.Fatalf("hashDumpFiles: %s", err)
+	}
+	expected := []string{"msg-0000: modified", "msg-0001: missing", "msg-0003: added"}
+	if problems := compareChecksums(recorded, actual); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+	err = verifyDumpChecksums(dir, "")
+	if err == nil || !strings.Contains(err.Error(), "3 problems found") {
+		t.Errorf("Expected a tampered dump, got %v", err)
+	}
+
+	// Rewriting the checksums file to match hides the tampering, except
+	// from the root recorded at dump time.
+	err = writeChecksumManifest(dir)
+	if err != nil {
+		t.Fatalf("writeChecksumManifest: %s", err)
+	}
+	if err = verifyDumpChecksums(dir, ""); err != nil {
+		t.Errorf("Expected the rewritten checksums to match, got %s", err)
+	}
+	err = verifyDumpChecksums(dir, root)
+	if err == nil || !strings.Contains(err.Error(), "1 problems found") {
+		t.Errorf("Expected a root mismatch, got %v", err)
+	}
+}
+
+func TestParseChecksumsRejectsInvalidLines(t *testing.T) {
+	for _, data := range []string{
+		"not a checksum line\n",
+		"abc  msg-0000\n",
+		strings.Repeat("a", 64) + " msg-0000\n",
+		strings.Repeat("a", 64) + "  \n",
+	} {
+		if _, err := parseChecksums([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestChecksumManifestRequiresEmptyDir(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	*checksumManifest = true
+	defer func() { *checksumManifest = false }()
+
+	err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, dir, false)
+	if err == nil || !strings.Contains(err.Error(), "-checksum-manifest requires an empty or new -output-dir") {
+		t.Errorf("Expected a non-empty output dir to be rejected, got %v", err)
+	}
+
+	os.Mkdir(path.Join(dir, "empty"), 0755)
+	for _, empty := range []string{path.Join(dir, "missing"), path.Join(dir, "empty")} {
+		if ok, err := isEmptyDir(empty); !ok || err != nil {
+			t.Errorf("Expected %s to count as empty, got %v, %v", empty, ok, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// commandWriter streams the messages to the standard input of an external
+// command, which takes care of storing them. Every message is written as a
+// framed record (see framedWriter), so the command can read it back without
+// any parsing of the body.
+type commandWriter struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+}
+
+// startOutputCommand starts command with the shell; its standard output and
+// error are those of rabbitmq-dump-queue.
+func startOutputCommand(command string) (*commandWriter, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Output command: %s", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Output command: %s", err)
+	}
+	verboseLog(fmt.Sprintf("Started output command %q (pid %d)", command, cmd.Process.Pid))
+	return &commandWriter{command: command, cmd: cmd, stdin: stdin}, nil
+}
+
+func (w *commandWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	record, err := framedRecord(msg)
+	if err != nil {
+		return newDumpError("command", msg, counter, err)
+	}
+	_, err = w.stdin.Write(record)
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) {
+		// The command exited, Close reports its exit status.
+		return errReaderClosed
+	}
+	if err != nil {
+		return newDumpError("command", msg, counter, err)
+	}
+	return nil
+}
+
+// Close signals the end of the stream to the command by closing its
+// standard input and waits for it to exit. A non-zero exit status is an
+// error.
+func (w *commandWriter) Close() error {
+	w.stdin.Close()
+	err := w.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("Output command %q: %s", w.command, err)
+	}
+	verboseLog(fmt.Sprintf("Output command %q exited with status 0", w.command))
+	return nil
+}
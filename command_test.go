@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestCommandWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-command")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	streamPath := path.Join(dir, "stream")
+	w, err := startOutputCommand("cat > " + streamPath)
+	if err != nil {
+		t.Fatalf("startOutputCommand: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		publishing := makeAmqpMessage(i)
+		msg := amqp091.Delivery{MessageId: publishing.MessageId, Body: publishing.Body}
+		err = w.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	f, err := os.Open(streamPath)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+	r := newFramedReader(f)
+	for i := 0; i < 3; i++ {
+		msg, err := r.next()
+		if err != nil {
+			t.Fatalf("next: %s", err)
+		}
+		expected := makeAmqpMessage(i)
+		if string(msg.Publishing.Body) != string(expected.Body) || msg.Publishing.MessageId != expected.MessageId {
+			t.Errorf("Wrong message %d: %#v", i, msg.Publishing)
+		}
+	}
+}
+
+func TestCommandWriterExitStatus(t *testing.T) {
+	w, err := startOutputCommand("exit 3")
+	if err != nil {
+		t.Fatalf("startOutputCommand: %s", err)
+	}
+	// The command may exit before or after the message is written.
+	err = w.WriteMessage(amqp091.Delivery{Body: []byte("body")}, 0)
+	if err != nil && err != errReaderClosed {
+		t.Errorf("WriteMessage: %s", err)
+	}
+	err = w.Close()
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Expected the exit status in the error, got %v", err)
+	}
+}
+
+func TestOutputCommandRejectsAck(t *testing.T) {
+	*outputCommand = "cat"
+	*ack = true
+	defer func() {
+		*outputCommand = ""
+		*ack = false
+	}()
+	err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, "tmp-test", false)
+	if err == nil || !strings.Contains(err.Error(), "-output-command can't be combined with -ack") {
+		t.Errorf("Expected -output-command with -ack to be rejected, got %v", err)
+	}
+}
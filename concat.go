@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"syscall"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func concatFilePath(outputDir string) string {
+	return path.Join(outputDir, "dump.txt")
+}
+
+// parseConcatSeparator interprets the Go escapes of -concat-separator, so
+// that e.g. \x1e (the ASCII record separator) can be given on the command
+// line.
+func parseConcatSeparator(separator string) ([]byte, error) {
+	unquoted, err := strconv.Unquote(`"` + separator + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -concat-separator %q", separator)
+	}
+	if unquoted == "" {
+		return nil, fmt.Errorf("-concat-separator can't be empty")
+	}
+	return []byte(unquoted), nil
+}
+
+// concatWriter appends the bodies of all messages to a single file, each one
+// followed by the separator, for text messages such as log lines.  With
+// -concat-header every body is preceded by a "# message N" comment line with
+// its routing key.  Headers and properties are not written.
+type concatWriter struct {
+	output    *bufferedFile
+	separator []byte
+	header    bool
+	ambiguous uint
+}
+
+func openConcatWriter(filePath string, separator []byte, header bool) (*concatWriter, error) {
+	file, interval, err := openOutputFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("concat: %s", err)
+	}
+	return &concatWriter{output: newBufferedFile(file, interval), separator: separator, header: header}, nil
+}
+
+// openConcatOutput opens the -output=concat writer on dump.txt in outputDir,
+// or on outputDir itself if it is a named pipe.
+func openConcatOutput(outputDir string) (*concatWriter, error) {
+	separator, err := parseConcatSeparator(*concatSeparator)
+	if err != nil {
+		return nil, err
+	}
+	filePath := concatFilePath(outputDir)
+	if isNamedPipe(outputDir) {
+		filePath = outputDir
+	}
+	return openConcatWriter(filePath, separator, *concatHeader)
+}
+
+func concatHeaderLine(msg amqp091.Delivery, counter uint) []byte {
+	header := fmt.Sprintf("# message %d", counter)
+	if msg.RoutingKey != "" {
+		header += " routing_key=" + msg.RoutingKey
+	}
+	return []byte(header + "\n")
+}
+
+func (w *concatWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	if bytes.Contains(msg.Body, w.separator) {
+		w.ambiguous++
+	}
+	record := make([]byte, 0, len(msg.Body)+len(w.separator)+64)
+	if w.header {
+		record = append(record, concatHeaderLine(msg, counter)...)
+	}
+	record = append(append(record, msg.Body...), w.separator...)
+
+	err := w.output.writeRecord(record)
+	if errors.Is(err, syscall.EPIPE) {
+		return errReaderClosed
+	}
+	if err != nil {
+		return newDumpError("concat", msg, counter, err)
+	}
+	return nil
+}
+
+// Close warns when bodies contain the separator, since the file can't be
+// split back into the same messages.
+func (w *concatWriter) Close() error {
+	if w.ambiguous > 0 {
+		warningLog("%d message bodies contain the -concat-separator, the dump can't be split back into messages", w.ambiguous)
+	}
+	err := w.output.Close()
+	if errors.Is(err, syscall.EPIPE) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseConcatSeparator(t *testing.T) {
+	for _, test := range []struct {
+		flag     string
+		expected string
+	}{
+		{`\n`, "\n"},
+		{`\x1e`, "\x1e"},
+		{`---\n`, "---\n"},
+	} {
+		separator, err := parseConcatSeparator(test.flag)
+		if err != nil || string(separator) != test.expected {
+			t.Errorf("Wrong separator for %q: %q (%v)", test.flag, separator, err)
+		}
+	}
+	for _, invalid := range []string{"", `\q`, `"`} {
+		if _, err := parseConcatSeparator(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+// writeConcatDump writes messages with a concatWriter and returns the file
+// content.
+func writeConcatDump(t *testing.T, messages []amqp091.Delivery, separator string, header bool) []byte {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-concat")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := openConcatWriter(concatFilePath(dir), []byte(separator), header)
+	if err != nil {
+		t.Fatalf("openConcatWriter: %s", err)
+	}
+	for i, msg := range messages {
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	content, err := ioutil.ReadFile(concatFilePath(dir))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	return content
+}
+
+func TestConcatSplitsBackIntoMessages(t *testing.T) {
+	messages := []amqp091.Delivery{
+		{RoutingKey: "app.info", Body: []byte("service started")},
+		{Body: []byte("multi\nline\nentry")},
+		{RoutingKey: "app.error", Body: []byte("")},
+	}
+
+	content := writeConcatDump(t, messages, "\x1e", false)
+	records := bytes.Split(content, []byte("\x1e"))
+	if len(records) != len(messages)+1 || len(records[len(messages)]) != 0 {
+		t.Fatalf("Expected %d records followed by the separator, got %q", len(messages), content)
+	}
+	for i, msg := range messages {
+		if !bytes.Equal(records[i], msg.Body) {
+			t.Errorf("Wrong body %d: expected %q, got %q", i, msg.Body, records[i])
+		}
+	}
+
+	content = writeConcatDump(t, messages, "\n---\n", true)
+	records = bytes.Split(content, []byte("\n---\n"))
+	if len(records) != len(messages)+1 {
+		t.Fatalf("Expected %d records, got %q", len(messages), content)
+	}
+	expectedHeaders := []string{"# message 0 routing_key=app.info", "# message 1", "# message 2 routing_key=app.error"}
+	for i, msg := range messages {
+		lines := bytes.SplitN(records[i], []byte("\n"), 2)
+		if len(lines) != 2 || string(lines[0]) != expectedHeaders[i] || !bytes.Equal(lines[1], msg.Body) {
+			t.Errorf("Wrong record %d: %q", i, records[i])
+		}
+	}
+}
+
+func TestConcatCountsAmbiguousBodies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-concat")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := openConcatWriter(concatFilePath(dir), []byte("\n"), false)
+	if err != nil {
+		t.Fatalf("openConcatWriter: %s", err)
+	}
+	defer writer.Close()
+	for i, body := range []string{"one line", "two\nlines", "three\nmore\nlines"} {
+		err := writer.WriteMessage(amqp091.Delivery{Body: []byte(body)}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	if writer.ambiguous != 2 {
+		t.Errorf("Expected 2 bodies containing the separator, got %d", writer.ambiguous)
+	}
+}
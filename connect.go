@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// handshakeDialer connects to the broker for -connect-timeout: it bounds the
+// TCP connection, and the TLS and AMQP handshakes with a deadline which
+// amqp091 clears once the connection is open.  amqp091 turns a handshake
+// timeout into a generic frame error, so the connection records whether its
+// deadline expired.
+type handshakeDialer struct {
+	timeout  time.Duration
+	addr     string
+	timedOut int32
+}
+
+func (d *handshakeDialer) dial(network, addr string) (net.Conn, error) {
+	d.addr = addr
+	conn, err := amqp091.DefaultDial(d.timeout)(network, addr)
+	if err != nil {
+		if isTimeout(err) {
+			atomic.StoreInt32(&d.timedOut, 1)
+		}
+		return nil, err
+	}
+	return &handshakeConn{Conn: conn, dialer: d}, nil
+}
+
+// expired reports whether the connection timed out before it was open.
+func (d *handshakeDialer) expired() bool {
+	return atomic.LoadInt32(&d.timedOut) == 1
+}
+
+type handshakeConn struct {
+	net.Conn
+	dialer *handshakeDialer
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && isTimeout(err) {
+		atomic.StoreInt32(&c.dialer.timedOut, 1)
+	}
+	return n, err
+}
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil && isTimeout(err) {
+		atomic.StoreInt32(&c.dialer.timedOut, 1)
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
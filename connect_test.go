@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectTimeout(t *testing.T) {
+	// A broker which accepts the TCP connection but never answers the AMQP
+	// handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		var accepted []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			accepted = append(accepted, conn)
+		}
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	}()
+
+	*connectTimeout = 200 * time.Millisecond
+	defer func() { *connectTimeout = 30 * time.Second }()
+
+	started := time.Now()
+	conn, err := dial("amqp://guest:guest@" + listener.Addr().String() + "/")
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Expected a timeout")
+	}
+	expected := "connection to " + listener.Addr().String() + " timed out after 200ms"
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected error %q, got %q", expected, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Dial took %s", elapsed)
+	}
+}
+
+func TestConnectTimeoutRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = dial("amqp://guest:guest@" + addr + "/")
+	if err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a refused connection, got %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// consumePrefetch is the default basic.qos prefetch count in -consume mode.
+// Stream queues refuse consumers without a prefetch limit.
+const consumePrefetch = 100
+
+// noAckSafePrefetch is the default prefetch count of a -consume peek, which
+// bounds the number of un-acked messages held by the dump.
+const noAckSafePrefetch = 10
+
+// consumerPrefetch is the basic.qos prefetch count of the consumer: the
+// -prefetch value, or the default of the mode.
+func consumerPrefetch() int {
+	if *prefetchCount > 0 {
+		return int(*prefetchCount)
+	}
+	if requeuesEachMessage() {
+		return noAckSafePrefetch
+	}
+	return consumePrefetch
+}
+
+// requeuesEachMessage reports whether the dump requeues every consumed
+// message right after saving or skipping it: in a -consume peek of a queue
+// other than a stream.  A consumer that held them un-acked until the end
+// would stall once a prefetch window of them is waiting, and the dump would
+// end on -idle-timeout as if the queue were empty.  -no-ack-safe asks for
+// the same explicitly.
+func requeuesEachMessage() bool {
+	return *consume && !removesDumped() && *streamOffset == ""
+}
+
+// fetchFunc returns the next message from the queue; ok is false when there
+// are no more messages.
+type fetchFunc func() (msg amqp091.Delivery, ok bool, err error)
+
+// messageGetter is the part of *amqp091.Channel used to pull messages, which
+// tests replace with a fake queue.
+type messageGetter interface {
+	Get(queue string, autoAck bool) (msg amqp091.Delivery, ok bool, err error)
+}
+
+// amqpChannel is the part of *amqp091.Channel used by -mirror to copy a
+// queue: basic.get, queue.declare and publish.  Tests replace it with a fake
+// broker.
+type amqpChannel interface {
+	messageGetter
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp091.Publishing) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error)
+}
+
+// getMessages returns a fetchFunc that pulls messages one at a time with
+// basic.get.
+func getMessages(channel messageGetter, queueName string, autoAck bool) fetchFunc {
+	return func() (amqp091.Delivery, bool, error) {
+		return channel.Get(queueName, autoAck)
+	}
+}
+
+// messageConsumer is the part of *amqp091.Channel used to consume messages,
+// which tests replace with a fake queue.
+type messageConsumer interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	NotifyCancel(c chan string) chan string
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp091.Table) (<-chan amqp091.Delivery, error)
+}
+
+// consumeMessages starts a consumer on the queue, named -consumer-tag and
+// exclusive with -exclusive, and returns a fetchFunc that reports no more
+// messages once none arrived for -idle-timeout, or once the broker cancelled
+// the consumer.
+func consumeMessages(channel messageConsumer, queueName string) (fetchFunc, error) {
+	err := channel.Qos(consumerPrefetch(), 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("Qos: %s", err)
+	}
+
+	args, err := consumerArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	// The channel must be buffered: amqp091 blocks on the notification
+	// before it closes the deliveries channel.
+	cancels := channel.NotifyCancel(make(chan string, 1))
+
+	deliveries, err := channel.Consume(queueName,
+		*consumerTag,
+		false, // autoAck
+		*exclusive,
+		false, // noLocal
+		false, // noWait
+		args,
+	)
+	var amqpErr *amqp091.Error
+	if *exclusive && errors.As(err, &amqpErr) && amqpErr.Code == amqp091.AccessRefused {
+		return nil, fmt.Errorf("-exclusive: queue %q has other consumers (%s)", queueName, amqpErr.Reason)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (amqp091.Delivery, bool, error) {
+		select {
+		case msg, ok := <-deliveries:
+			if !ok {
+				select {
+				case <-cancels:
+					return consumerCancelled(queueName)
+				default:
+				}
+				return msg, false, fmt.Errorf("deliveries channel closed")
+			}
+			return msg, true, nil
+		case <-cancels:
+			return consumerCancelled(queueName)
+		case <-time.After(*idleTimeout):
+			return amqp091.Delivery{}, false, nil
+		}
+	}, nil
+}
+
+// consumerArguments builds the basic.consume arguments from -stream-offset
+// and -consumer-priority.
+func consumerArguments() (amqp091.Table, error) {
+	args := amqp091.Table{}
+	if *streamOffset != "" {
+		offset, err := parseStreamOffset(*streamOffset)
+		if err != nil {
+			return nil, err
+		}
+		args["x-stream-offset"] = offset
+	}
+	if *consumerPriority != 0 {
+		args["x-priority"] = int32(*consumerPriority)
+	}
+	return args, nil
+}
+
+// consumerCancelled ends the dump when the broker cancelled the consumer,
+// e.g. because the queue was deleted.  The messages received so far are
+// kept.
+func consumerCancelled(queueName string) (amqp091.Delivery, bool, error) {
+	warningLog("Consumer cancelled by the broker (queue %q deleted?), stopping", queueName)
+	return amqp091.Delivery{}, false, nil
+}
+
+// acknowledgeSaved acks a message once it was saved with -ack or
+// -purge-matched, when messages are received with manual acks: in -consume
+// mode, and whenever filters are used so that unmatched messages aren't
+// acked automatically. Un-acked messages are requeued when the connection
+// closes. Stream queues need acks to keep delivering but don't remove acked
+// messages, so those are always acknowledged. In a -consume peek the message
+// is requeued right away instead, and with -on-dump=nack-discard it is
+// rejected without requeuing.
+func acknowledgeSaved(msg amqp091.Delivery, manualAck bool) error {
+	if manualAck && requeuesEachMessage() {
+		return msg.Nack(false, true)
+	}
+	if manualAck && dumpDisposition() == "nack-discard" {
+		return msg.Nack(false, false)
+	}
+	if !manualAck || !(dumpDisposition() == "ack" || *purgeMatched || *streamOffset != "") {
+		return nil
+	}
+	return msg.Ack(false)
+}
+
+// dumpDisposition is what happens to a message once it was dumped: the
+// -on-dump value, or by default ack with -ack and requeue otherwise.
+func dumpDisposition() string {
+	if *onDump != "" {
+		return *onDump
+	}
+	if *ack {
+		return "ack"
+	}
+	return "requeue"
+}
+
+// removesDumped reports whether the dumped messages are removed from the
+// queue, by acking or discarding them, or by acking the matched ones with
+// -purge-matched.
+func removesDumped() bool {
+	return dumpDisposition() != "requeue" || *purgeMatched
+}
+
+// stopAtRequeued wraps the fetch of a -consume peek so that it reports no more
+// messages when a message it already returned is delivered again after being
+// requeued, instead of dumping the queue over and over.  Messages are
+// recognized by a hash of their ID, headers and body.  The repeated message
+// is requeued again.  Queues that put requeued messages back at their
+// original position, such as classic queues, deliver them again after about
+// a prefetch window, so stopping before queueDepth messages (the number of
+// messages of the queue when the dump started, or -1 if unknown) is
+// reported as a truncated dump.
+func stopAtRequeued(fetch fetchFunc, queueDepth int) fetchFunc {
+	seen := make(map[[sha256.Size]byte]bool)
+	return func() (amqp091.Delivery, bool, error) {
+		msg, ok, err := fetch()
+		if !ok || err != nil {
+			return msg, ok, err
+		}
+		fingerprint := messageFingerprint(msg)
+		if msg.Redelivered && seen[fingerprint] {
+			if noAckSafeTruncated(len(seen), queueDepth) {
+				warningLog("WARNING: the -consume peek received a requeued message again after %d of the %d messages of the queue, which puts requeued messages back at their position: the dump is truncated", len(seen), queueDepth)
+			} else {
+				verboseLog("Received a requeued message again, stopping")
+			}
+			return amqp091.Delivery{}, false, msg.Nack(false, true)
+		}
+		seen[fingerprint] = true
+		return msg, true, nil
+	}
+}
+
+// noAckSafeTruncated reports whether a -consume peek that stopped after
+// seen distinct messages missed some of the queueDepth messages of the
+// queue.
+func noAckSafeTruncated(seen int, queueDepth int) bool {
+	return queueDepth >= 0 && seen < queueDepth
+}
+
+func messageFingerprint(msg amqp091.Delivery) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %v %d:", msg.MessageId, msg.Headers, len(msg.Body))
+	h.Write(msg.Body)
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+// parseStreamOffset converts a -stream-offset value to the x-stream-offset
+// consumer argument: one of "first", "last" or "next", a numeric offset, or
+// an RFC3339 timestamp.
+func parseStreamOffset(s string) (interface{}, error) {
+	switch s {
+	case "first", "last", "next":
+		return s, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("Invalid stream offset %q", s)
+		}
+		return n, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, s); err == nil {
+		return ts, nil
+	}
+	return nil, fmt.Errorf("Invalid stream offset %q", s)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const testStreamName = "test-rabbitmq-dump-stream"
+
+func TestParseStreamOffset(t *testing.T) {
+	for _, s := range []string{"first", "last", "next"} {
+		offset, err := parseStreamOffset(s)
+		if err != nil || offset != s {
+			t.Errorf("Wrong offset for %q: %#v (%v)", s, offset, err)
+		}
+	}
+
+	offset, err := parseStreamOffset("42")
+	if err != nil || offset != int64(42) {
+		t.Errorf("Wrong numeric offset: %#v (%v)", offset, err)
+	}
+
+	offset, err = parseStreamOffset("2021-12-27T13:04:05Z")
+	expected := time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	ts, ok := offset.(time.Time)
+	if err != nil || !ok || !ts.Equal(expected) {
+		t.Errorf("Wrong timestamp offset: %#v (%v)", offset, err)
+	}
+
+	for _, s := range []string{"", "-1", "yesterday"} {
+		_, err = parseStreamOffset(s)
+		if err == nil {
+			t.Errorf("Expected an error for stream offset %q", s)
+		}
+	}
+}
+
+func TestConsumeStreamOffset(t *testing.T) {
+	conn := dialTestBroker(t)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %s", err)
+	}
+
+	_, err = channel.QueueDeclare(testStreamName, true, false, false, false, amqp091.Table{"x-queue-type": "stream"})
+	if err != nil {
+		t.Skipf("Stream queues not supported by the broker: %s", err)
+	}
+
+	defer func() {
+		channel, err := conn.Channel()
+		if err == nil {
+			channel.QueueDelete(testStreamName, false, false, false)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		err = channel.Publish("", testStreamName, false, false, makeAmqpMessage(i))
+		if err != nil {
+			t.Fatalf("Publish: %s", err)
+		}
+	}
+
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testStreamName, "-consume", "-stream-offset=2", "-idle-timeout=1s", "-output-dir=tmp-test").CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	expectedOutput := "tmp-test/msg-0000\n" +
+		"tmp-test/msg-0001\n" +
+		"tmp-test/msg-0002\n"
+	if string(output) != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0000", "message-2-body")
+	verifyFileContent(t, "tmp-test/msg-0002", "message-4-body")
+}
+
+// testRequeueQueue simulates a queue consumed with a prefetch limit: the
+// broker pushes up to prefetch un-acked messages to the consumer ahead of
+// the ones it is handling.  Nacked messages go back to the head of the queue,
+// like in a classic queue, or to its tail with requeueAtTail.
+type testRequeueQueue struct {
+	ready         []amqp091.Delivery
+	inflight      []amqp091.Delivery
+	unacked       map[uint64]amqp091.Delivery
+	prefetch      int
+	requeueAtTail bool
+	maxUnacked    int
+	nextTag       uint64
+	redelivered   map[string]bool
+}
+
+func newTestRequeueQueue(messages int, prefetch int, requeueAtTail bool) *testRequeueQueue {
+	q := &testRequeueQueue{
+		unacked:       make(map[uint64]amqp091.Delivery),
+		prefetch:      prefetch,
+		requeueAtTail: requeueAtTail,
+		redelivered:   make(map[string]bool),
+	}
+	for i := 0; i < messages; i++ {
+		q.ready = append(q.ready, amqp091.Delivery{MessageId: fmt.Sprintf("msgid-%d", i), Body: []byte(fmt.Sprintf("body-%d", i))})
+	}
+	return q
+}
+
+func (q *testRequeueQueue) fetch() (amqp091.Delivery, bool, error) {
+	for len(q.ready) > 0 && len(q.unacked) < q.prefetch {
+		msg := q.ready[0]
+		q.ready = q.ready[1:]
+		q.nextTag++
+		msg.DeliveryTag = q.nextTag
+		msg.Acknowledger = q
+		msg.Redelivered = q.redelivered[msg.MessageId]
+		q.unacked[msg.DeliveryTag] = msg
+		q.inflight = append(q.inflight, msg)
+	}
+	if len(q.unacked) > q.maxUnacked {
+		q.maxUnacked = len(q.unacked)
+	}
+	if len(q.inflight) == 0 {
+		return amqp091.Delivery{}, false, nil
+	}
+	msg := q.inflight[0]
+	q.inflight = q.inflight[1:]
+	return msg, true, nil
+}
+
+func (q *testRequeueQueue) Ack(tag uint64, multiple bool) error {
+	delete(q.unacked, tag)
+	return nil
+}
+
+func (q *testRequeueQueue) Nack(tag uint64, multiple bool, requeue bool) error {
+	msg := q.unacked[tag]
+	delete(q.unacked, tag)
+	if !requeue {
+		return nil
+	}
+	q.redelivered[msg.MessageId] = true
+	if q.requeueAtTail {
+		q.ready = append(q.ready, msg)
+	} else {
+		q.ready = append([]amqp091.Delivery{msg}, q.ready...)
+	}
+	return nil
+}
+
+func (q *testRequeueQueue) Reject(tag uint64, requeue bool) error {
+	return q.Nack(tag, false, requeue)
+}
+
+func TestNoAckSafeKeepsUnackedBounded(t *testing.T) {
+	*consume = true
+	defer func() { *consume = false }()
+
+	for _, test := range []struct {
+		requeueAtTail bool
+		saved         int
+	}{
+		// A classic queue delivers the first requeued message again right
+		// after the prefetch window.
+		{false, noAckSafePrefetch},
+		{true, 50},
+	} {
+		q := newTestRequeueQueue(50, noAckSafePrefetch, test.requeueAtTail)
+		fetch := stopAtRequeued(q.fetch, 50)
+		saved := 0
+		for {
+			msg, ok, err := fetch()
+			if err != nil {
+				t.Fatalf("fetch: %s", err)
+			}
+			if !ok {
+				break
+			}
+			if msg.MessageId != fmt.Sprintf("msgid-%d", saved) {
+				t.Errorf("Expected msgid-%d, got %s", saved, msg.MessageId)
+			}
+			saved++
+			err = acknowledgeSaved(msg, true)
+			if err != nil {
+				t.Fatalf("acknowledgeSaved: %s", err)
+			}
+		}
+
+		if saved != test.saved {
+			t.Errorf("Requeue at tail %v: expected %d saved messages, got %d", test.requeueAtTail, test.saved, saved)
+		}
+		if truncated := noAckSafeTruncated(saved, 50); truncated != (saved < 50) {
+			t.Errorf("Requeue at tail %v: expected truncated %v after %d messages", test.requeueAtTail, saved < 50, saved)
+		}
+		if q.maxUnacked > noAckSafePrefetch {
+			t.Errorf("Requeue at tail %v: expected at most %d un-acked messages at a time, got %d", test.requeueAtTail, noAckSafePrefetch, q.maxUnacked)
+		}
+		if len(q.ready)+len(q.unacked) != 50 {
+			t.Errorf("Requeue at tail %v: expected all 50 messages back in the queue, got %d ready and %d un-acked", test.requeueAtTail, len(q.ready), len(q.unacked))
+		}
+	}
+	if noAckSafeTruncated(10, -1) {
+		t.Errorf("Expected no truncation when the queue depth is unknown")
+	}
+}
+
+func TestConsumerPrefetch(t *testing.T) {
+	*consume = true
+	defer func() {
+		*consume = false
+		*ack = false
+		*prefetchCount = 0
+	}()
+	for _, test := range []struct {
+		ack      bool
+		prefetch uint
+		expected int
+	}{
+		{false, 0, noAckSafePrefetch},
+		{true, 0, consumePrefetch},
+		{false, 3, 3},
+		{true, 25, 25},
+	} {
+		*ack = test.ack
+		*prefetchCount = test.prefetch
+		consumer := &testConsumer{deliveries: make(chan amqp091.Delivery)}
+		_, err := consumeMessages(consumer, testQueueName)
+		if err != nil {
+			t.Fatalf("consumeMessages: %s", err)
+		}
+		if consumer.prefetch != test.expected {
+			t.Errorf("-ack=%v -prefetch=%d: expected a prefetch of %d, got %d", test.ack, test.prefetch, test.expected, consumer.prefetch)
+		}
+	}
+}
+
+func TestPeekUnackedNeverExceedsPrefetch(t *testing.T) {
+	*consume = true
+	*prefetchCount = 5
+	defer func() {
+		*consume = false
+		*prefetchCount = 0
+	}()
+
+	q := newTestRequeueQueue(30, consumerPrefetch(), true)
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: stopAtRequeued(q.fetch, 30), writer: writer, manualAck: true}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if q.maxUnacked > 5 {
+		t.Errorf("Expected at most 5 un-acked messages, got %d", q.maxUnacked)
+	}
+	if received != 30 || len(q.ready)+len(q.unacked) != 30 {
+		t.Errorf("Expected the 30 messages dumped and left in the queue, got %d dumped, %d ready and %d un-acked", received, len(q.ready), len(q.unacked))
+	}
+}
+
+func TestPeekBrokerUnackedBounded(t *testing.T) {
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+
+	cmd := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-consume", "-prefetch=3", "-idle-timeout=1s", "-max-messages=0", "-output-dir=tmp-test")
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Start()
+	if err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// The broker counts the un-acked messages out of the ready ones.
+	for {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatalf("run: %s: %s", err, output.String())
+			}
+			if length := getTestQueueLength(t); length != 10 {
+				t.Errorf("Expected the 10 messages back in the queue, got %d", length)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if ready := getTestQueueLength(t); ready < 10-3 {
+			cmd.Process.Kill()
+			t.Fatalf("Expected at most 3 un-acked messages during the peek, got %d", 10-ready)
+		}
+	}
+}
+
+func TestConsumeStopsWhenQueueDeleted(t *testing.T) {
+	populateTestQueue(t, 3)
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+
+	cmd := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-consume", "-idle-timeout=30s", "-output-dir=tmp-test")
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Start()
+	if err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	time.Sleep(time.Second)
+	deleteTestQueue(t)
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("run: %s: %s", err, output.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("Dump didn't stop after the queue was deleted: %s", output.String())
+	}
+	if !strings.Contains(output.String(), "Consumer cancelled by the broker") {
+		t.Errorf("Missing cancellation message in output: %s", output.String())
+	}
+	verifyFileContent(t, "tmp-test/msg-0002", "message-2-body")
+}
+
+func TestConsumerArguments(t *testing.T) {
+	args, err := consumerArguments()
+	if err != nil || len(args) != 0 {
+		t.Errorf("Expected no arguments by default, got %v (%v)", args, err)
+	}
+
+	*consumerPriority = -5
+	*streamOffset = "first"
+	defer func() {
+		*consumerPriority = 0
+		*streamOffset = ""
+	}()
+	args, err = consumerArguments()
+	if err != nil {
+		t.Fatalf("consumerArguments: %s", err)
+	}
+	if priority, ok := args["x-priority"].(int32); !ok || priority != -5 {
+		t.Errorf("Wrong x-priority argument: %#v", args["x-priority"])
+	}
+	if args["x-stream-offset"] != "first" {
+		t.Errorf("Wrong x-stream-offset argument: %#v", args["x-stream-offset"])
+	}
+}
+
+// testConsumer is a fake channel for consumeMessages that records the
+// consumer it was asked to start.
+type testConsumer struct {
+	prefetch   int
+	tag        string
+	exclusive  bool
+	deliveries chan amqp091.Delivery
+	consumeErr error
+}
+
+func (c *testConsumer) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.prefetch = prefetchCount
+	return nil
+}
+
+func (c *testConsumer) NotifyCancel(cancels chan string) chan string {
+	return cancels
+}
+
+func (c *testConsumer) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp091.Table) (<-chan amqp091.Delivery, error) {
+	c.tag = consumer
+	c.exclusive = exclusive
+	return c.deliveries, c.consumeErr
+}
+
+func TestConsumeTagAndExclusive(t *testing.T) {
+	*consumerTag = "nightly-dump"
+	*exclusive = true
+	defer func() {
+		*consumerTag = ""
+		*exclusive = false
+	}()
+
+	consumer := &testConsumer{deliveries: make(chan amqp091.Delivery, 1)}
+	consumer.deliveries <- amqp091.Delivery{ConsumerTag: "nightly-dump", Body: []byte("body")}
+	close(consumer.deliveries)
+	fetch, err := consumeMessages(consumer, testQueueName)
+	if err != nil {
+		t.Fatalf("consumeMessages: %s", err)
+	}
+	if consumer.tag != "nightly-dump" || !consumer.exclusive {
+		t.Errorf("Expected an exclusive consumer tagged nightly-dump, got %q (exclusive %v)", consumer.tag, consumer.exclusive)
+	}
+	msg, ok, err := fetch()
+	if err != nil || !ok || string(msg.Body) != "body" {
+		t.Errorf("Wrong message: %+v (%v, %v)", msg, ok, err)
+	}
+
+	consumer = &testConsumer{consumeErr: &amqp091.Error{
+		Code:   amqp091.AccessRefused,
+		Reason: "ACCESS_REFUSED - queue '" + testQueueName + "' in vhost '/' in exclusive use",
+	}}
+	_, err = consumeMessages(consumer, testQueueName)
+	if err == nil || !strings.Contains(err.Error(), "-exclusive: queue \""+testQueueName+"\" has other consumers") {
+		t.Errorf("Expected a clear -exclusive error, got %v", err)
+	}
+}
+
+func TestConsumeExclusiveConflict(t *testing.T) {
+	populateTestQueue(t, 3)
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+
+	conn := dialTestBroker(t)
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %s", err)
+	}
+	err = channel.Qos(1, 0, false)
+	if err != nil {
+		t.Fatalf("Qos: %s", err)
+	}
+	_, err = channel.Consume(testQueueName, "other-consumer", false, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("Consume: %s", err)
+	}
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-consume", "-exclusive", "-consumer-tag=dump", "-idle-timeout=1s", "-output-dir=tmp-test").CombinedOutput()
+	if err == nil {
+		t.Fatalf("Expected -exclusive to fail with another consumer: %s", output)
+	}
+	if !strings.Contains(string(output), "has other consumers") {
+		t.Errorf("Expected a clear -exclusive error, got: %s", output)
+	}
+}
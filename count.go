@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+)
+
+// queueCounts holds the number of messages in a queue. Unacknowledged is -1
+// when only the AMQP count is available.
+type queueCounts struct {
+	Ready          int
+	Unacknowledged int
+	Consumers      int
+}
+
+func (c queueCounts) String() string {
+	s := fmt.Sprintf("ready: %d\n", c.Ready)
+	if c.Unacknowledged >= 0 {
+		s += fmt.Sprintf("unacknowledged: %d\n", c.Unacknowledged)
+	}
+	s += fmt.Sprintf("consumers: %d\n", c.Consumers)
+	return s
+}
+
+// countMessages reports the number of messages in the queue without
+// receiving any. A passive queue declaration only returns the number of
+// ready messages; the ready/unacknowledged split comes from the management
+// HTTP API when -management-url or management credentials are given.
+func countMessages(amqpURI string, queueName string) (queueCounts, error) {
+	if queueName == "" {
+		return queueCounts{}, fmt.Errorf("Must supply queue name")
+	}
+
+	if useManagementAPI() {
+		queue, err := getManagementQueue(*managementURL, amqpURI, queueName)
+		if err != nil {
+			return queueCounts{}, fmt.Errorf("Management API: %s", err)
+		}
+		return queueCounts{
+			Ready:          queue.MessagesReady,
+			Unacknowledged: queue.MessagesUnacknowledged,
+			Consumers:      queue.Consumers,
+		}, nil
+	}
+
+	conn, err := dial(amqpURI)
+	if err != nil {
+		return queueCounts{}, fmt.Errorf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return queueCounts{}, fmt.Errorf("Channel: %s", err)
+	}
+
+	queue, err := channel.QueueDeclarePassive(queueName, false, false, false, false, nil)
+	if err != nil {
+		return queueCounts{}, fmt.Errorf("Queue declare: %s", err)
+	}
+	return queueCounts{
+		Ready:          queue.Messages,
+		Unacknowledged: -1,
+		Consumers:      queue.Consumers,
+	}, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// dumpLoop moves the messages returned by fetch to writer, applying the
+// filters, acknowledgements and error handling of a dump.  It only talks to
+// the broker through fetch and the Acknowledger of the messages, so tests can
+// run it without one.
+type dumpLoop struct {
+	fetch       fetchFunc
+	writer      messageWriter
+	maxMessages uint
+	filters     []messageFilter
+	manualAck   bool
+	errorLog    *errorRecorder
+	manifest    *dumpManifest
+	pause       *pauseController
+	sizes       *bodySizeReport
+	summary     *dumpSummary
+	acks        *ackBatcher
+}
+
+// run dumps messages until the queue is empty or maxMessages were received,
+// and returns the number of messages received, not counting the ones
+// skipped by the filters.
+func (d *dumpLoop) run() (uint, error) {
+	messagesReceived := uint(0)
+	var unsaved []amqp091.Delivery
+	for d.maxMessages == 0 || messagesReceived < d.maxMessages {
+		d.pause.waitWhilePaused(messagesReceived)
+
+		msg, ok, err := d.fetch()
+		receivedAt := time.Now()
+		if err == errRuntimeExceeded {
+			return messagesReceived, fmt.Errorf("Maximum runtime of %s exceeded after %d messages", *maxRuntime, messagesReceived)
+		}
+		if err != nil {
+			return messagesReceived, fmt.Errorf("Queue get: %s", err)
+		}
+
+		if !ok {
+			verboseLog("No more messages in queue")
+			break
+		}
+
+		matched := matchesFilters(d.filters, msg)
+		d.sizes.add(matched, len(msg.Body))
+		if !matched {
+			err = disposeUnmatched(msg)
+			if err != nil {
+				return messagesReceived, fmt.Errorf("Ack: %s", err)
+			}
+			d.manifest.messageFiltered()
+			d.summary.skip("filtered out")
+			continue
+		}
+
+		if *canonicalizeJSON {
+			msg.Body = canonicalJSON(msg.Body)
+		}
+		if *protoReplace {
+			msg = protoBodies.replaceProtoBody(msg)
+		}
+		if stripsHeaders() {
+			msg.Headers = stripHeaders(msg.Headers)
+		}
+
+		counter := messagesReceived
+		messagesReceived++
+		d.manifest.messageReceived(len(msg.Body))
+
+		err = d.writer.WriteMessage(msg, counter)
+		// A duplicate is already saved, so it is acked like a saved message.
+		duplicate := err == errDuplicateMessage
+		if duplicate {
+			err = nil
+		}
+		if err == errReaderClosed {
+			verboseLog("Output reader closed, stopping")
+			unsaved = append(unsaved, msg)
+			break
+		}
+		if err != nil {
+			unsaved = append(unsaved, msg)
+			if d.errorLog == nil {
+				if requeueErr := d.requeue(unsaved); requeueErr != nil {
+					warningLog("%s", requeueErr)
+				}
+				return messagesReceived, err
+			}
+			err = d.errorLog.record(counter, msg.MessageId, err)
+			if err != nil {
+				return messagesReceived, fmt.Errorf("Error file: %s", err)
+			}
+			d.summary.skip("failed")
+			continue
+		}
+		if duplicate {
+			d.summary.skip("duplicate")
+		} else {
+			d.summary.saved(len(msg.Body))
+			d.summary.received(msg.Timestamp, receivedAt)
+		}
+
+		if d.acks != nil {
+			err = d.acks.add(msg)
+		} else {
+			err = acknowledgeSaved(msg, d.manualAck)
+		}
+		if err != nil {
+			return messagesReceived, fmt.Errorf("Ack: %s", err)
+		}
+	}
+
+	if flusher, ok := d.writer.(messageFlusher); ok {
+		for _, failure := range flusher.flush() {
+			var dumpErr *DumpError
+			if d.errorLog == nil || !errors.As(failure, &dumpErr) {
+				return messagesReceived, failure
+			}
+			err := d.errorLog.record(dumpErr.Counter, dumpErr.MessageID, failure)
+			if err != nil {
+				return messagesReceived, fmt.Errorf("Error file: %s", err)
+			}
+			d.summary.saveFailed()
+		}
+	}
+
+	return messagesReceived, d.requeue(unsaved)
+}
+
+// requeue returns the messages that the writer failed to save, e.g. because
+// the webhook or Kafka output didn't confirm them, to the queue so that they
+// are not lost.  They are only requeued once the loop stopped fetching, since
+// basic.get would return them again right away.  Auto-acked messages are
+// already gone, and stream queues keep every message anyway.
+func (d *dumpLoop) requeue(messages []amqp091.Delivery) error {
+	if (dumpDisposition() == "ack" && !d.manualAck) || *streamOffset != "" {
+		return nil
+	}
+	for _, msg := range messages {
+		err := msg.Nack(false, true)
+		if err != nil {
+			return fmt.Errorf("Requeue: %s", err)
+		}
+	}
+	if len(messages) > 0 {
+		verboseLog(fmt.Sprintf("Requeued %d messages that were not saved", len(messages)))
+	}
+	return nil
+}
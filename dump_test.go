@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// testBroker is a fake amqpChannel with a single queue that records the
+// acks of its deliveries, and the queues declared and the messages published.  With confirms,
+// every publish is confirmed on it.  It may be used by several goroutines,
+// like the channels of -channels.
+type testBroker struct {
+	mu        sync.Mutex
+	queue     string
+	ready     []amqp091.Delivery
+	getErr    error
+	nextTag   uint64
+	acked     []uint64
+	requeued  []uint64
+	discarded []uint64
+	declared  []string
+	published map[string][]amqp091.Publishing
+	confirms  chan amqp091.Confirmation
+}
+
+func newTestBroker(messages int) *testBroker {
+	b := &testBroker{queue: testQueueName}
+	for i := 0; i < messages; i++ {
+		b.ready = append(b.ready, amqp091.Delivery{
+			MessageId: fmt.Sprintf("msgid-%d", i),
+			Body:      []byte(fmt.Sprintf("message-%d-body", i)),
+		})
+	}
+	return b
+}
+
+func (b *testBroker) Get(queue string, autoAck bool) (amqp091.Delivery, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if queue != b.queue {
+		return amqp091.Delivery{}, false, fmt.Errorf("NOT_FOUND - no queue '%s'", queue)
+	}
+	if len(b.ready) == 0 {
+		return amqp091.Delivery{}, false, b.getErr
+	}
+	msg := b.ready[0]
+	b.ready = b.ready[1:]
+	b.nextTag++
+	msg.DeliveryTag = b.nextTag
+	msg.Acknowledger = b
+	if autoAck {
+		b.acked = append(b.acked, msg.DeliveryTag)
+	}
+	return msg, true, nil
+}
+
+func (b *testBroker) Ack(tag uint64, multiple bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.acked = append(b.acked, tag)
+	return nil
+}
+
+func (b *testBroker) Nack(tag uint64, multiple bool, requeue bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if requeue {
+		b.requeued = append(b.requeued, tag)
+	} else {
+		b.discarded = append(b.discarded, tag)
+	}
+	return nil
+}
+
+func (b *testBroker) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
+
+func (b *testBroker) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if name == "" {
+		name = fmt.Sprintf("amq.gen-%d", len(b.declared))
+	}
+	b.declared = append(b.declared, name)
+	return amqp091.Queue{Name: name}, nil
+}
+
+func (b *testBroker) Publish(exchange, key string, mandatory, immediate bool, msg amqp091.Publishing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.published == nil {
+		b.published = make(map[string][]amqp091.Publishing)
+	}
+	b.published[key] = append(b.published[key], msg)
+	if b.confirms != nil {
+		b.confirms <- amqp091.Confirmation{DeliveryTag: uint64(len(b.published[key])), Ack: true}
+	}
+	return nil
+}
+
+// testWriter records the messages and bodies it is given, fails for the
+// counters in failAt and reports the ones in duplicateAt as duplicates.
+type testWriter struct {
+	messages    []amqp091.Delivery
+	bodies      []string
+	failAt      map[uint]bool
+	duplicateAt map[uint]bool
+}
+
+func (w *testWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	if w.failAt[counter] {
+		return newDumpError("save message", msg, counter, errors.New("disk full"))
+	}
+	if w.duplicateAt[counter] {
+		return errDuplicateMessage
+	}
+	w.messages = append(w.messages, msg)
+	w.bodies = append(w.bodies, string(msg.Body))
+	return nil
+}
+
+func (w *testWriter) Close() error {
+	return nil
+}
+
+func TestDumpLoopMaxMessages(t *testing.T) {
+	broker := newTestBroker(5)
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, maxMessages: 3}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 3 || len(writer.bodies) != 3 || writer.bodies[2] != "message-2-body" {
+		t.Errorf("Expected the first 3 messages, got %d: %v", received, writer.bodies)
+	}
+	if len(broker.ready) != 2 || len(broker.acked) != 0 {
+		t.Errorf("Expected 2 messages left and no acks, got %d left and acks %v", len(broker.ready), broker.acked)
+	}
+}
+
+func TestDumpLoopUnlimited(t *testing.T) {
+	broker := newTestBroker(5)
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, true), writer: writer}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 5 || len(broker.acked) != 5 {
+		t.Errorf("Expected 5 auto-acked messages, got %d (acks %v)", received, broker.acked)
+	}
+}
+
+func TestDumpLoopEmptyQueue(t *testing.T) {
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: getMessages(newTestBroker(0), testQueueName, false), writer: writer, maxMessages: 10}
+	received, err := loop.run()
+	if err != nil || received != 0 || len(writer.bodies) != 0 {
+		t.Errorf("Expected an empty dump, got %d messages (%v)", received, err)
+	}
+}
+
+func TestDumpLoopGetError(t *testing.T) {
+	broker := newTestBroker(2)
+	broker.getErr = errors.New("channel/connection is not open")
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer}
+	received, err := loop.run()
+	if err == nil || !strings.Contains(err.Error(), "Queue get: channel/connection is not open") {
+		t.Errorf("Expected the get error, got %v", err)
+	}
+	if received != 2 {
+		t.Errorf("Expected 2 messages before the error, got %d", received)
+	}
+
+	loop = &dumpLoop{fetch: getMessages(broker, "missing-queue", false), writer: writer}
+	_, err = loop.run()
+	if err == nil || !strings.Contains(err.Error(), "NOT_FOUND") {
+		t.Errorf("Expected a NOT_FOUND error, got %v", err)
+	}
+}
+
+func TestDumpLoopWriteError(t *testing.T) {
+	*ack = true
+	defer func() { *ack = false }()
+
+	broker := newTestBroker(3)
+	writer := &testWriter{failAt: map[uint]bool{1: true}}
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, manualAck: true}
+	_, err := loop.run()
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) || dumpErr.Counter != 1 || dumpErr.MessageID != "msgid-1" {
+		t.Fatalf("Expected the write error of message 1, got %v", err)
+	}
+	if fmt.Sprint(broker.acked) != "[1]" {
+		t.Errorf("Only the saved message should be acked, got acks %v", broker.acked)
+	}
+
+	broker = newTestBroker(3)
+	writer = &testWriter{failAt: map[uint]bool{1: true}}
+	loop = &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, manualAck: true, errorLog: newStderrRecorder()}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run with an error log: %s", err)
+	}
+	if received != 3 || loop.errorLog.failures() != 1 || fmt.Sprint(writer.bodies) != "[message-0-body message-2-body]" {
+		t.Errorf("Expected to skip the failed message, got %d received, %d failures, %v", received, loop.errorLog.failures(), writer.bodies)
+	}
+	if fmt.Sprint(broker.acked) != "[1 3]" {
+		t.Errorf("The failed message should not be acked, got acks %v", broker.acked)
+	}
+}
+
+func TestDumpLoopDuplicates(t *testing.T) {
+	*ack = true
+	defer func() { *ack = false }()
+
+	broker := newTestBroker(3)
+	summary := newDumpSummary("/tmp/dump")
+	writer := &testWriter{duplicateAt: map[uint]bool{0: true, 2: true}}
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, manualAck: true, summary: summary}
+	_, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if summary.dumped != 1 || summary.skipped["duplicate"] != 2 {
+		t.Errorf("Expected 1 dumped and 2 duplicate messages, got %d and %v", summary.dumped, summary.skipped)
+	}
+	if fmt.Sprint(broker.acked) != "[1 2 3]" {
+		t.Errorf("Expected the duplicates to be acked as saved, got acks %v", broker.acked)
+	}
+}
+
+func TestDumpLoopFilters(t *testing.T) {
+	broker := newTestBroker(4)
+	writer := &testWriter{}
+	even := func(msg amqp091.Delivery) bool { return msg.DeliveryTag%2 == 0 }
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, filters: []messageFilter{even}, manualAck: true}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 2 || fmt.Sprint(writer.bodies) != "[message-1-body message-3-body]" {
+		t.Errorf("Expected the 2 matching messages, got %d: %v", received, writer.bodies)
+	}
+	if len(broker.acked) != 0 || len(broker.requeued) != 0 {
+		t.Errorf("Expected the unmatched messages to be left un-acked, got acks %v", broker.acked)
+	}
+
+	*requeueUnmatched = false
+	defer func() { *requeueUnmatched = true }()
+	broker = newTestBroker(4)
+	loop = &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: &testWriter{}, filters: []messageFilter{even}, manualAck: true}
+	_, err = loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if fmt.Sprint(broker.acked) != "[1 3]" {
+		t.Errorf("Expected the unmatched messages to be acked, got acks %v", broker.acked)
+	}
+}
+
+func TestDumpLoopPurgeMatched(t *testing.T) {
+	*purgeMatched = true
+	defer func() { *purgeMatched = false }()
+
+	broker := newTestBroker(5)
+	writer := &testWriter{}
+	poison := func(msg amqp091.Delivery) bool { return msg.MessageId == "msgid-1" || msg.MessageId == "msgid-3" }
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, filters: []messageFilter{poison}, manualAck: true}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 2 || fmt.Sprint(writer.bodies) != "[message-1-body message-3-body]" {
+		t.Errorf("Expected the 2 matching messages to be dumped, got %d: %v", received, writer.bodies)
+	}
+	if fmt.Sprint(broker.acked) != "[2 4]" {
+		t.Errorf("Expected only the matching messages to be acked, got acks %v", broker.acked)
+	}
+}
+
+func TestDumpLoopOnDump(t *testing.T) {
+	defer func() { *onDump = "" }()
+	for disposition, expected := range map[string]string{
+		"ack":          "acked [1 2 3], requeued [], discarded []",
+		"nack-discard": "acked [], requeued [], discarded [1 2 3]",
+		"requeue":      "acked [], requeued [], discarded []",
+	} {
+		*onDump = disposition
+		broker := newTestBroker(3)
+		writer := &testWriter{}
+		// As set up by dumpMessagesFromQueue.
+		manualAck := dumpDisposition() == "nack-discard"
+		loop := &dumpLoop{fetch: getMessages(broker, testQueueName, dumpDisposition() == "ack" && !manualAck), writer: writer, manualAck: manualAck}
+		received, err := loop.run()
+		if err != nil {
+			t.Fatalf("run: %s", err)
+		}
+		got := fmt.Sprintf("acked %v, requeued %v, discarded %v", broker.acked, broker.requeued, broker.discarded)
+		if received != 3 || got != expected {
+			t.Errorf("-on-dump=%s: expected 3 messages %s, got %d %s", disposition, expected, received, got)
+		}
+	}
+
+	// With filters, the dumped messages are disposed of one by one.
+	*onDump = "nack-discard"
+	broker := newTestBroker(3)
+	matching := func(msg amqp091.Delivery) bool { return msg.MessageId != "msgid-1" }
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: &testWriter{}, filters: []messageFilter{matching}, manualAck: true}
+	_, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if fmt.Sprint(broker.discarded) != "[1 3]" || len(broker.acked) != 0 {
+		t.Errorf("Expected only the dumped messages to be discarded: acked %v, discarded %v", broker.acked, broker.discarded)
+	}
+}
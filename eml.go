@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// emlExtension is appended to the body file of email messages with
+// -output=eml, so that they open in mail clients.
+const emlExtension = ".eml"
+
+// isEmailMessage reports whether msg carries an RFC 822 email: its content
+// type is message/rfc822, or it is text/plain (or has no content type) and
+// the body starts with a header block that has a From header and a Subject,
+// To or Date header.
+func isEmailMessage(msg amqp091.Delivery) bool {
+	mediaType, _, err := mime.ParseMediaType(msg.ContentType)
+	if err != nil {
+		mediaType = ""
+	}
+	switch mediaType {
+	case "message/rfc822":
+		return true
+	case "text/plain", "":
+	default:
+		return false
+	}
+
+	email, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+	if err != nil {
+		return false
+	}
+	header := email.Header
+	return header.Get("From") != "" &&
+		(header.Get("Subject") != "" || header.Get("To") != "" || header.Get("Date") != "")
+}
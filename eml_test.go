@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const testEmail = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Order 42 shipped\r\n" +
+	"\r\n" +
+	"Your order is on its way.\r\n"
+
+func TestIsEmailMessage(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		expected    bool
+	}{
+		{"message/rfc822", "not even headers", true},
+		{"text/plain", testEmail, true},
+		{"text/plain; charset=utf-8", testEmail, true},
+		{"", testEmail, true},
+		{"text/plain", "From: alice@example.com\n\nno subject, recipient or date", false},
+		{"text/plain", "Subject: no sender\n\nbody", false},
+		{"text/plain", "just some text", false},
+		{"application/json", testEmail, false},
+	}
+	for _, test := range tests {
+		msg := amqp091.Delivery{ContentType: test.contentType, Body: []byte(test.body)}
+		if isEmail := isEmailMessage(msg); isEmail != test.expected {
+			t.Errorf("isEmailMessage(%q, %q): expected %v, got %v", test.contentType, test.body, test.expected, isEmail)
+		}
+	}
+}
+
+func TestEmlOutput(t *testing.T) {
+	*output = "eml"
+	*full = true
+	defer func() {
+		*output = "files"
+		*full = false
+	}()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-eml")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := openMessageWriter(dir, false)
+	if err != nil {
+		t.Fatalf("openMessageWriter: %s", err)
+	}
+	messages := []amqp091.Delivery{
+		{ContentType: "text/plain", Body: []byte(testEmail)},
+		{ContentType: "application/json", Body: []byte(`{"order": 42}`)},
+	}
+	for i, msg := range messages {
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	writer.Close()
+
+	verifyFileContent(t, generateFilePath(dir, 0)+emlExtension, testEmail)
+	verifyFileContent(t, generateFilePath(dir, 1), `{"order": 42}`)
+	if _, err := os.Stat(generateFilePath(dir, 0) + emlExtension + metadataFileSuffix); err != nil {
+		t.Errorf("Missing metadata file of the email: %s", err)
+	}
+
+	dumped, orphans, err := findDumpedMessages(dir)
+	if err != nil || len(orphans) > 0 || len(dumped) != 2 {
+		t.Fatalf("Expected 2 dumped messages, got %v, orphans %v (%v)", dumped, orphans, err)
+	}
+	if dumped[0].BodyPath != generateFilePath(dir, 0)+emlExtension {
+		t.Errorf("Wrong body path of the email: %s", dumped[0].BodyPath)
+	}
+	err = verifyDump(dir)
+	if err != nil {
+		t.Errorf("verifyDump: %s", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errorRecord is a single line of the -error-file.
+type errorRecord struct {
+	Counter   uint   `json:"counter"`
+	MessageID string `json:"message_id,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// errorRecorder writes failures as newline-delimited JSON records. A nil
+// recorder means neither -error-file nor -continue-on-error was given and
+// failures are fatal.
+type errorRecorder struct {
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	count   int
+}
+
+func openErrorFile(errorFilePath string) (*errorRecorder, error) {
+	if errorFilePath == "" {
+		return nil, nil
+	}
+	file, err := os.Create(errorFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return &errorRecorder{
+		path:    errorFilePath,
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// newStderrRecorder returns a recorder for -continue-on-error without
+// -error-file, which prints the failures to stderr.
+func newStderrRecorder() *errorRecorder {
+	return &errorRecorder{}
+}
+
+func (r *errorRecorder) record(counter uint, messageID string, failure error) error {
+	r.count++
+	if r.encoder == nil {
+		warningLog("Message %d failed: %s", counter, failure)
+		return nil
+	}
+	verboseLog(fmt.Sprintf("Message %d failed: %s", counter, failure))
+	reason := failure.Error()
+	var dumpErr *DumpError
+	if errors.As(failure, &dumpErr) {
+		// The counter and message ID already have their own fields.
+		reason = fmt.Sprintf("%s: %s", dumpErr.Op, dumpErr.Err)
+	}
+	return r.encoder.Encode(errorRecord{
+		Counter:   counter,
+		MessageID: messageID,
+		Reason:    reason,
+	})
+}
+
+func (r *errorRecorder) failures() int {
+	if r == nil {
+		return 0
+	}
+	return r.count
+}
+
+// report prints the number of recorded failures, and returns an error if
+// there were any and -fail-on-errors or -continue-on-error is set.
+func (r *errorRecorder) report() error {
+	if r == nil || r.count == 0 {
+		return nil
+	}
+	if r.path != "" {
+		warningLog("%d messages failed, see %s", r.count, r.path)
+	} else {
+		warningLog("%d messages failed", r.count)
+	}
+	if *failOnErrors || *continueOnError {
+		return fmt.Errorf("%d messages failed", r.count)
+	}
+	return nil
+}
+
+func (r *errorRecorder) Close() error {
+	if r == nil || r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
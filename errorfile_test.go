@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func readErrorFile(t *testing.T, errorFilePath string) []errorRecord {
+	content, err := ioutil.ReadFile(errorFilePath)
+	if err != nil {
+		t.Fatalf("Error reading %s: %s", errorFilePath, err)
+	}
+	var records []errorRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var record errorRecord
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("Error unmarshaling JSON: %s", err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestErrorFileRecordsWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-errors")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	errorFilePath := path.Join(dir, "errors.jsonl")
+	errorLog, err := openErrorFile(errorFilePath)
+	if err != nil {
+		t.Fatalf("openErrorFile: %s", err)
+	}
+
+	msg := amqp091.Delivery{MessageId: "msgid-7", Body: []byte("body")}
+	writer := &filesWriter{outputDir: path.Join(dir, "does-not-exist")}
+	err = writer.WriteMessage(msg, 7)
+	if err == nil {
+		t.Fatalf("Expected saving to a missing directory to fail")
+	}
+	err = errorLog.record(7, msg.MessageId, err)
+	if err != nil {
+		t.Fatalf("record: %s", err)
+	}
+	err = errorLog.record(8, "", fmt.Errorf("publish rejected"))
+	if err != nil {
+		t.Fatalf("record: %s", err)
+	}
+	errorLog.Close()
+
+	records := readErrorFile(t, errorFilePath)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 error records, got %#v", records)
+	}
+	if records[0].Counter != 7 || records[0].MessageID != "msgid-7" || !strings.Contains(records[0].Reason, "save message") {
+		t.Errorf("Wrong error record: %#v", records[0])
+	}
+	if records[1].Counter != 8 || records[1].Reason != "publish rejected" {
+		t.Errorf("Wrong error record: %#v", records[1])
+	}
+}
+
+func TestErrorFileReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-errors")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	errorLog, err := openErrorFile(path.Join(dir, "errors.jsonl"))
+	if err != nil {
+		t.Fatalf("openErrorFile: %s", err)
+	}
+	defer errorLog.Close()
+
+	if errorLog.report() != nil {
+		t.Errorf("Expected no error without recorded failures")
+	}
+
+	errorLog.record(0, "", fmt.Errorf("write error"))
+	if errorLog.report() != nil {
+		t.Errorf("Expected no error without -fail-on-errors")
+	}
+
+	*failOnErrors = true
+	defer func() { *failOnErrors = false }()
+	if errorLog.report() == nil {
+		t.Errorf("Expected an error with -fail-on-errors")
+	}
+}
+
+func TestVerifyRecordsErrors(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(path.Join(dir, "msg-0001"+metadataFileSuffix), []byte(`not json`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	errorFilePath := path.Join(dir, "errors.jsonl")
+	*errorFile = errorFilePath
+	defer func() { *errorFile = "" }()
+
+	if verifyDump(dir) == nil {
+		t.Errorf("Expected verification to fail")
+	}
+
+	records := readErrorFile(t, errorFilePath)
+	if len(records) != 1 || records[0].Counter != 1 {
+		t.Errorf("Wrong error records: %#v", records)
+	}
+}
+
+func TestContinueOnErrorWithoutErrorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-errors")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*continueOnError = true
+	defer func() { *continueOnError = false }()
+
+	errorLog := newStderrRecorder()
+	defer errorLog.Close()
+
+	// Saving to a missing directory fails for the first message only.
+	writer := &filesWriter{outputDir: path.Join(dir, "created-later")}
+	for counter := uint(0); counter < 3; counter++ {
+		msg := amqp091.Delivery{MessageId: fmt.Sprintf("msgid-%d", counter), Body: []byte("body")}
+		err = writer.WriteMessage(msg, counter)
+		if err != nil {
+			err = errorLog.record(counter, msg.MessageId, err)
+			if err != nil {
+				t.Fatalf("record: %s", err)
+			}
+		}
+		os.MkdirAll(writer.outputDir, 0775)
+	}
+
+	if errorLog.failures() != 1 {
+		t.Errorf("Expected 1 failure, got %d", errorLog.failures())
+	}
+	verifyFileContent(t, generateFilePath(writer.outputDir, 2), "body")
+	if errorLog.report() == nil {
+		t.Errorf("Expected an error with -continue-on-error")
+	}
+}
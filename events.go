@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// eventLogger receives the operational messages of the tool instead of the
+// terminal with -syslog; *syslog.Writer implements it.
+type eventLogger interface {
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// events is the -syslog logger, nil when the messages go to the terminal.
+var events eventLogger
+
+func verboseLog(msg string) {
+	if !*verbose {
+		return
+	}
+	if events != nil {
+		events.Info(msg)
+		return
+	}
+	fmt.Println("*", msg)
+}
+
+// noticeLog reports a change of state, such as a pause, on stderr or at the
+// info level of syslog.
+func noticeLog(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if events != nil {
+		events.Info(msg)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "* %s\n", msg)
+}
+
+// warningLog reports a problem that doesn't stop the dump on stderr or at the
+// warning level of syslog.
+func warningLog(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if events != nil {
+		events.Warning(msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// errorLogExit reports the error that ended the tool and exits; with
+// -syslog it is also printed to stderr, so that scripts still see it.
+func errorLogExit(err error) {
+	if events != nil {
+		events.Err(err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", err)
+	os.Exit(1)
+}
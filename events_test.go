@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testEvents records the messages sent to syslog.
+type testEvents struct {
+	messages []string
+}
+
+func (e *testEvents) Info(m string) error {
+	e.messages = append(e.messages, "info: "+m)
+	return nil
+}
+
+func (e *testEvents) Warning(m string) error {
+	e.messages = append(e.messages, "warning: "+m)
+	return nil
+}
+
+func (e *testEvents) Err(m string) error {
+	e.messages = append(e.messages, "err: "+m)
+	return nil
+}
+
+func TestEventsGoToSyslog(t *testing.T) {
+	recorder := &testEvents{}
+	events = recorder
+	defer func() { events = nil }()
+
+	verboseLog("Not verbose")
+	*verbose = true
+	defer func() { *verbose = false }()
+	verboseLog("Pulling messages from queue \"incoming_1\"")
+	noticeLog("Paused after %d messages", 5)
+	warningLog("Message %d failed: %s", 3, "disk full")
+
+	expected := `[info: Pulling messages from queue "incoming_1" info: Paused after 5 messages warning: Message 3 failed: disk full]`
+	if fmt.Sprint(recorder.messages) != expected {
+		t.Errorf("Wrong syslog messages:\n%v\nexpected:\n%s", recorder.messages, expected)
+	}
+}
+
+func TestDumpLoopFailuresGoToSyslog(t *testing.T) {
+	recorder := &testEvents{}
+	events = recorder
+	defer func() { events = nil }()
+
+	writer := &testWriter{failAt: map[uint]bool{0: true}}
+	loop := &dumpLoop{fetch: getMessages(newTestBroker(1), testQueueName, false), writer: writer, errorLog: newStderrRecorder()}
+	_, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	expected := `[warning: Message 0 failed: save message: message 0 (message_id "msgid-0"): disk full]`
+	if fmt.Sprint(recorder.messages) != expected {
+		t.Errorf("Wrong syslog messages:\n%v\nexpected:\n%s", recorder.messages, expected)
+	}
+}
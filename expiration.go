@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseExpiration parses the expiration property of a message, the
+// per-message TTL in milliseconds as a decimal string.  ok is false for
+// messages without an expiration.
+func parseExpiration(expiration string) (ttl time.Duration, ok bool, err error) {
+	if expiration == "" {
+		return 0, false, nil
+	}
+	ms, err := strconv.ParseUint(expiration, 10, 63)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid expiration %q", expiration)
+	}
+	if ms > uint64(1<<63-1)/uint64(time.Millisecond) {
+		return 0, false, fmt.Errorf("expiration %q out of range", expiration)
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+// expiresWithin reports whether a message that was just received, with the
+// given expiration property, is projected to expire within the given
+// duration.
+func expiresWithin(expiration string, within time.Duration) bool {
+	ttl, ok, err := parseExpiration(expiration)
+	return err == nil && ok && ttl <= within
+}
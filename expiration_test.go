@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseExpiration(t *testing.T) {
+	tests := []struct {
+		expiration string
+		ttl        time.Duration
+		ok         bool
+		valid      bool
+	}{
+		{"", 0, false, true},
+		{"0", 0, true, true},
+		{"60000", time.Minute, true, true},
+		{"-1", 0, false, false},
+		{"1.5", 0, false, false},
+		{"soon", 0, false, false},
+		{"99999999999999999999", 0, false, false},
+	}
+	for _, test := range tests {
+		ttl, ok, err := parseExpiration(test.expiration)
+		if ttl != test.ttl || ok != test.ok || (err == nil) != test.valid {
+			t.Errorf("parseExpiration(%q) = %s, %v, %v", test.expiration, ttl, ok, err)
+		}
+	}
+}
+
+func TestExpiresWithinBoundary(t *testing.T) {
+	tests := []struct {
+		expiration string
+		expected   bool
+	}{
+		{"299999", true},
+		{"300000", true},
+		{"300001", false},
+		{"", false},
+		{"invalid", false},
+	}
+	for _, test := range tests {
+		if got := expiresWithin(test.expiration, 5*time.Minute); got != test.expected {
+			t.Errorf("expiresWithin(%q, 5m) = %v, expected %v", test.expiration, got, test.expected)
+		}
+	}
+}
+
+func TestExpirationProperties(t *testing.T) {
+	before := time.Now()
+	props := getProperties(amqp091.Delivery{Expiration: "60000"})
+	if props["expiration_ms"] != int64(60000) {
+		t.Errorf("Wrong expiration_ms: %#v", props["expiration_ms"])
+	}
+	expiresAt, err := time.Parse(timestampLayout, props["expires_at"].(string))
+	if err != nil {
+		t.Fatalf("Parse expires_at: %s", err)
+	}
+	if expiresAt.Before(before.Add(time.Minute).Truncate(time.Second)) || expiresAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Wrong expires_at: %s", expiresAt)
+	}
+
+	props = getProperties(amqp091.Delivery{})
+	if _, ok := props["expiration_ms"]; ok {
+		t.Errorf("Expected no expiration_ms without an expiration: %#v", props)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// filenameHashLength is the number of hex digits of the hash appended to
+// names truncated to -max-filename-length.
+const filenameHashLength = 8
+
+// filenameIndexFileName lists the message files named after the messages,
+// so that -verify and -restore find them and keep their order.
+const filenameIndexFileName = "filenames.json"
+
+// minFilenameLength leaves room for a few characters of the name besides the
+// hash suffix.
+const minFilenameLength = 16
+
+// filenameTemplate is the parsed -filename-template, or nil.  It is set once
+// before the dumps start, since the -queue-concurrency dumps share it.
+var filenameTemplate *template.Template
+
+// filenameData holds the values available to a -filename-template.  The
+// message values are encoded like queue names, and empty when the message
+// doesn't have them.
+type filenameData struct {
+	Counter    string
+	MessageID  string
+	RoutingKey string
+	Exchange   string
+}
+
+// checkFilenameOptions validates -filename-replacement, -output-encoding,
+// -max-filename-length and -filename-template.
+func checkFilenameOptions() error {
+	r, size := utf8.DecodeRuneInString(*filenameReplace)
+	if size == 0 || size != len(*filenameReplace) || !isFilenameRune(r) {
+		return fmt.Errorf("-filename-replacement must be a single letter, digit, '.', '-' or '_'")
+	}
+	if *outputEncoding != "replace" && *outputEncoding != "percent" {
+		return fmt.Errorf("Unknown output encoding %q", *outputEncoding)
+	}
+	if *maxFilenameLen < minFilenameLength {
+		return fmt.Errorf("-max-filename-length must be at least %d", minFilenameLength)
+	}
+
+	if *filenameTmpl == "" {
+		return nil
+	}
+	if *filenameHeader != "" {
+		return fmt.Errorf("-filename-template can't be combined with -filename-from-header")
+	}
+	if strings.Contains(*filenameTmpl, "/") {
+		return fmt.Errorf("-filename-template must be a file name, without '/'")
+	}
+	_, err := parseFilenameTemplate()
+	return err
+}
+
+// parseFilenameTemplate parses the -filename-template, or returns nil when
+// there is none.
+func parseFilenameTemplate() (*template.Template, error) {
+	if *filenameTmpl == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("filename").Parse(*filenameTmpl)
+	if err == nil {
+		// Catches unknown placeholders before the first message.
+		err = tmpl.Execute(ioutil.Discard, filenameData{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-filename-template: %s", err)
+	}
+	return tmpl, nil
+}
+
+// isFilenameRune reports whether r is kept as is in sanitized file names.
+func isFilenameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_'
+}
+
+// sanitizeFilename turns a value taken from the broker, such as a queue name,
+// into a single safe path component.  Letters and digits (including
+// non-ASCII ones), '.', '-' and '_' are kept; any other character, like '/',
+// ':' or a space, is encoded with encodeFilename, and so is a leading '.' so
+// that the name is neither hidden nor "." or "..".  Names longer than
+// -max-filename-length bytes are truncated and get a hash of the full value
+// as suffix, so that values sharing a long prefix don't collide.
+func sanitizeFilename(name string) string {
+	sanitized := encodeFilename(name)
+	if sanitized == "" {
+		return *filenameReplace
+	}
+	return limitFilename(sanitized, name)
+}
+
+// encodeFilename encodes the unsafe characters of name with the
+// -output-encoding: "replace" replaces each of them with
+// -filename-replacement, "percent" writes their UTF-8 bytes as %XX so that
+// the original value can be recovered.
+func encodeFilename(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if isFilenameRune(r) && (i > 0 || r != '.') {
+			b.WriteString(name[i : i+size])
+		} else if *outputEncoding == "percent" {
+			for _, c := range []byte(name[i : i+size]) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		} else {
+			b.WriteString(*filenameReplace)
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// limitFilename truncates sanitized, the sanitized form of name, to
+// -max-filename-length bytes with a hash of name as suffix.
+func limitFilename(sanitized string, name string) string {
+	maxLength := int(*maxFilenameLen)
+	if len(sanitized) <= maxLength {
+		return sanitized
+	}
+	keep := maxLength - filenameHashLength - 1
+	for keep > 0 && !utf8.RuneStart(sanitized[keep]) {
+		keep--
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:filenameHashLength]
+	return sanitized[:keep] + "-" + hash
+}
+
+// namesFilesByMessage reports whether message files are named after the
+// messages instead of their counter.
+func namesFilesByMessage() bool {
+	return *filenameHeader != "" || *filenameTmpl != ""
+}
+
+// messageFilename returns the file name of msg after -filename-from-header
+// or -filename-template, or "" to name it after its counter.
+func messageFilename(msg amqp091.Delivery, counter uint) string {
+	if filenameTemplate != nil {
+		return templateFilename(msg, counter)
+	}
+	return headerFilename(msg, *filenameHeader)
+}
+
+// templateFilename expands the -filename-template for msg.  It returns ""
+// when the result is empty, e.g. for "{{.MessageID}}" and a message without
+// message_id, or "." or "..".
+func templateFilename(msg amqp091.Delivery, counter uint) string {
+	data := filenameData{
+		Counter:    fmt.Sprintf("%04d", counter),
+		MessageID:  encodeFilename(msg.MessageId),
+		RoutingKey: encodeFilename(msg.RoutingKey),
+		Exchange:   encodeFilename(msg.Exchange),
+	}
+	var b strings.Builder
+	err := filenameTemplate.Execute(&b, data)
+	name := b.String()
+	if err != nil || name == "" || name == "." || name == ".." {
+		return ""
+	}
+	return limitFilename(name, name)
+}
+
+// headerFilename returns the sanitized value of header name of msg to use as
+// its file name, or "" when name is empty or the message has no such header
+// with a string or integer value.
+func headerFilename(msg amqp091.Delivery, name string) string {
+	if name == "" {
+		return ""
+	}
+	var value string
+	switch v := msg.Headers[name].(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64, int, uint:
+		value = fmt.Sprint(v)
+	}
+	if value == "" {
+		return ""
+	}
+	return sanitizeFilename(value)
+}
+
+// isReservedFilename reports whether a message file can't be named name,
+// because it could be the msg-NNNN file of another message, a metadata file
+// or one of the files written next to the messages.
+func isReservedFilename(name string) bool {
+	if bodyFileRegexp.MatchString(name) || partitionDirRegexp.MatchString(name) {
+		return true
+	}
+	switch name {
+	case checksumsFileName, manifestFileName, emptyMarkerFileName, frequencyReportFileName,
+		schemaReportFileName, topologyFileName, filenameIndexFileName, "dump.db", "index.html":
+		return true
+	}
+	name = strings.TrimSuffix(name, gzipSuffix)
+	for _, suffix := range []string{metadataFileSuffix, yamlMetadataFileSuffix, msgpackMetadataFileSuffix, protoJSONFileSuffix, rawDeliveryFileSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filenameIndexEntry is the file of a message named after the message,
+// relative to the output directory.
+type filenameIndexEntry struct {
+	Counter uint   `json:"counter"`
+	File    string `json:"file"`
+}
+
+func writeFilenameIndex(outputDir string, entries []filenameIndexEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	filePath := path.Join(outputDir, filenameIndexFileName)
+	err = writeFile(filePath, data)
+	if err != nil {
+		return err
+	}
+	fmt.Println(filePath)
+	return nil
+}
+
+// readFilenameIndex returns the messages listed in the filename index of
+// outputDir, if any.
+func readFilenameIndex(outputDir string) ([]dumpedMessage, error) {
+	data, err := ioutil.ReadFile(path.Join(outputDir, filenameIndexFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []filenameIndexEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filenameIndexFileName, err)
+	}
+	messages := make([]dumpedMessage, 0, len(entries))
+	for _, entry := range entries {
+		if entry.File == "" || path.IsAbs(entry.File) || path.Clean(entry.File) != entry.File || strings.HasPrefix(entry.File, "../") {
+			return nil, fmt.Errorf("%s: invalid file name %q", filenameIndexFileName, entry.File)
+		}
+		messages = append(messages, dumpedMessage{
+			Counter:  entry.Counter,
+			BodyPath: path.Join(outputDir, entry.File),
+		})
+	}
+	return messages, nil
+}
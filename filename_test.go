@@ -0,0 +1,325 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"orders.eu.created", "orders.eu.created"},
+		{"orders/eu/created", "orders_eu_created"},
+		{"host:5672 queue", "host_5672_queue"},
+		{"commandes.créées", "commandes.créées"},
+		{"注文.作成", "注文.作成"},
+		{"emoji-🚀", "emoji-_"},
+		{"..", "_."},
+		{".hidden", "_hidden"},
+		{"", "_"},
+	}
+	for _, test := range tests {
+		if sanitized := sanitizeFilename(test.name); sanitized != test.expected {
+			t.Errorf("sanitizeFilename(%q): expected %q, got %q", test.name, test.expected, sanitized)
+		}
+	}
+}
+
+func TestSanitizeFilenameReplacement(t *testing.T) {
+	*filenameReplace = "-"
+	defer func() { *filenameReplace = "_" }()
+	if sanitized := sanitizeFilename("a/b c"); sanitized != "a-b-c" {
+		t.Errorf("Wrong replacement: %q", sanitized)
+	}
+}
+
+func TestSanitizeFilenameTruncates(t *testing.T) {
+	*maxFilenameLen = 24
+	defer func() { *maxFilenameLen = 200 }()
+
+	a := sanitizeFilename("routing.key.ééééééééé.1")
+	b := sanitizeFilename("routing.key.ééééééééé.2")
+	if len(a) > 24 || len(b) > 24 {
+		t.Errorf("Names not truncated: %q, %q", a, b)
+	}
+	if !utf8.ValidString(a) {
+		t.Errorf("Truncated name isn't valid UTF-8: %q", a)
+	}
+	if !strings.HasPrefix(a, "routing.key.é-") || a == b {
+		t.Errorf("Truncated names should keep the prefix and differ: %q, %q", a, b)
+	}
+	if short := sanitizeFilename("short"); short != "short" {
+		t.Errorf("Short name changed: %q", short)
+	}
+}
+
+func TestCheckFilenameOptions(t *testing.T) {
+	if err := checkFilenameOptions(); err != nil {
+		t.Errorf("Defaults rejected: %s", err)
+	}
+	for _, replacement := range []string{"", "/", "__", " "} {
+		*filenameReplace = replacement
+		if err := checkFilenameOptions(); err == nil {
+			t.Errorf("Expected an error for replacement %q", replacement)
+		}
+	}
+	*filenameReplace = "_"
+}
+
+func TestFilenameFromHeader(t *testing.T) {
+	*filenameHeader = "x-filename"
+	*full = true
+	defer func() {
+		*filenameHeader = ""
+		*full = false
+	}()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-filename")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	messages := []amqp091.Delivery{
+		{Headers: amqp091.Table{"x-filename": "invoice/42.pdf"}, Body: []byte("first")},
+		{Headers: amqp091.Table{"other": "value"}, Body: []byte("no header")},
+		{Headers: amqp091.Table{"x-filename": "invoice/42.pdf"}, Body: []byte("duplicate")},
+		{Headers: amqp091.Table{"x-filename": int32(7)}, Body: []byte("number")},
+		{Headers: amqp091.Table{"x-filename": ""}, Body: []byte("empty")},
+		{Headers: amqp091.Table{"x-filename": "msg-0007"}, Body: []byte("counter name")},
+		{Headers: amqp091.Table{"x-filename": "7-delivery.json"}, Body: []byte("sidecar name")},
+		{Body: []byte("no header again")},
+	}
+	writer := &filesWriter{outputDir: dir}
+	for i, msg := range messages {
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	expected := []struct {
+		name string
+		body string
+	}{
+		{"invoice_42.pdf", "first"},
+		{"msg-0001", "no header"},
+		{"invoice_42.pdf-0002", "duplicate"},
+		{"7", "number"},
+		{"msg-0004", "empty"},
+		{"msg-0007-0005", "counter name"},
+		{"7-delivery.json-0006", "sidecar name"},
+		{"msg-0007", "no header again"},
+	}
+	for _, e := range expected {
+		verifyFileContent(t, path.Join(dir, e.name), e.body)
+		if _, err := os.Stat(path.Join(dir, e.name) + metadataFileSuffix); err != nil {
+			t.Errorf("Missing metadata file for %s: %s", e.name, err)
+		}
+	}
+
+	found, orphans, err := findDumpedMessages(dir)
+	if err != nil || len(orphans) != 0 {
+		t.Fatalf("findDumpedMessages: %v, orphans %v", err, orphans)
+	}
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d messages, found %d", len(expected), len(found))
+	}
+	for i, msg := range found {
+		if msg.Counter != uint(i) || msg.BodyPath != path.Join(dir, expected[i].name) {
+			t.Errorf("Message %d: expected %s, found %d at %s", i, expected[i].name, msg.Counter, msg.BodyPath)
+		}
+	}
+}
+
+func TestSanitizeFilenamePercentEncoding(t *testing.T) {
+	*outputEncoding = "percent"
+	defer func() { *outputEncoding = "replace" }()
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"orders.eu.created", "orders.eu.created"},
+		{"orders/eu created", "orders%2Feu%20created"},
+		{"commandes.créées", "commandes.créées"},
+		{"emoji-🚀", "emoji-%F0%9F%9A%80"},
+		{"100%", "100%25"},
+		{".hidden", "%2Ehidden"},
+	}
+	for _, test := range tests {
+		if sanitized := sanitizeFilename(test.name); sanitized != test.expected {
+			t.Errorf("sanitizeFilename(%q): expected %q, got %q", test.name, test.expected, sanitized)
+		}
+	}
+}
+
+func TestFilenameTemplate(t *testing.T) {
+	*filenameTmpl = "{{.RoutingKey}}-{{.MessageID}}"
+	defer func() {
+		*filenameTmpl = ""
+		filenameTemplate = nil
+	}()
+	var err error
+	filenameTemplate, err = parseFilenameTemplate()
+	if err != nil {
+		t.Fatalf("parseFilenameTemplate: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-filename")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	messages := []amqp091.Delivery{
+		{RoutingKey: "orders.eu.created", MessageId: "42", Body: []byte("dots")},
+		{RoutingKey: "orders/eu/created", MessageId: "a:b", Body: []byte("slashes")},
+		{RoutingKey: "commandes.créées", MessageId: "7", Body: []byte("unicode")},
+		{RoutingKey: "orders.eu.created", MessageId: "42", Body: []byte("duplicate")},
+	}
+	writer := &filesWriter{outputDir: dir}
+	for i, msg := range messages {
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+
+	expected := map[string]string{
+		"orders.eu.created-42":      "dots",
+		"orders_eu_created-a_b":     "slashes",
+		"commandes.créées-7":        "unicode",
+		"orders.eu.created-42-0003": "duplicate",
+	}
+	for name, body := range expected {
+		verifyFileContent(t, path.Join(dir, name), body)
+	}
+}
+
+func TestFilenameTemplateFallsBackToCounter(t *testing.T) {
+	*filenameTmpl = "{{.MessageID}}"
+	defer func() {
+		*filenameTmpl = ""
+		filenameTemplate = nil
+	}()
+	var err error
+	filenameTemplate, err = parseFilenameTemplate()
+	if err != nil {
+		t.Fatalf("parseFilenameTemplate: %s", err)
+	}
+	if name := messageFilename(amqp091.Delivery{}, 3); name != "" {
+		t.Errorf("Expected no name for a message without message_id, got %q", name)
+	}
+	if name := messageFilename(amqp091.Delivery{MessageId: "id-1"}, 3); name != "id-1" {
+		t.Errorf("Expected the message_id as name, got %q", name)
+	}
+}
+
+// Run with -race: the -queue-concurrency dumps share the parsed template.
+func TestFilenameTemplateConcurrentQueues(t *testing.T) {
+	*filenameTmpl = "{{.RoutingKey}}-{{.Counter}}"
+	defer func() {
+		*filenameTmpl = ""
+		filenameTemplate = nil
+	}()
+	var err error
+	filenameTemplate, err = parseFilenameTemplate()
+	if err != nil {
+		t.Fatalf("parseFilenameTemplate: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-filename")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	queueNames := []string{"q1", "q2", "q3", "q4", "q5", "q6"}
+	results := dumpQueues(queueNames, 3, func(queueName string) (*dumpSummary, error) {
+		// Like dumpQueue, which checks the options of every queue.
+		err := checkFilenameOptions()
+		if err != nil {
+			return nil, err
+		}
+		outputDir := path.Join(dir, queueName)
+		err = os.Mkdir(outputDir, 0775)
+		if err != nil {
+			return nil, err
+		}
+		writer := &filesWriter{outputDir: outputDir}
+		for i := uint(0); i < 3; i++ {
+			err = writer.WriteMessage(amqp091.Delivery{RoutingKey: queueName, Body: []byte(queueName)}, i)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	for _, result := range results {
+		if result.err != nil {
+			t.Fatalf("Queue %s: %s", result.queue, result.err)
+		}
+		for _, counter := range []string{"0000", "0001", "0002"} {
+			verifyFileContent(t, path.Join(dir, result.queue, result.queue+"-"+counter), result.queue)
+		}
+	}
+}
+
+func TestCheckFilenameTemplate(t *testing.T) {
+	defer func() {
+		*filenameTmpl = ""
+		*filenameHeader = ""
+		*outputEncoding = "replace"
+		filenameTemplate = nil
+	}()
+	for _, tmpl := range []string{"{{.Unknown}}", "{{.MessageID", "dir/{{.MessageID}}"} {
+		*filenameTmpl = tmpl
+		if err := checkFilenameOptions(); err == nil {
+			t.Errorf("Expected an error for template %q", tmpl)
+		}
+	}
+
+	*filenameTmpl = "{{.Counter}}"
+	*filenameHeader = "x-filename"
+	if err := checkFilenameOptions(); err == nil {
+		t.Errorf("Expected an error for -filename-template with -filename-from-header")
+	}
+
+	*filenameTmpl = ""
+	*filenameHeader = ""
+	*outputEncoding = "base64"
+	if err := checkFilenameOptions(); err == nil {
+		t.Errorf("Expected an error for an unknown output encoding")
+	}
+}
+
+func TestReadFilenameIndexRejectsOutsidePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-filename")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"../secret", "/etc/passwd", "a/../../b", ""} {
+		err = writeFilenameIndex(dir, []filenameIndexEntry{{Counter: 0, File: file}})
+		if err != nil {
+			t.Fatalf("writeFilenameIndex: %s", err)
+		}
+		if _, err := readFilenameIndex(dir); err == nil {
+			t.Errorf("Expected an error for file %q", file)
+		}
+	}
+}
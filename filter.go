@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// messageFilter reports whether a message should be dumped.
+type messageFilter func(msg amqp091.Delivery) bool
+
+// buildFilters returns the filters selected on the command line. A message
+// is dumped only if it matches all of them.
+func buildFilters() ([]messageFilter, error) {
+	var filters []messageFilter
+
+	if *filterRoutingKey != "" {
+		routingKey := *filterRoutingKey
+		filters = append(filters, func(msg amqp091.Delivery) bool {
+			return msg.RoutingKey == routingKey
+		})
+	}
+
+	if *maxBodySize > 0 && *minBodySize > *maxBodySize {
+		return nil, fmt.Errorf("-min-body-bytes must not be greater than -max-body-bytes-filter")
+	}
+	if *minBodySize > 0 || *maxBodySize > 0 {
+		min, max := *minBodySize, *maxBodySize
+		filters = append(filters, func(msg amqp091.Delivery) bool {
+			return bodySizeInRange(len(msg.Body), min, max)
+		})
+	}
+
+	if *filterExpiring > 0 {
+		within := *filterExpiring
+		filters = append(filters, func(msg amqp091.Delivery) bool {
+			return expiresWithin(msg.Expiration, within)
+		})
+	}
+
+	for _, kv := range filterHeaderFlags {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid header filter %q, expected key=value", kv)
+		}
+		key, value := parts[0], parts[1]
+		filters = append(filters, func(msg amqp091.Delivery) bool {
+			v, ok := msg.Headers[key]
+			return ok && fmt.Sprint(v) == value
+		})
+	}
+
+	return filters, nil
+}
+
+// hasFilters reports whether any option that skips messages was given: the
+// filters of buildFilters, -rules-file and -max-per-routing-key.
+func hasFilters() bool {
+	return *filterRoutingKey != "" || *minBodySize > 0 || *maxBodySize > 0 || *filterExpiring > 0 ||
+		len(filterHeaderFlags) > 0 || *rulesFile != "" || *maxPerRoutingKey > 0
+}
+
+// bodySizeInRange reports whether size is within [min, max]; a zero max means
+// no upper limit.
+func bodySizeInRange(size int, min, max uint) bool {
+	return uint(size) >= min && (max == 0 || uint(size) <= max)
+}
+
+// bodySizeReport collects the body sizes of the matched and skipped messages
+// when filtering by size, to show how they are distributed.
+type bodySizeReport struct {
+	matched []int
+	skipped []int
+}
+
+func (r *bodySizeReport) add(matched bool, size int) {
+	if r == nil {
+		return
+	}
+	if matched {
+		r.matched = append(r.matched, size)
+	} else {
+		r.skipped = append(r.skipped, size)
+	}
+}
+
+func (r *bodySizeReport) String() string {
+	var b strings.Builder
+	for _, group := range []struct {
+		name  string
+		sizes []int
+	}{{"matched", r.matched}, {"skipped", r.skipped}} {
+		sort.Ints(group.sizes)
+		fmt.Fprintf(&b, "Body sizes of %s messages: %d messages", group.name, len(group.sizes))
+		if len(group.sizes) > 0 {
+			fmt.Fprintf(&b, ", min %d, median %d, p95 %d, max %d bytes",
+				group.sizes[0], percentile(group.sizes, 50), percentile(group.sizes, 95), group.sizes[len(group.sizes)-1])
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func matchesFilters(filters []messageFilter, msg amqp091.Delivery) bool {
+	for _, filter := range filters {
+		if !filter(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// disposeUnmatched leaves a message that didn't match the filters un-acked,
+// so that it is returned to the queue when the connection closes, or acks it
+// (removing it from the queue) when -requeue-unmatched=false. Messages read
+// from a stream are always acked, which doesn't remove them. In a -consume
+// peek, messages to requeue are requeued right away.
+func disposeUnmatched(msg amqp091.Delivery) error {
+	if *requeueUnmatched && requeuesEachMessage() {
+		return msg.Nack(false, true)
+	}
+	if *requeueUnmatched && *streamOffset == "" {
+		return nil
+	}
+	return msg.Ack(false)
+}
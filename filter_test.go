@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// testAcknowledger records the acks and nacks of a delivery.
+type testAcknowledger struct {
+	acks    []uint64
+	nacks   []uint64
+	rejects []uint64
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks = append(a.nacks, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejects = append(a.rejects, tag)
+	return nil
+}
+
+func makeTestDelivery(acknowledger amqp091.Acknowledger, tag uint64, routingKey string, headers amqp091.Table) amqp091.Delivery {
+	return amqp091.Delivery{
+		Acknowledger: acknowledger,
+		DeliveryTag:  tag,
+		RoutingKey:   routingKey,
+		Headers:      headers,
+	}
+}
+
+func TestBuildFilters(t *testing.T) {
+	*filterRoutingKey = "orders.created"
+	filterHeaderFlags = stringListFlag{"tenant=acme", "version=2"}
+	defer func() {
+		*filterRoutingKey = ""
+		filterHeaderFlags = nil
+	}()
+
+	filters, err := buildFilters()
+	if err != nil {
+		t.Fatalf("buildFilters: %s", err)
+	}
+
+	matching := makeTestDelivery(nil, 1, "orders.created", amqp091.Table{"tenant": "acme", "version": int32(2)})
+	if !matchesFilters(filters, matching) {
+		t.Errorf("Expected message to match: %#v", matching)
+	}
+
+	for _, msg := range []amqp091.Delivery{
+		makeTestDelivery(nil, 2, "orders.deleted", amqp091.Table{"tenant": "acme", "version": int32(2)}),
+		makeTestDelivery(nil, 3, "orders.created", amqp091.Table{"tenant": "other", "version": int32(2)}),
+		makeTestDelivery(nil, 4, "orders.created", amqp091.Table{"tenant": "acme"}),
+	} {
+		if matchesFilters(filters, msg) {
+			t.Errorf("Expected message not to match: %#v", msg)
+		}
+	}
+
+	filterHeaderFlags = stringListFlag{"tenant"}
+	_, err = buildFilters()
+	if err == nil {
+		t.Errorf("Expected an error for an invalid header filter")
+	}
+}
+
+func TestDisposeUnmatchedRequeues(t *testing.T) {
+	acknowledger := &testAcknowledger{}
+	err := disposeUnmatched(makeTestDelivery(acknowledger, 1, "", nil))
+	if err != nil {
+		t.Fatalf("disposeUnmatched: %s", err)
+	}
+	if len(acknowledger.acks) != 0 || len(acknowledger.nacks) != 0 {
+		t.Errorf("Expected unmatched message to be left un-acked: %#v", acknowledger)
+	}
+}
+
+func TestDisposeUnmatchedDiscards(t *testing.T) {
+	*requeueUnmatched = false
+	defer func() { *requeueUnmatched = true }()
+
+	acknowledger := &testAcknowledger{}
+	err := disposeUnmatched(makeTestDelivery(acknowledger, 7, "", nil))
+	if err != nil {
+		t.Fatalf("disposeUnmatched: %s", err)
+	}
+	if len(acknowledger.acks) != 1 || acknowledger.acks[0] != 7 {
+		t.Errorf("Expected unmatched message to be acked: %#v", acknowledger)
+	}
+}
+
+func TestFilterHeaderRequeueUnmatched(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	output := run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=0 -output-dir=tmp-test -filter-header=my-header=my-value-3")
+	expectedOutput := "tmp-test/msg-0000\n"
+	if output != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0000", "message-3-body")
+}
+
+func TestFilterHeaderDiscardUnmatched(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-max-messages=0", "-output-dir=tmp-test", "-filter-header=my-header=my-value-3", "-requeue-unmatched=false").Output()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	expectedOutput := "tmp-test/msg-0000\n"
+	if string(output) != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	// Only the matched (and not acked) message is left in the queue.
+	if length := getTestQueueLength(t); length != 1 {
+		t.Errorf("Wrong queue length: expected 1 but got %d", length)
+	}
+}
+
+func TestPurgeMatched(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+
+	args := []string{"-uri=" + testAmqpURI, "-queue=" + testQueueName, "-max-messages=0", "-output-dir=tmp-test", "-filter-header=my-header=my-value-3", "-purge-matched"}
+	_, err := exec.Command("./rabbitmq-dump-queue", args...).Output()
+	if err == nil {
+		t.Errorf("Expected an error without -confirm-purge")
+	}
+
+	output, err := exec.Command("./rabbitmq-dump-queue", append(args, "-confirm-purge="+testQueueName)...).Output()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	expectedOutput := "tmp-test/msg-0000\n"
+	if string(output) != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0000", "message-3-body")
+	// The matched message was removed, the others are back in the queue.
+	if length := getTestQueueLength(t); length != 9 {
+		t.Errorf("Wrong queue length: expected 9 but got %d", length)
+	}
+}
+
+func TestBodySizeFilterBoundaries(t *testing.T) {
+	*minBodySize = 10
+	*maxBodySize = 20
+	defer func() {
+		*minBodySize = 0
+		*maxBodySize = 0
+	}()
+	filters, err := buildFilters()
+	if err != nil {
+		t.Fatalf("buildFilters: %s", err)
+	}
+
+	for size, expected := range map[int]bool{0: false, 9: false, 10: true, 15: true, 20: true, 21: false} {
+		msg := amqp091.Delivery{Body: make([]byte, size)}
+		if matchesFilters(filters, msg) != expected {
+			t.Errorf("Body of %d bytes: expected match = %v", size, expected)
+		}
+	}
+
+	if !bodySizeInRange(1<<20, 10, 0) {
+		t.Errorf("Expected no upper limit with a zero maximum")
+	}
+
+	*minBodySize = 30
+	_, err = buildFilters()
+	if err == nil {
+		t.Errorf("Expected an error for a minimum greater than the maximum")
+	}
+}
+
+func TestBodySizeReport(t *testing.T) {
+	r := &bodySizeReport{}
+	for _, size := range []int{30, 10, 20} {
+		r.add(true, size)
+	}
+	r.add(false, 5)
+	expected := "Body sizes of matched messages: 3 messages, min 10, median 20, p95 30, max 30 bytes\n" +
+		"Body sizes of skipped messages: 1 messages, min 5, median 5, p95 5, max 5 bytes\n"
+	if r.String() != expected {
+		t.Errorf("Wrong report: expected\n%s\ngot\n%s", expected, r.String())
+	}
+
+	var none *bodySizeReport
+	none.add(true, 10)
+}
+
+func TestPurgeMatchedRemovesDumped(t *testing.T) {
+	*purgeMatched = true
+	defer func() { *purgeMatched = false }()
+	if !removesDumped() {
+		t.Errorf("Expected -purge-matched to remove the dumped messages")
+	}
+
+	defer func() {
+		*writeParallel = 1
+		*webhookParallel = 1
+	}()
+	for _, set := range []func(){
+		func() { *writeParallel, *webhookParallel = 4, 1 },
+		func() { *writeParallel, *webhookParallel = 1, 4 },
+	} {
+		set()
+		err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, "tmp-test", false)
+		if err == nil || !strings.Contains(err.Error(), "-purge-matched, since messages would be removed before") {
+			t.Errorf("Expected concurrent saves to be rejected with -purge-matched, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"syscall"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// maxFrameLength limits the fields read back from a framed dump, so that a
+// corrupt length doesn't allocate gigabytes; RabbitMQ itself refuses
+// messages larger than 512 MiB.
+const maxFrameLength = 1 << 30
+
+func framedFilePath(outputDir string) string {
+	return path.Join(outputDir, "dump.framed")
+}
+
+// framedWriter writes all messages to a single binary stream. Every record
+// is the big-endian uint32 length of the headers+properties JSON, the JSON
+// itself (as in the -full metadata files, shaped according to -json-root),
+// the big-endian uint32 length of the body and the raw body bytes.
+type framedWriter struct {
+	output *bufferedFile
+}
+
+func openFramedWriter(filePath string) (*framedWriter, error) {
+	file, interval, err := openOutputFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("framed: %s", err)
+	}
+	return &framedWriter{output: newBufferedFile(file, interval)}, nil
+}
+
+// appendFrame appends the length of field and field itself to record.
+func appendFrame(record []byte, field []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	return append(append(record, length[:]...), field...)
+}
+
+func framedRecord(msg amqp091.Delivery) ([]byte, error) {
+	if len(msg.Body) > maxFrameLength {
+		return nil, fmt.Errorf("body of %d bytes is too large", len(msg.Body))
+	}
+	metadata, err := marshalJSON(getExtras(msg), "")
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 0, 8+len(metadata)+len(msg.Body))
+	record = appendFrame(record, metadata)
+	return appendFrame(record, msg.Body), nil
+}
+
+func (w *framedWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	record, err := framedRecord(msg)
+	if err != nil {
+		return newDumpError("framed", msg, counter, err)
+	}
+
+	err = w.output.writeRecord(record)
+	if errors.Is(err, syscall.EPIPE) {
+		return errReaderClosed
+	}
+	if err != nil {
+		return newDumpError("framed", msg, counter, err)
+	}
+	return nil
+}
+
+func (w *framedWriter) Close() error {
+	err := w.output.Close()
+	if errors.Is(err, syscall.EPIPE) {
+		return nil
+	}
+	return err
+}
+
+// framedReader reads back the messages written by framedWriter.
+type framedReader struct {
+	input   *bufio.Reader
+	counter uint
+}
+
+func newFramedReader(r io.Reader) *framedReader {
+	return &framedReader{input: bufio.NewReader(r)}
+}
+
+func (r *framedReader) readFrame() ([]byte, error) {
+	var length [4]byte
+	_, err := io.ReadFull(r.input, length[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrameLength {
+		return nil, fmt.Errorf("invalid frame length %d", n)
+	}
+	field := make([]byte, n)
+	_, err = io.ReadFull(r.input, field)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return field, err
+}
+
+// next returns the next message of the stream, or io.EOF after the last
+// one. A stream that ends in the middle of a record is an error.
+func (r *framedReader) next() (dumpedMessage, error) {
+	msg := dumpedMessage{Counter: r.counter}
+	metadata, err := r.readFrame()
+	if err != nil {
+		return msg, err
+	}
+	body, err := r.readFrame()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return msg, fmt.Errorf("message %d: %s", r.counter, err)
+	}
+
+	err = applyMetadata(&msg, metadata)
+	if err != nil {
+		return msg, fmt.Errorf("message %d: %s", r.counter, err)
+	}
+	msg.Publishing.Body = body
+	r.counter++
+	return msg, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestFramedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-framed")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := openFramedWriter(framedFilePath(dir))
+	if err != nil {
+		t.Fatalf("openFramedWriter: %s", err)
+	}
+	messages := []amqp091.Delivery{
+		{
+			Headers:    amqp091.Table{"my-header": "my-value", "attempt": int32(2)},
+			MessageId:  "msgid-0",
+			RoutingKey: "orders.created",
+			Body:       []byte(`{"id":1}`),
+		},
+		{MessageId: "msgid-1", Body: []byte{0xff, 0x00, '\n', 0xfe}},
+		{MessageId: "msgid-2"},
+	}
+	for i, msg := range messages {
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	file, err := os.Open(path.Join(dir, "dump.framed"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer file.Close()
+	reader := newFramedReader(file)
+	for i, expected := range messages {
+		msg, err := reader.next()
+		if err != nil {
+			t.Fatalf("next: %s", err)
+		}
+		if msg.Counter != uint(i) || msg.Publishing.MessageId != expected.MessageId || !bytes.Equal(msg.Publishing.Body, expected.Body) {
+			t.Errorf("Wrong message %d: %+v", i, msg)
+		}
+	}
+	if _, err := reader.next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last message, got %v", err)
+	}
+}
+
+func TestFramedRecordFormat(t *testing.T) {
+	*jsonRoot = "flat"
+	defer func() { *jsonRoot = "nested" }()
+
+	record, err := framedRecord(amqp091.Delivery{RoutingKey: "rk", Body: []byte("hello")})
+	if err != nil {
+		t.Fatalf("framedRecord: %s", err)
+	}
+	metadata := `{"delivery_mode":0,"headers":null,"priority":0,"routing_key":"rk"}`
+	expected := "\x00\x00\x00\x42" + metadata + "\x00\x00\x00\x05hello"
+	if string(record) != expected {
+		t.Errorf("Wrong record:\n%q\nexpected:\n%q", record, expected)
+	}
+
+	msg, err := newFramedReader(bytes.NewReader(record)).next()
+	if err != nil {
+		t.Fatalf("next: %s", err)
+	}
+	if msg.RoutingKey != "rk" || string(msg.Publishing.Body) != "hello" {
+		t.Errorf("Wrong message: %+v", msg)
+	}
+}
+
+func TestFramedReaderTruncated(t *testing.T) {
+	record, err := framedRecord(amqp091.Delivery{MessageId: "msgid-0", Body: []byte("message-0-body")})
+	if err != nil {
+		t.Fatalf("framedRecord: %s", err)
+	}
+	for _, n := range []int{2, 10, len(record) - 4, len(record) - 1} {
+		_, err := newFramedReader(bytes.NewReader(record[:n])).next()
+		if err == nil || err == io.EOF {
+			t.Errorf("Expected an error for a stream truncated to %d bytes, got %v", n, err)
+		}
+	}
+
+	corrupt := append([]byte{0xff, 0xff, 0xff, 0xff}, record[4:]...)
+	_, err = newFramedReader(bytes.NewReader(corrupt)).next()
+	if err == nil {
+		t.Errorf("Expected an error for an invalid frame length")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const frequencyReportFileName = "body-frequency.json"
+
+// frequencyEntry is an entry of the -body-frequency report: a distinct body,
+// how many messages had it and which one had it first.
+type frequencyEntry struct {
+	SHA256       string `json:"sha256"`
+	Count        uint   `json:"count"`
+	Bytes        int    `json:"bytes"`
+	File         string `json:"file"`
+	FirstMessage uint   `json:"first_message"`
+}
+
+// frequencyReport is written to body-frequency.json, with the bodies by
+// decreasing count.
+type frequencyReport struct {
+	Messages     uint              `json:"messages"`
+	UniqueBodies int               `json:"unique_bodies"`
+	Bodies       []*frequencyEntry `json:"bodies"`
+}
+
+// frequencyWriter writes every distinct body once, to a body-SHA256 file,
+// and counts how many messages had it.
+type frequencyWriter struct {
+	outputDir string
+	messages  uint
+	bodies    map[string]*frequencyEntry
+}
+
+func newFrequencyWriter(outputDir string) *frequencyWriter {
+	return &frequencyWriter{outputDir: outputDir, bodies: make(map[string]*frequencyEntry)}
+}
+
+func (w *frequencyWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	sum := sha256.Sum256(msg.Body)
+	hash := hex.EncodeToString(sum[:])
+	w.messages++
+	if entry, ok := w.bodies[hash]; ok {
+		entry.Count++
+		return nil
+	}
+
+	filename := "body-" + hash
+	err := saveMessageToFile(msg.Body, path.Join(w.outputDir, filename))
+	if err != nil {
+		return newDumpError("save body", msg, counter, err)
+	}
+	w.bodies[hash] = &frequencyEntry{
+		SHA256:       hash,
+		Count:        1,
+		Bytes:        len(msg.Body),
+		File:         filename,
+		FirstMessage: counter,
+	}
+	return nil
+}
+
+func (w *frequencyWriter) report() frequencyReport {
+	report := frequencyReport{Messages: w.messages, UniqueBodies: len(w.bodies), Bodies: []*frequencyEntry{}}
+	for _, entry := range w.bodies {
+		report.Bodies = append(report.Bodies, entry)
+	}
+	sort.Slice(report.Bodies, func(i, j int) bool {
+		a, b := report.Bodies[i], report.Bodies[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.FirstMessage < b.FirstMessage
+	})
+	return report
+}
+
+// Close writes the report.
+func (w *frequencyWriter) Close() error {
+	data, err := json.MarshalIndent(w.report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	reportPath := path.Join(w.outputDir, frequencyReportFileName)
+	err = writeFile(reportPath, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Body frequency report: %s", err)
+	}
+	fmt.Println(reportPath)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func testBodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFrequencyWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-frequency")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer := newFrequencyWriter(dir)
+	for i, body := range []string{"spam", "ham", "spam", "eggs", "spam", "ham"} {
+		err = writer.WriteMessage(amqp091.Delivery{Body: []byte(body)}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, frequencyReportFileName))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	var report frequencyReport
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if report.Messages != 6 || report.UniqueBodies != 3 || len(report.Bodies) != 3 {
+		t.Fatalf("Wrong report: %s", data)
+	}
+	expected := []frequencyEntry{
+		{SHA256: testBodyHash("spam"), Count: 3, Bytes: 4, File: "body-" + testBodyHash("spam"), FirstMessage: 0},
+		{SHA256: testBodyHash("ham"), Count: 2, Bytes: 3, File: "body-" + testBodyHash("ham"), FirstMessage: 1},
+		{SHA256: testBodyHash("eggs"), Count: 1, Bytes: 4, File: "body-" + testBodyHash("eggs"), FirstMessage: 3},
+	}
+	for i, entry := range expected {
+		if *report.Bodies[i] != entry {
+			t.Errorf("Wrong entry %d: expected %+v but got %+v", i, entry, *report.Bodies[i])
+		}
+		verifyFileContent(t, path.Join(dir, entry.File), []string{"spam", "ham", "eggs"}[i])
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Expected each distinct body to be written once, got %d files", len(entries))
+	}
+}
+
+func TestBodyFrequencyKeepsQueue(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 5)
+	defer deleteTestQueue(t)
+	run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=0 -output-dir=tmp-test -body-frequency")
+
+	data, err := ioutil.ReadFile(path.Join("tmp-test", frequencyReportFileName))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	var report frequencyReport
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if report.Messages != 5 || report.UniqueBodies != 5 {
+		t.Errorf("Wrong report: %s", data)
+	}
+}
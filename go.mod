@@ -5,4 +5,8 @@ go 1.13
 require (
 	github.com/glebarez/go-sqlite v1.20.3
 	github.com/rabbitmq/amqp091-go v1.2.0
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// stripsHeaders reports whether headers are removed from the dumped messages
+// with -drop-header or -strip-internal.
+func stripsHeaders() bool {
+	return len(dropHeaderFlags) > 0 || *stripInternal
+}
+
+// stripHeaders returns a copy of headers without the -drop-header headers
+// and, with -strip-internal, without the headers starting with
+// -internal-prefix (x- by default), such as the x-death and
+// x-first-death-* headers added by RabbitMQ when dead-lettering.  A message
+// left without headers gets nil headers, like one that never had any.
+func stripHeaders(headers amqp091.Table) amqp091.Table {
+	if len(headers) == 0 {
+		return headers
+	}
+	drop := make(map[string]bool, len(dropHeaderFlags))
+	for _, name := range dropHeaderFlags {
+		drop[name] = true
+	}
+
+	stripped := make(amqp091.Table, len(headers))
+	for k, v := range headers {
+		if drop[k] || (*stripInternal && strings.HasPrefix(k, *internalPrefix)) {
+			continue
+		}
+		stripped[k] = v
+	}
+	if len(stripped) == 0 {
+		return nil
+	}
+	return stripped
+}
+
+// escapeInvalidUTF8 replaces every byte of s that isn't part of a valid
+// UTF-8 sequence with a \xNN escape.  JSON and YAML can only hold UTF-8
+// text, and their encoders would otherwise silently turn such bytes into
+// U+FFFD, losing the original value.
+func escapeInvalidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var b strings.Builder
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, "\\x%02x", s[0])
+		} else {
+			b.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	return b.String()
+}
+
+// encodableHeaders returns headers with the keys and string values that
+// aren't valid UTF-8, including the ones nested in tables and arrays,
+// escaped with escapeInvalidUTF8.  Headers that are valid UTF-8 throughout,
+// the common case, are returned as is.
+func encodableHeaders(headers amqp091.Table) amqp091.Table {
+	if !hasInvalidUTF8(headers) {
+		return headers
+	}
+	return escapeHeaderValue(headers).(amqp091.Table)
+}
+
+func hasInvalidUTF8(v interface{}) bool {
+	switch t := v.(type) {
+	case string:
+		return !utf8.ValidString(t)
+	case amqp091.Table:
+		for k, item := range t {
+			if !utf8.ValidString(k) || hasInvalidUTF8(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range t {
+			if hasInvalidUTF8(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func escapeHeaderValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return escapeInvalidUTF8(t)
+	case amqp091.Table:
+		result := make(amqp091.Table, len(t))
+		for k, item := range t {
+			result[escapeInvalidUTF8(k)] = escapeHeaderValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i, item := range t {
+			result[i] = escapeHeaderValue(item)
+		}
+		return result
+	default:
+		return v
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// testDeadLetteredHeaders are the headers of a message rejected from
+// incoming_1 and dead-lettered once.
+func testDeadLetteredHeaders() amqp091.Table {
+	return amqp091.Table{
+		"my-header": "my-value",
+		"x-death": []interface{}{
+			amqp091.Table{
+				"count":        int64(1),
+				"exchange":     "",
+				"queue":        "incoming_1",
+				"reason":       "rejected",
+				"routing-keys": []interface{}{"incoming_1"},
+				"time":         time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		"x-first-death-exchange": "",
+		"x-first-death-queue":    "incoming_1",
+		"x-first-death-reason":   "rejected",
+	}
+}
+
+func TestStripInternalHeaders(t *testing.T) {
+	*stripInternal = true
+	defer func() { *stripInternal = false }()
+
+	headers := testDeadLetteredHeaders()
+	stripped := stripHeaders(headers)
+	expected := amqp091.Table{"my-header": "my-value"}
+	if !reflect.DeepEqual(stripped, expected) {
+		t.Errorf("Wrong headers: expected %v but got %v", expected, stripped)
+	}
+	if _, ok := headers["x-death"]; !ok {
+		t.Errorf("The original headers must not be modified")
+	}
+
+	*internalPrefix = "x-first-"
+	defer func() { *internalPrefix = "x-" }()
+	stripped = stripHeaders(testDeadLetteredHeaders())
+	if _, ok := stripped["x-death"]; !ok || len(stripped) != 2 {
+		t.Errorf("Expected only the x-first- headers to be removed, got %v", stripped)
+	}
+
+	*internalPrefix = "x-"
+	if stripped := stripHeaders(amqp091.Table{"x-death": "gone"}); stripped != nil {
+		t.Errorf("Expected nil headers when all are removed, got %v", stripped)
+	}
+}
+
+func TestDropHeader(t *testing.T) {
+	dropHeaderFlags = stringListFlag{"my-header", "x-first-death-queue"}
+	defer func() { dropHeaderFlags = nil }()
+
+	stripped := stripHeaders(testDeadLetteredHeaders())
+	if _, ok := stripped["my-header"]; ok || len(stripped) != 3 {
+		t.Errorf("Expected my-header and x-first-death-queue to be removed, got %v", stripped)
+	}
+}
+
+func TestDumpLoopStripsInternalHeaders(t *testing.T) {
+	*stripInternal = true
+	defer func() { *stripInternal = false }()
+
+	broker := newTestBroker(1)
+	broker.ready[0].Headers = testDeadLetteredHeaders()
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer}
+	_, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	record := ndjsonRecord(writer.messages[0])
+	if !reflect.DeepEqual(record["headers"], amqp091.Table{"my-header": "my-value"}) {
+		t.Errorf("Expected the x- headers to be removed before writing, got %v", record["headers"])
+	}
+}
+
+func TestEncodableHeaders(t *testing.T) {
+	valid := amqp091.Table{"scénario": "été", "注文": []interface{}{"作成", int32(1)}}
+	if encoded := encodableHeaders(valid); !reflect.DeepEqual(encoded, valid) {
+		t.Errorf("Expected valid UTF-8 headers to be kept, got %v", encoded)
+	}
+
+	headers := amqp091.Table{
+		"latin1-\xe9t\xe9": "caf\xe9",
+		"nested":           amqp091.Table{"k\xff": []interface{}{"ok", "\xc3("}},
+		"bytes":            []byte{0xff},
+	}
+	expected := amqp091.Table{
+		`latin1-\xe9t\xe9`: `caf\xe9`,
+		"nested":           amqp091.Table{`k\xff`: []interface{}{"ok", `\xc3(`}},
+		"bytes":            []byte{0xff},
+	}
+	encoded := encodableHeaders(headers)
+	if !reflect.DeepEqual(encoded, expected) {
+		t.Errorf("Wrong escaped headers: expected %#v, got %#v", expected, encoded)
+	}
+
+	data, err := json.Marshal(getExtras(amqp091.Delivery{Headers: headers}))
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if !utf8.Valid(data) || !strings.Contains(string(data), `"latin1-\\xe9t\\xe9":"caf\\xe9"`) {
+		t.Errorf("Wrong metadata JSON: %s", data)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// htmlBodyLimit is the number of body bytes shown in the HTML report; the
+// linked file has the whole body.
+const htmlBodyLimit = 64 * 1024
+
+func htmlReportPath(outputDir string) string {
+	return path.Join(outputDir, "index.html")
+}
+
+// htmlEntry is one message of the HTML report.
+type htmlEntry struct {
+	Counter      uint
+	File         string
+	MetadataFile string
+	BodySize     int
+	Body         string
+	Truncated    bool
+	Properties   map[string]string
+	Headers      map[string]string
+}
+
+// htmlWriter writes the message files like the files output, and an
+// index.html report listing the messages with their properties, headers and
+// body, for people who would rather not read the raw files.  The rows of the
+// report are rendered as the messages arrive to a hidden temporary file, so
+// that large dumps aren't held in memory, and the report is written from it
+// when the writer is closed.
+type htmlWriter struct {
+	files     *filesWriter
+	outputDir string
+	rowsFile  *os.File
+	rows      *bufio.Writer
+	count     int
+}
+
+func newHTMLWriter(outputDir string) (*htmlWriter, error) {
+	rowsFile, err := ioutil.TempFile(outputDir, ".index.html.rows-")
+	if err != nil {
+		return nil, fmt.Errorf("HTML report: %s", err)
+	}
+	return &htmlWriter{
+		files:     newFilesWriter(outputDir, 1),
+		outputDir: outputDir,
+		rowsFile:  rowsFile,
+		rows:      bufio.NewWriter(rowsFile),
+	}, nil
+}
+
+func (w *htmlWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	bodyPath, err := w.files.writeMessage(msg, counter)
+	if err != nil {
+		return err
+	}
+	entry := newHTMLEntry(msg, counter, w.relativePath(bodyPath))
+	err = htmlReportTemplate.ExecuteTemplate(w.rows, "entry", entry)
+	if err != nil {
+		return newDumpError("HTML report", msg, counter, err)
+	}
+	w.count++
+	return nil
+}
+
+// relativePath is the link to filePath from the report.
+func (w *htmlWriter) relativePath(filePath string) string {
+	rel, err := filepath.Rel(w.outputDir, filePath)
+	if err != nil {
+		return filePath
+	}
+	return filepath.ToSlash(rel)
+}
+
+func newHTMLEntry(msg amqp091.Delivery, counter uint, file string) htmlEntry {
+	entry := htmlEntry{
+		Counter:    counter,
+		File:       file,
+		BodySize:   len(msg.Body),
+		Properties: make(map[string]string),
+		Headers:    make(map[string]string),
+	}
+	if *full {
+		entry.MetadataFile = file + metadataSuffix()
+	}
+
+	body := msg.Body
+	if len(body) > htmlBodyLimit {
+		body = body[:htmlBodyLimit]
+		entry.Truncated = true
+	}
+	var indented bytes.Buffer
+	switch {
+	case !utf8.Valid(body):
+		entry.Body = fmt.Sprintf("(binary body of %d bytes)", len(msg.Body))
+	case !entry.Truncated && json.Indent(&indented, body, "", "  ") == nil:
+		entry.Body = indented.String()
+	default:
+		entry.Body = string(body)
+	}
+
+	for name, value := range getProperties(msg) {
+		if text := htmlValue(value); text != "" && text != "0" {
+			entry.Properties[name] = text
+		}
+	}
+	for name, value := range encodableHeaders(msg.Headers) {
+		entry.Headers[name] = htmlValue(value)
+	}
+	return entry
+}
+
+// htmlValue formats a property or header value: strings as is and other
+// values as JSON.
+func htmlValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// htmlReportTemplate renders the report in three parts: "header", an "entry"
+// per message and "footer".
+var htmlReportTemplate = template.Must(template.New("index.html").Parse(`{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Message dump</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; vertical-align: top; padding: 0.2em 0.8em 0.2em 0; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+details { border-top: 1px solid #ccc; padding: 0.5em 0; }
+summary { cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>Message dump</h1>
+<p>{{.Count}} messages, generated {{.Generated}}.</p>
+{{end}}{{define "entry"}}<details id="msg-{{.Counter}}">
+<summary>#{{.Counter}} <a href="{{.File}}">{{.File}}</a>{{with index .Properties "routing_key"}} &middot; {{.}}{{end}}{{with index .Properties "content_type"}} &middot; {{.}}{{end}} &middot; {{.BodySize}} bytes</summary>
+{{if .MetadataFile}}<p><a href="{{.MetadataFile}}">headers and properties</a></p>
+{{end}}<h3>Properties</h3>
+<table>
+{{range $name, $value := .Properties}}<tr><th>{{$name}}</th><td>{{$value}}</td></tr>
+{{end}}</table>
+{{if .Headers}}<h3>Headers</h3>
+<table>
+{{range $name, $value := .Headers}}<tr><th>{{$name}}</th><td>{{$value}}</td></tr>
+{{end}}</table>
+{{end}}<h3>Body</h3>
+<pre>{{.Body}}</pre>
+{{if .Truncated}}<p>Truncated, see <a href="{{.File}}">the body file</a> for the whole body.</p>
+{{end}}</details>
+{{end}}{{define "footer"}}</body>
+</html>
+{{end}}`))
+
+func (w *htmlWriter) Close() error {
+	defer os.Remove(w.rowsFile.Name())
+	defer w.rowsFile.Close()
+	err := w.files.Close()
+	if err != nil {
+		return err
+	}
+
+	err = w.rows.Flush()
+	if err == nil {
+		_, err = w.rowsFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("HTML report: %s", err)
+	}
+	reportPath := htmlReportPath(w.outputDir)
+	err = writeFileWith(reportPath, func(out io.Writer) error {
+		err := htmlReportTemplate.ExecuteTemplate(out, "header", struct {
+			Count     int
+			Generated string
+		}{w.count, time.Now().UTC().Format(time.RFC3339)})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, w.rowsFile)
+		if err != nil {
+			return err
+		}
+		return htmlReportTemplate.ExecuteTemplate(out, "footer", nil)
+	})
+	if err != nil {
+		return fmt.Errorf("HTML report: %s", err)
+	}
+	fmt.Println(reportPath)
+	return nil
+}
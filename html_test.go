@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestHTMLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-html")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*full = true
+	defer func() { *full = false }()
+
+	writer, err := newHTMLWriter(dir)
+	if err != nil {
+		t.Fatalf("newHTMLWriter: %s", err)
+	}
+	messages := []amqp091.Delivery{
+		{
+			ContentType: "application/json",
+			RoutingKey:  "orders.created",
+			MessageId:   "msgid-0",
+			Headers:     amqp091.Table{"tenant": "<acme & co>", "attempt": int32(2)},
+			Body:        []byte(`{"id":1,"note":"<script>alert(1)</script>"}`),
+		},
+		{MessageId: "msgid-1", Body: []byte{0xff, 0x00, 0xfe}},
+	}
+	for i, msg := range messages {
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	verifyFileContent(t, path.Join(dir, "msg-0000"), string(messages[0].Body))
+	data, err := ioutil.ReadFile(path.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	report := string(data)
+	for _, expected := range []string{
+		"<p>2 messages, generated ",
+		`<summary>#0 <a href="msg-0000">msg-0000</a> &middot; orders.created &middot; application/json &middot; 43 bytes</summary>`,
+		`<a href="msg-0000-headers&#43;properties.json">headers and properties</a>`,
+		"<tr><th>message_id</th><td>msgid-0</td></tr>",
+		"<tr><th>tenant</th><td>&lt;acme &amp; co&gt;</td></tr>",
+		"<tr><th>attempt</th><td>2</td></tr>",
+		"<pre>{\n  &#34;id&#34;: 1,\n  &#34;note&#34;: &#34;&lt;script&gt;alert(1)&lt;/script&gt;&#34;\n}</pre>",
+		`<summary>#1 <a href="msg-0001">msg-0001</a> &middot; 3 bytes</summary>`,
+		"<pre>(binary body of 3 bytes)</pre>",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected the report to contain %q, got:\n%s", expected, report)
+		}
+	}
+	if strings.Contains(report, "<script>") {
+		t.Errorf("Body not escaped in the report:\n%s", report)
+	}
+	if !strings.HasPrefix(report, "<!DOCTYPE html>") || !strings.HasSuffix(report, "</body>\n</html>\n") {
+		t.Errorf("Report not assembled in order:\n%s", report)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			t.Errorf("Temporary file %s left in the dump", file.Name())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// inspectStats summarizes the composition of the inspected messages.
+type inspectStats struct {
+	Messages     int
+	ContentTypes map[string]int
+	RoutingKeys  map[string]int
+	HeaderKeys   map[string]int
+	BodySizes    []int
+	Ages         *messageAges
+}
+
+func newInspectStats() *inspectStats {
+	s := &inspectStats{
+		ContentTypes: make(map[string]int),
+		RoutingKeys:  make(map[string]int),
+		HeaderKeys:   make(map[string]int),
+	}
+	if *ageStats {
+		s.Ages = &messageAges{}
+	}
+	return s
+}
+
+func (s *inspectStats) add(msg amqp091.Delivery) {
+	s.Messages++
+	s.ContentTypes[msg.ContentType]++
+	s.RoutingKeys[msg.RoutingKey]++
+	for key := range msg.Headers {
+		s.HeaderKeys[key]++
+	}
+	s.BodySizes = append(s.BodySizes, len(msg.Body))
+	s.Ages.add(msg.Timestamp, time.Now())
+}
+
+// percentile returns the nearest-rank percentile p (0-100) of sorted values.
+func percentile(sorted []int, p float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// writeCounts writes a section with the counts sorted by decreasing
+// frequency, then by name.
+func writeCounts(b *strings.Builder, title string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Fprintf(b, "%s:\n", title)
+	for _, k := range keys {
+		name := k
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(b, "  %6d  %s\n", counts[k], name)
+	}
+}
+
+func (s *inspectStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "messages: %d\n", s.Messages)
+	writeCounts(&b, "content types", s.ContentTypes)
+	writeCounts(&b, "routing keys", s.RoutingKeys)
+	writeCounts(&b, "header keys", s.HeaderKeys)
+
+	sizes := append([]int(nil), s.BodySizes...)
+	sort.Ints(sizes)
+	fmt.Fprintf(&b, "body size (bytes):\n")
+	fmt.Fprintf(&b, "  min %d, p50 %d, p90 %d, p99 %d, max %d\n",
+		percentile(sizes, 0), percentile(sizes, 50), percentile(sizes, 90), percentile(sizes, 99), percentile(sizes, 100))
+	if s.Ages != nil {
+		fmt.Fprintf(&b, "message age:\n  %s\n", s.Ages)
+	}
+	return b.String()
+}
+
+// inspectQueue peeks at up to maxMessages messages and prints a summary of
+// their content types, routing keys, header keys and body sizes. Like a
+// normal dump without -ack, the messages are received without being
+// acknowledged and return to the queue when the connection closes.
+func inspectQueue(amqpURI string, queueName string, maxMessages uint) error {
+	if queueName == "" {
+		return fmt.Errorf("Must supply queue name")
+	}
+
+	conn, err := dial(amqpURI)
+	if err != nil {
+		return fmt.Errorf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Channel: %s", err)
+	}
+
+	fetch := getMessages(channel, queueName, false)
+	stats := newInspectStats()
+	for maxMessages == 0 || uint(stats.Messages) < maxMessages {
+		msg, ok, err := fetch()
+		if err != nil {
+			return fmt.Errorf("Queue get: %s", err)
+		}
+		if !ok {
+			break
+		}
+		stats.add(msg)
+	}
+
+	fmt.Print(stats)
+	return nil
+}
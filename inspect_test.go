@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestInspectStats(t *testing.T) {
+	stats := newInspectStats()
+	for i := 1; i <= 10; i++ {
+		msg := amqp091.Delivery{
+			ContentType: "application/json",
+			RoutingKey:  "orders.created",
+			Headers:     amqp091.Table{"tenant": "acme"},
+			Body:        make([]byte, i*10),
+		}
+		if i > 7 {
+			msg.ContentType = "text/plain"
+			msg.RoutingKey = ""
+			msg.Headers["x-retry"] = int32(i)
+		}
+		stats.add(msg)
+	}
+
+	if stats.Messages != 10 ||
+		stats.ContentTypes["application/json"] != 7 ||
+		stats.ContentTypes["text/plain"] != 3 ||
+		stats.RoutingKeys["orders.created"] != 7 ||
+		stats.HeaderKeys["tenant"] != 10 ||
+		stats.HeaderKeys["x-retry"] != 3 {
+		t.Errorf("Wrong stats: %#v", stats)
+	}
+
+	output := stats.String()
+	for _, expected := range []string{
+		"messages: 10\n",
+		"       7  application/json\n",
+		"       3  (none)\n",
+		"      10  tenant\n",
+		"  min 10, p50 50, p90 90, p99 100, max 100\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected output to contain '%s', got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	if percentile(nil, 50) != 0 {
+		t.Errorf("Expected 0 for no values")
+	}
+	sorted := []int{1, 2, 3, 4}
+	if percentile(sorted, 50) != 2 || percentile(sorted, 100) != 4 || percentile(sorted, 0) != 1 {
+		t.Errorf("Wrong percentiles for %v", sorted)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaWriter publishes messages to a Kafka topic, either while dumping a
+// queue or when restoring a dump.
+type kafkaWriter struct {
+	writer *kafka.Writer
+}
+
+func openKafkaWriter(brokers, topic string) (*kafkaWriter, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("Kafka: -kafka-topic is required with -kafka-brokers")
+	}
+	return &kafkaWriter{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+		Topic:        topic,
+		RequiredAcks: kafka.RequireAll,
+		// Every write waits for the brokers' acknowledgement so that a
+		// message is only acked in RabbitMQ once Kafka has it; don't make
+		// it wait for a batch to fill up too.
+		BatchSize: 1,
+	}}, nil
+}
+
+// kafkaMessage maps an AMQP message to a Kafka record.  The key is the value
+// of the -kafka-key-header header if set and present, otherwise the routing
+// key.
+func kafkaMessage(headers amqp091.Table, routingKey string, timestamp time.Time, body []byte) (kafka.Message, error) {
+	msg := kafka.Message{Value: body, Time: timestamp}
+
+	var key []byte
+	if routingKey != "" {
+		key = []byte(routingKey)
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := kafkaHeaderValue(headers[name])
+		if err != nil {
+			return kafka.Message{}, fmt.Errorf("header %q: %s", name, err)
+		}
+		msg.Headers = append(msg.Headers, kafka.Header{Key: name, Value: data})
+		if name == *kafkaKeyHeader {
+			key = data
+		}
+	}
+	msg.Key = key
+	return msg, nil
+}
+
+// kafkaHeaderValue encodes strings and byte arrays as is and other AMQP
+// header values as JSON.
+func kafkaHeaderValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func (w *kafkaWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	record, err := kafkaMessage(msg.Headers, msg.RoutingKey, msg.Timestamp, msg.Body)
+	if err == nil {
+		err = w.writer.WriteMessages(context.Background(), record)
+	}
+	if err != nil {
+		return newDumpError("publish message to kafka", msg, counter, err)
+	}
+	verboseLog(fmt.Sprintf("Message %d published to Kafka topic %q", counter, w.writer.Topic))
+	return nil
+}
+
+func (w *kafkaWriter) publish(msg *dumpedMessage) error {
+	p := msg.Publishing
+	record, err := kafkaMessage(p.Headers, msg.RoutingKey, p.Timestamp, p.Body)
+	if err != nil {
+		return err
+	}
+	return w.writer.WriteMessages(context.Background(), record)
+}
+
+func (w *kafkaWriter) Close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaMessage(t *testing.T) {
+	headers := amqp091.Table{
+		"my-header": "my-value",
+		"count":     int64(3),
+		"tags":      []interface{}{"a", "b"},
+	}
+	ts := time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	msg, err := kafkaMessage(headers, "my-key", ts, []byte("body"))
+	if err != nil {
+		t.Fatalf("kafkaMessage: %s", err)
+	}
+	if string(msg.Key) != "my-key" || string(msg.Value) != "body" || !msg.Time.Equal(ts) {
+		t.Errorf("Wrong message: %#v", msg)
+	}
+	expected := []kafka.Header{
+		{Key: "count", Value: []byte("3")},
+		{Key: "my-header", Value: []byte("my-value")},
+		{Key: "tags", Value: []byte(`["a","b"]`)},
+	}
+	if len(msg.Headers) != len(expected) {
+		t.Fatalf("Expected %d headers, got %v", len(expected), msg.Headers)
+	}
+	for i, h := range expected {
+		if msg.Headers[i].Key != h.Key || string(msg.Headers[i].Value) != string(h.Value) {
+			t.Errorf("Header %d: expected %s=%s, got %s=%s", i, h.Key, h.Value, msg.Headers[i].Key, msg.Headers[i].Value)
+		}
+	}
+}
+
+func TestKafkaMessageKeyHeader(t *testing.T) {
+	*kafkaKeyHeader = "customer"
+	defer func() { *kafkaKeyHeader = "" }()
+
+	msg, err := kafkaMessage(amqp091.Table{"customer": "c-42"}, "my-key", time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("kafkaMessage: %s", err)
+	}
+	if string(msg.Key) != "c-42" {
+		t.Errorf("Expected the key from the header, got %q", msg.Key)
+	}
+
+	// Messages without the header fall back to the routing key.
+	msg, err = kafkaMessage(nil, "my-key", time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("kafkaMessage: %s", err)
+	}
+	if string(msg.Key) != "my-key" {
+		t.Errorf("Expected the routing key, got %q", msg.Key)
+	}
+}
+
+func TestOpenKafkaWriterRequiresTopic(t *testing.T) {
+	_, err := openKafkaWriter("localhost:9092", "")
+	if err == nil {
+		t.Errorf("Expected an error without -kafka-topic")
+	}
+}
+
+// Set KAFKA_BROKERS (e.g. localhost:9092) to run against a Kafka server.
+func TestKafkaRestore(t *testing.T) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("KAFKA_BROKERS not set")
+	}
+	topic := "test-rabbitmq-dump-queue-" + time.Now().Format("20060102150405")
+
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	messages, _, err := findDumpedMessages(dir)
+	if err != nil {
+		t.Fatalf("findDumpedMessages: %s", err)
+	}
+
+	writer, err := openKafkaWriter(brokers, topic)
+	if err != nil {
+		t.Fatalf("openKafkaWriter: %s", err)
+	}
+	writer.writer.AllowAutoTopicCreation = true
+	for i := range messages {
+		err = loadDumpedMessage(&messages[i])
+		if err != nil {
+			t.Fatalf("loadDumpedMessage: %s", err)
+		}
+		err = writer.publish(&messages[i])
+		if err != nil {
+			t.Fatalf("publish: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: strings.Split(brokers, ","), Topic: topic})
+	defer reader.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < len(messages); i++ {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if string(msg.Value) != string(messages[i].Publishing.Body) {
+			t.Errorf("Message %d: expected %q, got %q", i, messages[i].Publishing.Body, msg.Value)
+		}
+	}
+}
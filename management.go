@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// managementQueue is the subset of the management HTTP API queue object that
+// we use.
+type managementQueue struct {
+	Name                   string `json:"name"`
+	Vhost                  string `json:"vhost"`
+	Messages               int    `json:"messages"`
+	MessagesReady          int    `json:"messages_ready"`
+	MessagesUnacknowledged int    `json:"messages_unacknowledged"`
+	Consumers              int    `json:"consumers"`
+}
+
+// The ports of the management plugin's HTTP listener, without and with TLS.
+const (
+	defaultManagementPort    = 15672
+	defaultManagementTLSPort = 15671
+)
+
+// managementClient gives up on a management API that doesn't answer, like
+// the -webhook-url client, instead of hanging the dump.
+var managementClient = &http.Client{Timeout: 30 * time.Second}
+
+// useManagementAPI reports whether -count should ask the management HTTP
+// API: when -management-url or any management credentials are given.
+func useManagementAPI() bool {
+	return *managementURL != "" || *mgmtUser != "" || *mgmtPass != "" || *mgmtToken != ""
+}
+
+// defaultManagementURL is the management API of the broker of the AMQP URI,
+// on the default management port.
+func defaultManagementURL(uri amqp091.URI) string {
+	// JoinHostPort brackets IPv6 addresses.
+	if uri.Scheme == "amqps" {
+		return "https://" + net.JoinHostPort(uri.Host, strconv.Itoa(defaultManagementTLSPort))
+	}
+	return "http://" + net.JoinHostPort(uri.Host, strconv.Itoa(defaultManagementPort))
+}
+
+// setManagementAuth authenticates req with the -mgmt-token bearer token, or
+// else with basic auth using -mgmt-user and -mgmt-pass, which default to the
+// credentials of the AMQP URI.
+func setManagementAuth(req *http.Request, uri amqp091.URI) {
+	if *mgmtToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*mgmtToken)
+		return
+	}
+	user, pass := uri.Username, uri.Password
+	if *mgmtUser != "" {
+		user = *mgmtUser
+	}
+	if *mgmtPass != "" {
+		pass = *mgmtPass
+	}
+	req.SetBasicAuth(user, pass)
+}
+
+// getManagementQueue fetches a queue's details from the management HTTP API
+// at managementURL, or by default on the host of the AMQP URI.
+func getManagementQueue(managementURL string, amqpURI string, queueName string) (*managementQueue, error) {
+	uri, err := amqp091.ParseURI(amqpURI)
+	if err != nil {
+		return nil, err
+	}
+	var queue managementQueue
+	err = getManagementJSON(managementURL, uri, "/api/queues/"+url.PathEscape(uri.Vhost)+"/"+url.PathEscape(queueName), &queue)
+	if err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+// getManagementJSON decodes the response of a GET of apiPath on the
+// management HTTP API into v.
+func getManagementJSON(managementURL string, uri amqp091.URI, apiPath string, v interface{}) error {
+	if managementURL == "" {
+		managementURL = defaultManagementURL(uri)
+	}
+
+	endpoint := strings.TrimRight(managementURL, "/") + apiPath
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	setManagementAuth(req, uri)
+
+	resp, err := managementClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return fmt.Errorf("GET %s: %s: check the credentials (-mgmt-user, -mgmt-pass or -mgmt-token)", endpoint, resp.Status)
+	case http.StatusForbidden:
+		return fmt.Errorf("GET %s: %s: the user needs the monitoring or management tag and access to vhost %q", endpoint, resp.Status, uri.Vhost)
+	default:
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("GET %s: %s", endpoint, err)
+	}
+	return nil
+}
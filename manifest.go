@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	manifestFileName    = "manifest.json"
+	emptyMarkerFileName = "EMPTY"
+)
+
+// dumpManifest describes a dump, so that a later consumer can check that it
+// is complete.
+type dumpManifest struct {
+	Queue             string              `json:"queue"`
+	StartedAt         time.Time           `json:"started_at"`
+	FinishedAt        time.Time           `json:"finished_at"`
+	Output            string              `json:"output"`
+	MessagesAvailable int                 `json:"messages_available"`
+	MessagesDumped    uint                `json:"messages_dumped"`
+	MessagesFiltered  uint                `json:"messages_filtered,omitempty"`
+	Partitions        []manifestPartition `json:"partitions,omitempty"`
+	Progress          []progressSnapshot  `json:"progress,omitempty"`
+	BytesDumped       uint64              `json:"bytes_dumped,omitempty"`
+	Messages          []manifestMessage   `json:"messages,omitempty"`
+	RepairedAt        *time.Time          `json:"repaired_at,omitempty"`
+	Broker            *brokerProperties   `json:"broker,omitempty"`
+
+	progressEvery uint
+	received      uint
+	bytes         uint64
+}
+
+// progressSnapshot records how far the dump was at a point in time, so that
+// the dump rate can be reconstructed afterwards.
+type progressSnapshot struct {
+	Time     time.Time `json:"time"`
+	Messages uint      `json:"messages"`
+	Bytes    uint64    `json:"bytes"`
+}
+
+// manifestPartition lists the messages of a -split-every subdirectory, or of
+// a partition database with -db.
+type manifestPartition struct {
+	Dir          string `json:"dir,omitempty"`
+	DB           string `json:"db,omitempty"`
+	FirstMessage uint   `json:"first_message"`
+	LastMessage  uint   `json:"last_message"`
+}
+
+// manifestPartitions maps the counters of the messages received to their
+// subdirectories, or databases with db, splitting every splitEvery messages.
+func manifestPartitions(messagesReceived, splitEvery uint, db bool) []manifestPartition {
+	var partitions []manifestPartition
+	for first := uint(0); first < messagesReceived; first += splitEvery {
+		last := first + splitEvery - 1
+		if last >= messagesReceived {
+			last = messagesReceived - 1
+		}
+		partition := manifestPartition{
+			FirstMessage: first,
+			LastMessage:  last,
+		}
+		if db {
+			partition.DB = partitionDbFile(first, splitEvery)
+		} else {
+			partition.Dir = partitionDir(first, splitEvery)
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// newManifest records the number of ready messages in the queue at the
+// start of the dump, from a passive queue declaration, and the broker the
+// dump is taken from.
+func newManifest(channel *amqp091.Channel, queueName string, db bool, broker *brokerProperties) (*dumpManifest, error) {
+	queue, err := channel.QueueDeclarePassive(queueName, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	output := *output
+	if *webhookURL != "" {
+		output = "webhook"
+	} else if *outputCommand != "" {
+		output = "command"
+	} else if *kafkaBrokers != "" {
+		output = "kafka"
+	} else if db {
+		output = "db"
+	}
+	return &dumpManifest{
+		Queue:             escapeInvalidUTF8(queueName),
+		StartedAt:         time.Now().UTC(),
+		Output:            output,
+		MessagesAvailable: queue.Messages,
+		Broker:            broker,
+		progressEvery:     *progressEvery,
+	}, nil
+}
+
+// messageReceived counts a received message of bodySize bytes and records a
+// progress snapshot every -progress-every messages.
+func (m *dumpManifest) messageReceived(bodySize int) {
+	if m == nil {
+		return
+	}
+	m.received++
+	m.bytes += uint64(bodySize)
+	if m.progressEvery > 0 && m.received%m.progressEvery == 0 {
+		m.snapshot()
+	}
+}
+
+// messageFiltered counts a message skipped by the filters, which is not
+// missing from the dump.
+func (m *dumpManifest) messageFiltered() {
+	if m == nil {
+		return
+	}
+	m.MessagesFiltered++
+}
+
+func (m *dumpManifest) snapshot() {
+	m.Progress = append(m.Progress, progressSnapshot{
+		Time:     time.Now().UTC(),
+		Messages: m.received,
+		Bytes:    m.bytes,
+	})
+}
+
+// finish records the end of the dump and warns when fewer messages were
+// dumped or filtered out than were available, unless the dump stopped at its
+// limit of maxMessages (from -max-messages or -tail-n) on purpose.  The
+// manifest is written afterwards, once the output is closed.
+func (m *dumpManifest) finish(messagesDumped uint, maxMessages uint) {
+	m.FinishedAt = time.Now().UTC()
+	m.MessagesDumped = messagesDumped
+	if m.progressEvery > 0 && m.received%m.progressEvery != 0 {
+		m.snapshot()
+	}
+
+	limited := maxMessages > 0 && m.MessagesDumped >= maxMessages
+	if int(m.MessagesDumped+m.MessagesFiltered) < m.MessagesAvailable && !limited {
+		warningLog("WARNING: dumped %d of the %d messages available in queue %q",
+			m.MessagesDumped, m.MessagesAvailable, m.Queue)
+	}
+}
+
+// finished reports whether the dump loop completed, so that the manifest
+// describes the dump.
+func (m *dumpManifest) finished() bool {
+	return m != nil && !m.FinishedAt.IsZero()
+}
+
+func writeManifest(outputDir string, m *dumpManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path.Join(outputDir, manifestFileName), append(data, '\n'))
+}
+
+func readManifest(outputDir string) (*dumpManifest, error) {
+	data, err := ioutil.ReadFile(path.Join(outputDir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var m dumpManifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// updateEmptyMarker writes an empty EMPTY file to outputDir after a
+// successful dump of no messages, for -dump-empty-marker, so that automation
+// can tell an empty queue from a dump that failed before writing anything.
+// A marker left by an earlier run is removed when messages were dumped.
+func updateEmptyMarker(outputDir string, messagesDumped uint) error {
+	markerPath := path.Join(outputDir, emptyMarkerFileName)
+	if messagesDumped > 0 {
+		err := os.Remove(markerPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return writeFile(markerPath, nil)
+}
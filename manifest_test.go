@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-manifest")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &dumpManifest{Queue: "incoming_1", Output: "files", MessagesAvailable: 10}
+	m.finish(3, 0)
+	err = writeManifest(dir, m)
+	if err != nil {
+		t.Fatalf("writeManifest: %s", err)
+	}
+
+	loaded, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+	if loaded.Queue != "incoming_1" ||
+		loaded.MessagesAvailable != 10 ||
+		loaded.MessagesDumped != 3 ||
+		loaded.FinishedAt.IsZero() {
+		t.Errorf("Wrong manifest: %#v", loaded)
+	}
+}
+
+func TestManifestCountsFilteredMessages(t *testing.T) {
+	// Only the even messages match, so all 5 are accounted for.
+	even := func(msg amqp091.Delivery) bool {
+		return strings.ContainsAny(string(msg.Body), "024")
+	}
+	m := &dumpManifest{MessagesAvailable: 5}
+	loop := &dumpLoop{fetch: getMessages(newTestBroker(5), testQueueName, false), writer: &testWriter{}, filters: []messageFilter{even}, manifest: m}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	m.finish(received, 0)
+	if m.MessagesDumped != 3 || m.MessagesFiltered != 2 || !m.finished() {
+		t.Errorf("Expected 3 dumped and 2 filtered messages, got %#v", m)
+	}
+}
+
+func TestManifestWarnsWhenShort(t *testing.T) {
+	recorder := &testEvents{}
+	events = recorder
+	defer func() { events = nil }()
+
+	for _, test := range []struct {
+		dumped      uint
+		maxMessages uint
+		warns       bool
+	}{
+		{10, 0, false},
+		{4, 0, true},
+		// Stopped by -max-messages or -tail-n.
+		{3, 3, false},
+		// The queue had fewer messages left than the limit.
+		{4, 6, true},
+	} {
+		recorder.messages = nil
+		m := &dumpManifest{Queue: "incoming_1", MessagesAvailable: 10}
+		m.finish(test.dumped, test.maxMessages)
+		if warned := len(recorder.messages) > 0; warned != test.warns {
+			t.Errorf("%d dumped with a limit of %d: expected warning %v, got %v", test.dumped, test.maxMessages, test.warns, recorder.messages)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=3 -output-dir=tmp-test -manifest")
+
+	m, err := readManifest("tmp-test")
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+	if m.Queue != testQueueName || m.MessagesAvailable != 10 || m.MessagesDumped != 3 || m.Output != "files" {
+		t.Errorf("Wrong manifest: %#v", m)
+	}
+	if m.Broker == nil || m.Broker.Product != "RabbitMQ" || m.Broker.Version == "" || !m.Broker.Capabilities["publisher_confirms"] {
+		t.Errorf("Wrong broker in manifest: %#v", m.Broker)
+	}
+}
+
+func TestManifestProgressSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-manifest")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &dumpManifest{Queue: "incoming_1", Output: "files", MessagesAvailable: 7, progressEvery: 3}
+	for i := 0; i < 7; i++ {
+		m.messageReceived(10)
+	}
+	m.finish(7, 0)
+	err = writeManifest(dir, m)
+	if err != nil {
+		t.Fatalf("writeManifest: %s", err)
+	}
+
+	loaded, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+	// Every 3 messages, plus the last one at the end of the dump.
+	expected := []progressSnapshot{{Messages: 3, Bytes: 30}, {Messages: 6, Bytes: 60}, {Messages: 7, Bytes: 70}}
+	if len(loaded.Progress) != len(expected) {
+		t.Fatalf("Expected %d snapshots, got %#v", len(expected), loaded.Progress)
+	}
+	for i, snapshot := range loaded.Progress {
+		if snapshot.Messages != expected[i].Messages || snapshot.Bytes != expected[i].Bytes || snapshot.Time.IsZero() {
+			t.Errorf("Snapshot %d: expected %d messages and %d bytes, got %#v", i, expected[i].Messages, expected[i].Bytes, snapshot)
+		}
+		if i > 0 && snapshot.Time.Before(loaded.Progress[i-1].Time) {
+			t.Errorf("Snapshot %d is older than the previous one", i)
+		}
+	}
+}
+
+func TestManifestWithoutProgress(t *testing.T) {
+	m := &dumpManifest{}
+	m.messageReceived(10)
+	if len(m.Progress) != 0 {
+		t.Errorf("Expected no snapshots without -progress-every, got %#v", m.Progress)
+	}
+
+	var none *dumpManifest
+	none.messageReceived(10)
+}
+
+func TestUpdateEmptyMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-manifest")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	markerPath := path.Join(dir, emptyMarkerFileName)
+
+	err = updateEmptyMarker(dir, 0)
+	if err != nil {
+		t.Fatalf("updateEmptyMarker: %s", err)
+	}
+	verifyFileContent(t, markerPath, "")
+
+	err = updateEmptyMarker(dir, 3)
+	if err != nil {
+		t.Fatalf("updateEmptyMarker: %s", err)
+	}
+	if _, err := os.Stat(markerPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the marker to be removed after a dump of some messages, got %v", err)
+	}
+	err = updateEmptyMarker(dir, 3)
+	if err != nil {
+		t.Errorf("updateEmptyMarker without a marker: %s", err)
+	}
+}
+
+func TestDumpEmptyMarker(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+	run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -output-dir=tmp-test -manifest -dump-empty-marker")
+
+	verifyFileContent(t, path.Join("tmp-test", emptyMarkerFileName), "")
+	m, err := readManifest("tmp-test")
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+	if m.MessagesAvailable != 0 || m.MessagesDumped != 0 {
+		t.Errorf("Wrong manifest of an empty queue: %#v", m)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// queueMirror is a temporary copy of a queue.  The dump reads the copies, so
+// the original messages are only held un-acked while they are being copied.
+type queueMirror struct {
+	queue   string
+	origins []messageOrigin
+}
+
+// messageOrigin is where and by whom a copied message was originally
+// published, which the copy loses because it is published to the temporary
+// queue directly, by the user of the dump.
+type messageOrigin struct {
+	exchange   string
+	routingKey string
+	userID     string
+}
+
+// mirrorQueue copies up to limit messages (0 for all) of source into a new
+// exclusive queue, in order.  The originals are never acknowledged: they are
+// returned to source when the copying channel is closed.
+func mirrorQueue(conn *amqp091.Connection, source string, limit uint) (*queueMirror, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// Closing the channel requeues the originals right after the copy.
+	defer channel.Close()
+
+	err = channel.Confirm(false)
+	if err != nil {
+		return nil, fmt.Errorf("Confirm: %s", err)
+	}
+	confirms := channel.NotifyPublish(make(chan amqp091.Confirmation, 1))
+	return copyQueue(channel, confirms, source, limit)
+}
+
+// copyQueue publishes up to limit messages (0 for all) of source to a new
+// exclusive queue, waiting for the confirm of each on confirms, without
+// acknowledging them.
+func copyQueue(channel amqpChannel, confirms <-chan amqp091.Confirmation, source string, limit uint) (*queueMirror, error) {
+	temp, err := channel.QueueDeclare("", false, false, true, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Queue declare: %s", err)
+	}
+
+	m := &queueMirror{queue: temp.Name}
+	for limit == 0 || uint(len(m.origins)) < limit {
+		msg, ok, err := channel.Get(source, false)
+		if err != nil {
+			return nil, fmt.Errorf("Queue get: %s", err)
+		}
+		if !ok {
+			break
+		}
+		err = channel.Publish("", temp.Name, false, false, deliveryToPublishing(msg))
+		if err != nil {
+			return nil, fmt.Errorf("Publish: %s", err)
+		}
+		if confirm, ok := <-confirms; !ok || !confirm.Ack {
+			return nil, fmt.Errorf("Publish: message %d not confirmed by the broker", len(m.origins))
+		}
+		m.origins = append(m.origins, messageOrigin{exchange: msg.Exchange, routingKey: msg.RoutingKey, userID: msg.UserId})
+	}
+
+	verboseLog(fmt.Sprintf("Copied %d messages from queue %q to %q", len(m.origins), source, m.queue))
+	return m, nil
+}
+
+// withOrigins wraps a fetch from the temporary queue so that the messages
+// report the exchange, routing key and user_id of the originals.
+func (m *queueMirror) withOrigins(fetch fetchFunc) fetchFunc {
+	next := 0
+	return func() (amqp091.Delivery, bool, error) {
+		msg, ok, err := fetch()
+		if ok && err == nil && next < len(m.origins) {
+			msg.Exchange = m.origins[next].exchange
+			msg.RoutingKey = m.origins[next].routingKey
+			msg.UserId = m.origins[next].userID
+			next++
+		}
+		return msg, ok, err
+	}
+}
+
+// deliveryToPublishing returns a Publishing with the same body, headers and
+// properties as msg, except user_id: the broker rejects a publish whose
+// user_id isn't the user of the connection with PRECONDITION_FAILED.
+func deliveryToPublishing(msg amqp091.Delivery) amqp091.Publishing {
+	return amqp091.Publishing{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
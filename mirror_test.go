@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestMirrorWithOrigins(t *testing.T) {
+	m := &queueMirror{
+		queue: "amq.gen-test",
+		origins: []messageOrigin{
+			{exchange: "ex-0", routingKey: "key-0", userID: "orders-service"},
+			{exchange: "ex-1", routingKey: "key-1"},
+		},
+	}
+	fetched := 0
+	fetch := m.withOrigins(func() (amqp091.Delivery, bool, error) {
+		if fetched == 2 {
+			return amqp091.Delivery{}, false, nil
+		}
+		fetched++
+		return amqp091.Delivery{RoutingKey: "amq.gen-test"}, true, nil
+	})
+
+	for i, expected := range m.origins {
+		msg, ok, err := fetch()
+		if !ok || err != nil {
+			t.Fatalf("fetch %d: %v, %v", i, ok, err)
+		}
+		if msg.Exchange != expected.exchange || msg.RoutingKey != expected.routingKey || msg.UserId != expected.userID {
+			t.Errorf("Message %d: expected %v, got exchange %q, routing key %q and user_id %q", i, expected, msg.Exchange, msg.RoutingKey, msg.UserId)
+		}
+	}
+	if _, ok, _ := fetch(); ok {
+		t.Errorf("Expected no more messages")
+	}
+}
+
+func TestMirrorRejectsChannels(t *testing.T) {
+	*mirror = true
+	*channelCount = 2
+	defer func() {
+		*mirror = false
+		*channelCount = 1
+	}()
+	err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, "tmp-test", false)
+	if err == nil || !strings.Contains(err.Error(), "-channels can't be combined") {
+		t.Errorf("Expected -mirror with -channels to be rejected, got %v", err)
+	}
+}
+
+func TestMirrorRouted(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10, testExchangeName)
+	defer deleteTestQueue(t)
+
+	output := run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=3 -output-dir=tmp-test -full -mirror")
+	expectedOutput := "tmp-test/msg-0000\n" +
+		"tmp-test/msg-0000-headers+properties.json\n" +
+		"tmp-test/msg-0001\n" +
+		"tmp-test/msg-0001-headers+properties.json\n" +
+		"tmp-test/msg-0002\n" +
+		"tmp-test/msg-0002-headers+properties.json\n"
+	if output != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0002", "message-2-body")
+
+	_, properties := verifyAndGetDefaultMetadata(t)
+	if properties["exchange"] != testExchangeName ||
+		properties["routing_key"] != testRoutingKey {
+		t.Errorf("Wrong property value: properties = %#v", properties)
+	}
+}
+
+func TestCopyQueue(t *testing.T) {
+	broker := newTestBroker(5)
+	for i := range broker.ready {
+		broker.ready[i].Exchange = "orders"
+		broker.ready[i].RoutingKey = fmt.Sprintf("key-%d", i)
+		broker.ready[i].UserId = "orders-service"
+	}
+	broker.confirms = make(chan amqp091.Confirmation, 5)
+
+	m, err := copyQueue(broker, broker.confirms, testQueueName, 3)
+	if err != nil {
+		t.Fatalf("copyQueue: %s", err)
+	}
+	if len(broker.declared) != 1 || m.queue != broker.declared[0] {
+		t.Fatalf("Expected a copy in a declared queue, got %q and %v", m.queue, broker.declared)
+	}
+	copies := broker.published[m.queue]
+	if len(copies) != 3 || len(m.origins) != 3 {
+		t.Fatalf("Expected 3 copies, got %d with %d origins", len(copies), len(m.origins))
+	}
+	for i, copied := range copies {
+		if string(copied.Body) != fmt.Sprintf("message-%d-body", i) || m.origins[i].routingKey != fmt.Sprintf("key-%d", i) {
+			t.Errorf("Copy %d: wrong body %q or origin %v", i, copied.Body, m.origins[i])
+		}
+		// Published as the user of the dump, which the broker would check.
+		if copied.UserId != "" || m.origins[i].userID != "orders-service" {
+			t.Errorf("Copy %d: expected the user_id only in the origin, got %q and %v", i, copied.UserId, m.origins[i])
+		}
+	}
+	if len(broker.acked) != 0 {
+		t.Errorf("Expected the originals to stay un-acked, got acks %v", broker.acked)
+	}
+}
+
+func TestCopyQueueStopsWithoutConfirm(t *testing.T) {
+	broker := newTestBroker(2)
+	confirms := make(chan amqp091.Confirmation)
+	close(confirms)
+
+	_, err := copyQueue(broker, confirms, testQueueName, 0)
+	if err == nil || !strings.Contains(err.Error(), "not confirmed") {
+		t.Errorf("Expected an unconfirmed publish to fail the copy, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// errReaderClosed is returned when the reading end of a pipe went away.
+var errReaderClosed = errors.New("output reader closed")
+
+func ndjsonFilePath(outputDir string) string {
+	return path.Join(outputDir, "dump.ndjson")
+}
+
+// ndjsonWriter writes one JSON object per line: the message body and its
+// properties and headers, shaped according to -json-root.  With a rotation
+// size, the file is rotated like a log file once it reaches that size.
+type ndjsonWriter struct {
+	output *bufferedFile
+
+	path        string
+	interval    time.Duration
+	written     uint64
+	rotateSize  uint64
+	rotateCount uint
+}
+
+// openNdjsonWriter creates the ndjson file, or opens filePath for writing if
+// it is a named pipe. Pipes are always flushed after every message so that
+// the reader sees each message as soon as it was received.
+func openNdjsonWriter(filePath string) (*ndjsonWriter, error) {
+	file, interval, err := openOutputFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("ndjson: %s", err)
+	}
+	w := newNdjsonWriter(file, interval)
+	if !isNamedPipe(filePath) {
+		w.path = filePath
+		w.interval = interval
+		w.rotateSize = *rotateSize
+		w.rotateCount = *rotateCount
+	}
+	return w, nil
+}
+
+// openOutputFile creates a single-file output and prints its name, or opens
+// filePath for writing if it is a named pipe. It returns the -flush-interval
+// to use, which is 0 for pipes.
+func openOutputFile(filePath string) (*os.File, time.Duration, error) {
+	if isNamedPipe(filePath) {
+		file, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+		return file, 0, err
+	}
+	file, err := createOutputFile(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	fmt.Println(filePath)
+	return file, *flushInterval, nil
+}
+
+// createOutputFile creates or truncates filePath with the -file-mode
+// permissions.
+func createOutputFile(filePath string) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(fileMode))
+	if err != nil {
+		return nil, err
+	}
+	err = file.Chmod(os.FileMode(fileMode))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func newNdjsonWriter(file io.WriteCloser, flushInterval time.Duration) *ndjsonWriter {
+	return &ndjsonWriter{output: newBufferedFile(file, flushInterval)}
+}
+
+// ndjsonRecord returns the JSON object written for msg. Bodies that aren't
+// valid UTF-8 are base64-encoded under "body_base64" instead of "body".
+func ndjsonRecord(msg amqp091.Delivery) map[string]interface{} {
+	record := getExtras(msg)
+	if utf8.Valid(msg.Body) {
+		record["body"] = string(msg.Body)
+	} else {
+		record["body_base64"] = base64.StdEncoding.EncodeToString(msg.Body)
+	}
+	return record
+}
+
+// errRotateFailed is returned for the messages after a failed rotation.
+var errRotateFailed = errors.New("output file closed after a failed rotation")
+
+func (w *ndjsonWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	if w.output == nil {
+		return newDumpError("ndjson", msg, counter, errRotateFailed)
+	}
+	data, err := marshalJSON(ndjsonRecord(msg), "")
+	if err != nil {
+		return newDumpError("ndjson", msg, counter, err)
+	}
+	data = append(data, '\n')
+
+	err = w.output.writeRecord(data)
+	if errors.Is(err, syscall.EPIPE) {
+		return errReaderClosed
+	}
+	if err != nil {
+		return newDumpError("ndjson", msg, counter, err)
+	}
+
+	w.written += uint64(len(data))
+	if w.rotateSize > 0 && w.written >= w.rotateSize {
+		err = w.rotate()
+		if err != nil {
+			return newDumpError("ndjson rotate", msg, counter, err)
+		}
+	}
+	return nil
+}
+
+// rotate closes the ndjson file, which ends with a complete line, renames it
+// to dump.ndjson.1 after shifting the older files (dump.ndjson.1 to
+// dump.ndjson.2 and so on, removing the one beyond the rotation count) and
+// starts a new file.  Renames are atomic, so every rotated file holds only
+// complete lines.  After a failure no more messages are written.
+func (w *ndjsonWriter) rotate() error {
+	err := w.output.Close()
+	w.output = nil
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(rotatedPath(w.path, w.rotateCount))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := w.rotateCount; i > 1; i-- {
+		err = os.Rename(rotatedPath(w.path, i-1), rotatedPath(w.path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if w.rotateCount > 0 {
+		err = os.Rename(w.path, rotatedPath(w.path, 1))
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := createOutputFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.output = newBufferedFile(file, w.interval)
+	w.written = 0
+	verboseLog(fmt.Sprintf("Rotated %s", w.path))
+	return nil
+}
+
+// rotatedPath is the name of the n-th most recent rotated file; the 0th is
+// the file being written.
+func rotatedPath(filePath string, n uint) string {
+	if n == 0 {
+		return filePath
+	}
+	return fmt.Sprintf("%s.%d", filePath, n)
+}
+
+func (w *ndjsonWriter) Close() error {
+	if w.output == nil {
+		return nil
+	}
+	err := w.output.Close()
+	if errors.Is(err, syscall.EPIPE) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestNdjsonWriterStreamsToPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	writer := newNdjsonWriter(w, 0)
+
+	msg := amqp091.Delivery{
+		Headers:   amqp091.Table{"my-header": "my-value"},
+		MessageId: "msgid-0",
+		Body:      []byte("message-0-body"),
+	}
+	err = writer.WriteMessage(msg, 0)
+	if err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	// The line must be readable without closing the writer.
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("ReadBytes: %s", err)
+	}
+	var record map[string]interface{}
+	err = json.Unmarshal(line, &record)
+	if err != nil {
+		t.Fatalf("Error unmarshaling JSON: %s", err)
+	}
+	properties, _ := record["properties"].(map[string]interface{})
+	if record["body"] != "message-0-body" || properties["message_id"] != "msgid-0" {
+		t.Errorf("Wrong ndjson record: %#v", record)
+	}
+
+	r.Close()
+	err = writer.WriteMessage(msg, 1)
+	if err != errReaderClosed {
+		t.Errorf("Expected errReaderClosed after the reader closed, got %v", err)
+	}
+	writer.Close()
+}
+
+func TestNdjsonRecordBinaryBody(t *testing.T) {
+	record := ndjsonRecord(amqp091.Delivery{Body: []byte{0xff, 0x00, 0xfe}})
+	if record["body"] != nil || record["body_base64"] != "/wD+" {
+		t.Errorf("Wrong ndjson record for binary body: %#v", record)
+	}
+}
+
+func TestNdjsonRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-rotate")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every line is a bit over 100 bytes, so the file rotates every 3 lines.
+	*rotateSize = 300
+	*rotateCount = 2
+	defer func() {
+		*rotateSize = 0
+		*rotateCount = 5
+	}()
+
+	filePath := ndjsonFilePath(dir)
+	writer, err := openNdjsonWriter(filePath)
+	if err != nil {
+		t.Fatalf("openNdjsonWriter: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		msg := amqp091.Delivery{MessageId: fmt.Sprintf("msgid-%d", i), Body: []byte(fmt.Sprintf("message-%d-body", i))}
+		err = writer.WriteMessage(msg, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// Messages 0-2 were in dump.ndjson.3, which was removed.
+	expected := map[string][]string{
+		filePath:        {"msgid-9"},
+		filePath + ".1": {"msgid-6", "msgid-7", "msgid-8"},
+		filePath + ".2": {"msgid-3", "msgid-4", "msgid-5"},
+	}
+	for name, ids := range expected {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) != len(ids) {
+			t.Errorf("%s: expected %d lines but got %d", name, len(ids), len(lines))
+			continue
+		}
+		for i, line := range lines {
+			var record map[string]interface{}
+			err = json.Unmarshal([]byte(line), &record)
+			if err != nil {
+				t.Fatalf("%s: incomplete line %q: %s", name, line, err)
+			}
+			properties, _ := record["properties"].(map[string]interface{})
+			if properties["message_id"] != ids[i] {
+				t.Errorf("%s: expected %s on line %d but got %v", name, ids[i], i, properties["message_id"])
+			}
+		}
+	}
+	if _, err := os.Stat(filePath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept, got %v", err)
+	}
+}
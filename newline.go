@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// isTextContentType reports whether a content type is textual: text/* and
+// the JSON, XML and JavaScript application types, including the +json and
+// +xml structured syntax suffixes.
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// fileBody returns the body written to the body file of msg: with
+// -append-newline, text bodies that don't end with a newline get one.
+func fileBody(msg amqp091.Delivery) []byte {
+	if !*appendNewline || !isTextContentType(msg.ContentType) || bytes.HasSuffix(msg.Body, []byte("\n")) {
+		return msg.Body
+	}
+	body := make([]byte, len(msg.Body), len(msg.Body)+1)
+	copy(body, msg.Body)
+	return append(body, '\n')
+}
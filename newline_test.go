@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestIsTextContentType(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"text/plain":               true,
+		"text/csv; charset=utf-8":  true,
+		"application/json":         true,
+		"application/vnd.api+json": true,
+		"application/atom+xml":     true,
+		"application/octet-stream": false,
+		"application/x-protobuf":   false,
+		"":                         false,
+		"not a content type; =":    false,
+	} {
+		if got := isTextContentType(contentType); got != expected {
+			t.Errorf("isTextContentType(%q): expected %v but got %v", contentType, expected, got)
+		}
+	}
+}
+
+func TestAppendNewline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-newline")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	messages := []amqp091.Delivery{
+		{ContentType: "text/plain", Body: []byte("line")},
+		{ContentType: "application/json", Body: []byte("{}\n")},
+		{ContentType: "application/octet-stream", Body: []byte{0x01, 0x02}},
+		{Body: []byte("no content type")},
+	}
+	tests := []struct {
+		appendNewline bool
+		expected      []string
+	}{
+		{false, []string{"line", "{}\n", "\x01\x02", "no content type"}},
+		{true, []string{"line\n", "{}\n", "\x01\x02", "no content type"}},
+	}
+	for _, test := range tests {
+		*appendNewline = test.appendNewline
+		writer := newFilesWriter(dir, 1)
+		for i, msg := range messages {
+			err = writer.WriteMessage(msg, uint(i))
+			if err != nil {
+				t.Fatalf("WriteMessage: %s", err)
+			}
+		}
+		for i, expected := range test.expected {
+			verifyFileContent(t, generateFilePath(dir, uint(i)), expected)
+		}
+	}
+	*appendNewline = false
+
+	if string(messages[0].Body) != "line" {
+		t.Errorf("The message body must not be modified: %q", messages[0].Body)
+	}
+}
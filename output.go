@@ -0,0 +1,554 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// messageWriter saves dumped messages in one of the output formats.
+type messageWriter interface {
+	WriteMessage(msg amqp091.Delivery, counter uint) error
+	Close() error
+}
+
+// messageFlusher is implemented by writers that save messages in the
+// background: flush waits until every message passed to WriteMessage is
+// saved and returns the failures.
+type messageFlusher interface {
+	flush() []error
+}
+
+// openMessageWriter returns the writer for the selected output format. A
+// named pipe as -output-dir gets a framed stream with -output=framed, a zip
+// stream with -output=zip and an ndjson stream otherwise, and
+// -kafka-brokers, -webhook-url or -output-command replace the files
+// altogether.
+func openMessageWriter(outputDir string, db bool) (messageWriter, error) {
+	if *bodyFrequency {
+		return newFrequencyWriter(outputDir), nil
+	}
+	if *headerSchemas {
+		return newSchemaWriter(outputDir), nil
+	}
+	if *outputCommand != "" {
+		return startOutputCommand(*outputCommand)
+	}
+	if *webhookURL != "" {
+		return openWebhookWriter(*webhookURL)
+	}
+	if *kafkaBrokers != "" {
+		return openKafkaWriter(*kafkaBrokers, *kafkaTopic)
+	}
+	if db && *splitEvery > 0 {
+		return &partitionedDbWriter{outputDir: outputDir}, nil
+	}
+	if db {
+		return openDbWriter(outputDir)
+	}
+	if isNamedPipe(outputDir) && *output == "framed" {
+		return openFramedWriter(outputDir)
+	}
+	if isNamedPipe(outputDir) && *output == "zip" {
+		return openZipWriter(outputDir, *zipLevel)
+	}
+	if *output == "concat" {
+		return openConcatOutput(outputDir)
+	}
+	if isNamedPipe(outputDir) {
+		return openNdjsonWriter(outputDir)
+	}
+	if *output == "ndjson" {
+		return openNdjsonWriter(ndjsonFilePath(outputDir))
+	}
+	if *output == "framed" {
+		return openFramedWriter(framedFilePath(outputDir))
+	}
+	if *output == "zip" {
+		return openZipWriter(zipFilePath(outputDir), *zipLevel)
+	}
+	if *output == "html" {
+		return newHTMLWriter(outputDir)
+	}
+	return newFilesWriter(outputDir, *writeParallel), nil
+}
+
+// isSingleFileOutput reports whether -output writes all messages to one file
+// instead of a file per message.
+func isSingleFileOutput() bool {
+	return *output == "ndjson" || *output == "framed" || *output == "zip" || *output == "concat"
+}
+
+// isExternalOutput reports whether the messages are handed to another
+// system instead of being written to -output-dir.
+func isExternalOutput() bool {
+	return *kafkaBrokers != "" || *webhookURL != "" || *outputCommand != ""
+}
+
+// DumpError describes a failure to save a single message.
+type DumpError struct {
+	Counter   uint
+	MessageID string
+	Op        string
+	Err       error
+}
+
+func newDumpError(op string, msg amqp091.Delivery, counter uint, err error) *DumpError {
+	return &DumpError{
+		Counter:   counter,
+		MessageID: msg.MessageId,
+		Op:        op,
+		Err:       err,
+	}
+}
+
+func (e *DumpError) Error() string {
+	if e.MessageID != "" {
+		return fmt.Sprintf("%s: message %d (message_id %q): %s", e.Op, e.Counter, e.MessageID, e.Err)
+	}
+	return fmt.Sprintf("%s: message %d: %s", e.Op, e.Counter, e.Err)
+}
+
+func (e *DumpError) Unwrap() error {
+	return e.Err
+}
+
+// filesWriter writes each message body to its own msg-NNNN file, with
+// optional headers+properties and raw delivery files next to it.  With a
+// concurrency above 1 the files are saved in the background, so they may be
+// written out of order, but each file is still named after the counter the
+// message got when it was fetched; the failures are collected until flush
+// is called.
+type filesWriter struct {
+	outputDir string
+	// used holds the body file paths named after the message, and named
+	// lists them for the filename index.
+	used  map[string]bool
+	named []filenameIndexEntry
+
+	slots    chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	failures []error
+}
+
+func newFilesWriter(outputDir string, concurrency uint) *filesWriter {
+	w := &filesWriter{outputDir: outputDir}
+	if concurrency > 1 {
+		w.slots = make(chan struct{}, concurrency)
+	}
+	return w
+}
+
+// bodyPath returns the path of the body file of message counter: the
+// msg-NNNN file, or the name from -filename-from-header or -filename-template,
+// with "-NNNN" appended if another message already had that name.
+// Email messages get the .eml extension with -output=eml.  The metadata files
+// add their suffix to it.
+func (w *filesWriter) bodyPath(msg amqp091.Delivery, counter uint) string {
+	filePath := generateFilePath(w.outputDir, counter)
+	extension := ""
+	if *output == "eml" && isEmailMessage(msg) {
+		extension = emlExtension
+	}
+	name := messageFilename(msg, counter)
+	if name == "" {
+		return filePath + extension
+	}
+
+	if w.used == nil {
+		w.used = make(map[string]bool)
+	}
+	filePath = path.Join(path.Dir(filePath), name)
+	for w.used[filePath+extension] || isReservedFilename(path.Base(filePath+extension)) {
+		filePath += fmt.Sprintf("-%04d", counter)
+	}
+	filePath += extension
+	w.used[filePath] = true
+	w.named = append(w.named, filenameIndexEntry{
+		Counter: counter,
+		File:    strings.TrimPrefix(filePath, path.Clean(w.outputDir)+"/"),
+	})
+	return filePath
+}
+
+func (w *filesWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	_, err := w.writeMessage(msg, counter)
+	return err
+}
+
+// writeMessage saves msg like WriteMessage and returns the path of its body
+// file.
+func (w *filesWriter) writeMessage(msg amqp091.Delivery, counter uint) (string, error) {
+	if *splitEvery > 0 && counter%*splitEvery == 0 {
+		err := makeDirs(path.Join(w.outputDir, partitionDir(counter, *splitEvery)))
+		if err != nil {
+			return "", newDumpError("create partition directory", msg, counter, err)
+		}
+	}
+
+	bodyPath := w.bodyPath(msg, counter)
+	if w.slots == nil {
+		return bodyPath, saveMessageFiles(msg, bodyPath, counter)
+	}
+
+	w.slots <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.wg.Done()
+		}()
+		err := saveMessageFiles(msg, bodyPath, counter)
+		if err != nil {
+			w.mu.Lock()
+			w.failures = append(w.failures, err)
+			w.mu.Unlock()
+		}
+	}()
+	return bodyPath, nil
+}
+
+// saveMessageFiles writes the body and the enabled metadata files of msg.
+func saveMessageFiles(msg amqp091.Delivery, bodyPath string, counter uint) error {
+	err := saveMessageToFile(fileBody(msg), bodyPath)
+	if err != nil {
+		return newDumpError("save message", msg, counter, err)
+	}
+
+	if *full {
+		err = savePropsAndHeadersToFile(msg, bodyPath, counter)
+		if err != nil {
+			return newDumpError("save props and headers", msg, counter, err)
+		}
+	}
+
+	if protoBodies != nil && !*protoReplace {
+		err = saveProtoJSONToFile(msg, bodyPath)
+		if err != nil {
+			return newDumpError("save protobuf JSON", msg, counter, err)
+		}
+	}
+
+	if *rawProperties {
+		err = saveRawDeliveryToFile(msg, bodyPath)
+		if err != nil {
+			return newDumpError("save raw delivery", msg, counter, err)
+		}
+	}
+
+	return nil
+}
+
+// flush waits for the files saved in the background and returns their
+// failures.
+func (w *filesWriter) flush() []error {
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	failures := w.failures
+	w.failures = nil
+	return failures
+}
+
+func (w *filesWriter) Close() error {
+	if failures := w.flush(); len(failures) > 0 {
+		return fmt.Errorf("%d messages not saved, first: %s", len(failures), failures[0])
+	}
+	if len(w.named) > 0 {
+		return writeFilenameIndex(w.outputDir, w.named)
+	}
+	return nil
+}
+
+// dbWriter inserts messages into the dump table of a sqlite database. All
+// the inserts are done in a single transaction, committed when the writer is
+// closed, which is much faster than committing every message.  With
+// -db-batch the transaction is committed, and a new one started, every
+// batchSize messages instead, so a crash only loses the last batch.
+type dbWriter struct {
+	database   *sql.DB
+	tx         *sql.Tx
+	dedupe     bool
+	duplicates int
+	batchSize  uint
+	pending    uint
+	committed  uint
+}
+
+var dbPragmaRegexp = regexp.MustCompile(`^[a-z_]+=[A-Za-z0-9_]+$`)
+
+func openDbWriter(outputDir string) (*dbWriter, error) {
+	return openDbFile(path.Join(outputDir, "dump.db"))
+}
+
+func openDbFile(dbPath string) (*dbWriter, error) {
+	// Create the file ourselves so that it never exists with other
+	// permissions than -file-mode; SQLite accepts an empty file.
+	file, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_CREATE, os.FileMode(fileMode))
+	if err == nil {
+		file.Close()
+		err = os.Chmod(dbPath, os.FileMode(fileMode))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SQLite: %s", err)
+	}
+
+	database, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("SQLite: %s", err)
+	}
+	// Pragmas like journal_mode are per connection.
+	database.SetMaxOpenConns(1)
+
+	err = setupDb(database, dbPragmaFlags, *dbDedupe)
+	if err != nil {
+		database.Close()
+		return nil, fmt.Errorf("SQLite: %s", err)
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		database.Close()
+		return nil, fmt.Errorf("SQLite: %s", err)
+	}
+	return &dbWriter{database: database, tx: tx, dedupe: *dbDedupe, batchSize: *dbBatch}, nil
+}
+
+func setupDb(database *sql.DB, pragmas []string, dedupe bool) error {
+	for _, pragma := range pragmas {
+		if !dbPragmaRegexp.MatchString(pragma) {
+			return fmt.Errorf("Invalid pragma %q, expected pragma=value", pragma)
+		}
+		_, err := database.Exec("PRAGMA " + pragma)
+		if err != nil {
+			return fmt.Errorf("PRAGMA %s: %s", pragma, err)
+		}
+	}
+	_, err := database.Exec(
+		"CREATE TABLE IF NOT EXISTS dump (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"message STRING NOT NULL," +
+			"headers STRING NOT NULL," +
+			"message_id STRING," +
+			"body_hash STRING" +
+			");")
+	if err != nil {
+		return err
+	}
+	err = addMissingDbColumns(database, "message_id", "body_hash")
+	if err != nil {
+		return err
+	}
+	if !dedupe {
+		return nil
+	}
+
+	// Messages without a message_id are deduplicated by the SHA-256 of their
+	// body.  NULL message_ids are distinct in a UNIQUE index, hence the
+	// partial indexes.
+	_, err = database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS dump_message_id ON dump (message_id) WHERE message_id IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("-db-dedupe: %s", err)
+	}
+	_, err = database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS dump_body_hash ON dump (body_hash) WHERE message_id IS NULL")
+	if err != nil {
+		return fmt.Errorf("-db-dedupe: %s", err)
+	}
+	return nil
+}
+
+// addMissingDbColumns upgrades a dump table created by an older version.
+func addMissingDbColumns(database *sql.DB, columns ...string) error {
+	rows, err := database.Query("SELECT name FROM pragma_table_info('dump')")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		if existing[column] {
+			continue
+		}
+		_, err = database.Exec("ALTER TABLE dump ADD COLUMN " + column + " STRING")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errDuplicateMessage is returned by the -db writers for a message that was
+// not inserted because the database already has it.  The unique indexes of
+// -db-dedupe stay in the database, so this also happens in later dumps into
+// it without -db-dedupe.
+var errDuplicateMessage = errors.New("duplicate message")
+
+func (w *dbWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	inserted, err := saveMessageToDb(w.tx, msg, counter)
+	if err != nil {
+		return newDumpError("save message to db", msg, counter, err)
+	}
+	if !inserted {
+		w.duplicates++
+		verboseLog(fmt.Sprintf("Message %d is already in the db, skipped", counter))
+	}
+	w.pending++
+	if w.batchSize > 0 && w.pending >= w.batchSize {
+		err = w.commitBatch()
+		if err != nil {
+			return newDumpError("commit db batch", msg, counter, err)
+		}
+	}
+	if !inserted {
+		return errDuplicateMessage
+	}
+	return nil
+}
+
+// commitBatch commits the messages inserted so far and starts a new
+// transaction for the next batch.
+func (w *dbWriter) commitBatch() error {
+	err := w.tx.Commit()
+	if err != nil {
+		return fmt.Errorf("SQLite: commit: %s", err)
+	}
+	w.committed += w.pending
+	verboseLog(fmt.Sprintf("Committed a batch of %d messages to the db (%d in total)", w.pending, w.committed))
+	w.pending = 0
+	w.tx, err = w.database.Begin()
+	if err != nil {
+		return fmt.Errorf("SQLite: %s", err)
+	}
+	return nil
+}
+
+func (w *dbWriter) Close() error {
+	if w.dedupe || w.duplicates > 0 {
+		noticeLog("Skipped %d duplicate messages already in the db", w.duplicates)
+	}
+	return w.commitAndClose()
+}
+
+func (w *dbWriter) commitAndClose() error {
+	err := w.tx.Commit()
+	closeErr := w.database.Close()
+	verboseLog("DB connection closed")
+	if err != nil {
+		return fmt.Errorf("SQLite: commit: %s", err)
+	}
+	return closeErr
+}
+
+// partitionedDbWriter writes every -split-every messages to a new
+// dump-part-NNNN.db database.  Each database is committed and closed before
+// the next one is created, so that finished partitions are complete sqlite
+// files, which -db-gzip then compresses.
+type partitionedDbWriter struct {
+	outputDir   string
+	current     *dbWriter
+	currentPath string
+	duplicates  int
+}
+
+// partitionDbName is the -split-every database file of message counter.
+func partitionDbName(counter, splitEvery uint) string {
+	return "dump-" + partitionDir(counter, splitEvery) + ".db"
+}
+
+// partitionDbFile is the file that holds the -split-every database of
+// message counter once the dump is done, compressed with -db-gzip.
+func partitionDbFile(counter, splitEvery uint) string {
+	if *dbGzip {
+		return partitionDbName(counter, splitEvery) + ".gz"
+	}
+	return partitionDbName(counter, splitEvery)
+}
+
+// gzipFile replaces filePath with its gzip-compressed filePath.gz.
+func gzipFile(filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = writeFileWith(filePath+".gz", func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		_, err := io.Copy(gz, f)
+		if err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+func (w *partitionedDbWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	if w.current == nil || counter%*splitEvery == 0 {
+		err := w.closeCurrent()
+		if err != nil {
+			return newDumpError("close partition db", msg, counter, err)
+		}
+		w.currentPath = path.Join(w.outputDir, partitionDbName(counter, *splitEvery))
+		w.current, err = openDbFile(w.currentPath)
+		if err != nil {
+			return newDumpError("open partition db", msg, counter, err)
+		}
+	}
+	return w.current.WriteMessage(msg, counter)
+}
+
+func (w *partitionedDbWriter) closeCurrent() error {
+	if w.current == nil {
+		return nil
+	}
+	w.duplicates += w.current.duplicates
+	err := w.current.commitAndClose()
+	w.current = nil
+	if err != nil || !*dbGzip {
+		return err
+	}
+	err = gzipFile(w.currentPath)
+	if err != nil {
+		return fmt.Errorf("-db-gzip: %s", err)
+	}
+	return nil
+}
+
+func (w *partitionedDbWriter) Close() error {
+	err := w.closeCurrent()
+	if *dbDedupe || w.duplicates > 0 {
+		noticeLog("Skipped %d duplicate messages already in the partition dbs", w.duplicates)
+	}
+	return err
+}
+
+func isNamedPipe(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestDumpErrorContainsCounterAndMessageID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-output")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer := &filesWriter{outputDir: path.Join(dir, "does-not-exist")}
+	err = writer.WriteMessage(amqp091.Delivery{MessageId: "msgid-42", Body: []byte("body")}, 42)
+	if err == nil {
+		t.Fatalf("Expected saving to a missing directory to fail")
+	}
+
+	if !strings.Contains(err.Error(), "message 42") || !strings.Contains(err.Error(), "msgid-42") {
+		t.Errorf("Expected error to contain the counter and message ID: %s", err)
+	}
+
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) {
+		t.Fatalf("Expected a *DumpError, got %T", err)
+	}
+	if dumpErr.Counter != 42 || dumpErr.MessageID != "msgid-42" || dumpErr.Op != "save message" {
+		t.Errorf("Wrong DumpError fields: %#v", dumpErr)
+	}
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("Expected the underlying error to be kept: %#v", dumpErr.Err)
+	}
+}
+
+func TestDumpErrorWithoutMessageID(t *testing.T) {
+	err := newDumpError("save message", amqp091.Delivery{}, 3, errors.New("disk full"))
+	expected := "save message: message 3: disk full"
+	if err.Error() != expected {
+		t.Errorf("Wrong error message: expected '%s' but got '%s'", expected, err.Error())
+	}
+}
+
+func TestFilesWriterConcurrentKeepsFetchOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-output")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*splitEvery = 10
+	defer func() { *splitEvery = 0 }()
+
+	broker := newTestBroker(100)
+	writer := newFilesWriter(dir, 8)
+	loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 100 {
+		t.Fatalf("Expected 100 messages, got %d", received)
+	}
+
+	// The files were written concurrently, but message N of the queue must
+	// still be in msg-N.
+	for i := uint(0); i < 100; i++ {
+		verifyFileContent(t, path.Join(dir, partitionDir(i, 10), fmt.Sprintf("msg-%04d", i)), fmt.Sprintf("message-%d-body", i))
+	}
+	if err := writer.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+}
+
+func TestFilesWriterConcurrentFailures(t *testing.T) {
+	writer := newFilesWriter(path.Join(os.TempDir(), "rabbitmq-dump-queue-does-not-exist"), 4)
+	for i := 0; i < 3; i++ {
+		err := writer.WriteMessage(amqp091.Delivery{Body: []byte("body")}, uint(i))
+		if err != nil {
+			t.Fatalf("Expected the failure to be reported by flush, got %s", err)
+		}
+	}
+	if failures := writer.flush(); len(failures) != 3 {
+		t.Errorf("Expected 3 failures, got %v", failures)
+	}
+	if err := writer.Close(); err != nil {
+		t.Errorf("Expected the flushed failures not to be reported again: %s", err)
+	}
+}
+
+func TestFilesWriterSplitEvery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-output")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*splitEvery = 2
+	defer func() { *splitEvery = 0 }()
+
+	writer := &filesWriter{outputDir: dir}
+	for i := 0; i < 5; i++ {
+		err = writer.WriteMessage(amqp091.Delivery{Body: []byte(fmt.Sprintf("body %d", i))}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+
+	expected := []string{
+		"part-0001/msg-0000",
+		"part-0001/msg-0001",
+		"part-0002/msg-0002",
+		"part-0002/msg-0003",
+		"part-0003/msg-0004",
+	}
+	for _, name := range expected {
+		if _, err := os.Stat(path.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to exist: %s", name, err)
+		}
+	}
+
+	messages, orphans, err := findDumpedMessages(dir)
+	if err != nil {
+		t.Fatalf("findDumpedMessages: %s", err)
+	}
+	if len(messages) != 5 || len(orphans) != 0 {
+		t.Fatalf("Expected 5 messages and no orphans, got %d and %v", len(messages), orphans)
+	}
+	for i, msg := range messages {
+		if msg.BodyPath != path.Join(dir, expected[i]) {
+			t.Errorf("Message %d: expected %s, got %s", i, expected[i], msg.BodyPath)
+		}
+	}
+}
+
+func TestManifestPartitions(t *testing.T) {
+	partitions := manifestPartitions(5, 2, false)
+	expected := []manifestPartition{
+		{Dir: "part-0001", FirstMessage: 0, LastMessage: 1},
+		{Dir: "part-0002", FirstMessage: 2, LastMessage: 3},
+		{Dir: "part-0003", FirstMessage: 4, LastMessage: 4},
+	}
+	if len(partitions) != len(expected) {
+		t.Fatalf("Expected %d partitions, got %v", len(expected), partitions)
+	}
+	for i := range expected {
+		if partitions[i] != expected[i] {
+			t.Errorf("Partition %d: expected %v, got %v", i, expected[i], partitions[i])
+		}
+	}
+	if partitions := manifestPartitions(0, 2, false); len(partitions) != 0 {
+		t.Errorf("Expected no partitions for an empty dump, got %v", partitions)
+	}
+}
+
+func countDbRows(t testing.TB, dbPath string) int {
+	database, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	defer database.Close()
+	var rows int
+	err = database.QueryRow("SELECT COUNT(*) FROM dump").Scan(&rows)
+	if err != nil {
+		t.Fatalf("SELECT: %s", err)
+	}
+	return rows
+}
+
+func TestDbWriterWithPragmas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPragmaFlags = stringListFlag{"journal_mode=WAL", "synchronous=NORMAL"}
+	defer func() { dbPragmaFlags = nil }()
+
+	writer, err := openDbWriter(dir)
+	if err != nil {
+		t.Fatalf("openDbWriter: %s", err)
+	}
+	var journalMode string
+	err = writer.tx.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err != nil || journalMode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %q (%v)", journalMode, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		// Quotes in the body used to break the INSERT statement.
+		err = writer.WriteMessage(amqp091.Delivery{Body: []byte(fmt.Sprintf("it's message %d", i))}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if rows := countDbRows(t, path.Join(dir, "dump.db")); rows != 3 {
+		t.Errorf("Expected 3 rows, got %d", rows)
+	}
+}
+
+func TestDbBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*dbBatch = 2
+	defer func() { *dbBatch = 0 }()
+
+	writer, err := openDbWriter(dir)
+	if err != nil {
+		t.Fatalf("openDbWriter: %s", err)
+	}
+	// Only the complete batches are visible to another connection, as they
+	// would be after a crash.
+	for i, expectedRows := range []int{0, 2, 2, 4, 4} {
+		err = writer.WriteMessage(amqp091.Delivery{Body: []byte(fmt.Sprintf("message %d", i))}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		if rows := countDbRows(t, path.Join(dir, "dump.db")); rows != expectedRows {
+			t.Errorf("After message %d: expected %d committed rows, got %d", i, expectedRows, rows)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if rows := countDbRows(t, path.Join(dir, "dump.db")); rows != 5 {
+		t.Errorf("Expected 5 rows, got %d", rows)
+	}
+}
+
+func TestDbWriterRejectsInvalidPragma(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPragmaFlags = stringListFlag{"journal_mode=WAL; DROP TABLE dump"}
+	defer func() { dbPragmaFlags = nil }()
+
+	_, err = openDbWriter(dir)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid pragma")
+	}
+}
+
+func TestDbDedupe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*dbDedupe = true
+	defer func() { *dbDedupe = false }()
+
+	messages := []amqp091.Delivery{
+		{MessageId: "msgid-1", Body: []byte("first")},
+		{MessageId: "msgid-2", Body: []byte("second")},
+		{MessageId: "msgid-1", Body: []byte("first, redelivered")},
+		{Body: []byte("no message id")},
+		{Body: []byte("no message id")},
+		// Same body as a message with an ID, but it has no ID itself.
+		{Body: []byte("first")},
+	}
+	// The second run finds all the messages already in the db, and so does
+	// the third one without -db-dedupe, since the unique indexes stay.
+	for run, expectedDuplicates := range []int{2, 6, 6} {
+		*dbDedupe = run < 2
+		writer, err := openDbWriter(dir)
+		if err != nil {
+			t.Fatalf("openDbWriter: %s", err)
+		}
+		for i, msg := range messages {
+			err = writer.WriteMessage(msg, uint(i))
+			if err != nil && err != errDuplicateMessage {
+				t.Fatalf("WriteMessage: %s", err)
+			}
+		}
+		if writer.duplicates != expectedDuplicates {
+			t.Errorf("Run %d: expected %d duplicates, got %d", run, expectedDuplicates, writer.duplicates)
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+	}
+
+	if rows := countDbRows(t, path.Join(dir, "dump.db")); rows != 4 {
+		t.Errorf("Expected 4 rows, got %d", rows)
+	}
+}
+
+func TestDbDedupeUpgradesOldTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	database, err := sql.Open("sqlite", path.Join(dir, "dump.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	_, err = database.Exec("CREATE TABLE dump (id INTEGER PRIMARY KEY AUTOINCREMENT, message STRING NOT NULL, headers STRING NOT NULL)")
+	database.Close()
+	if err != nil {
+		t.Fatalf("CREATE TABLE: %s", err)
+	}
+
+	*dbDedupe = true
+	defer func() { *dbDedupe = false }()
+
+	writer, err := openDbWriter(dir)
+	if err != nil {
+		t.Fatalf("openDbWriter: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		err = writer.WriteMessage(amqp091.Delivery{MessageId: "msgid-1", Body: []byte("body")}, uint(i))
+		if err != nil && err != errDuplicateMessage {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if rows := countDbRows(t, path.Join(dir, "dump.db")); rows != 1 {
+		t.Errorf("Expected 1 row, got %d", rows)
+	}
+}
+
+func benchmarkDbInserts(b *testing.B, transactional bool) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+	if err != nil {
+		b.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := amqp091.Delivery{
+		Headers:     amqp091.Table{"my-header": "my-value"},
+		ContentType: "application/json",
+		Body:        []byte(`{"id": 12345, "name": "benchmark"}`),
+	}
+
+	b.ResetTimer()
+	if transactional {
+		writer, err := openDbWriter(dir)
+		if err != nil {
+			b.Fatalf("openDbWriter: %s", err)
+		}
+		for i := 0; i < b.N; i++ {
+			err = writer.WriteMessage(msg, uint(i))
+			if err != nil {
+				b.Fatalf("WriteMessage: %s", err)
+			}
+		}
+		err = writer.Close()
+		if err != nil {
+			b.Fatalf("Close: %s", err)
+		}
+	} else {
+		database, err := sql.Open("sqlite", path.Join(dir, "dump.db"))
+		if err != nil {
+			b.Fatalf("sql.Open: %s", err)
+		}
+		defer database.Close()
+		err = setupDb(database, nil, false)
+		if err != nil {
+			b.Fatalf("setupDb: %s", err)
+		}
+		for i := 0; i < b.N; i++ {
+			_, err = saveMessageToDb(database, msg, uint(i))
+			if err != nil {
+				b.Fatalf("saveMessageToDb: %s", err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	if rows := countDbRows(b, path.Join(dir, "dump.db")); rows != b.N {
+		b.Errorf("Expected %d rows, got %d", b.N, rows)
+	}
+}
+
+// Run with: go test -run XXX -bench Db -benchtime 50000x
+func BenchmarkDbInsertsTransaction(b *testing.B) {
+	benchmarkDbInserts(b, true)
+}
+
+func BenchmarkDbInsertsPerInsertCommit(b *testing.B) {
+	benchmarkDbInserts(b, false)
+}
+
+func TestPartitionedDbWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db-split")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*splitEvery = 2
+	defer func() { *splitEvery = 0 }()
+
+	writer, err := openMessageWriter(dir, true)
+	if err != nil {
+		t.Fatalf("openMessageWriter: %s", err)
+	}
+	for counter := uint(0); counter < 5; counter++ {
+		msg := amqp091.Delivery{Body: []byte(fmt.Sprintf("message-%d-body", counter))}
+		err = writer.WriteMessage(msg, counter)
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		if counter == 2 {
+			// The first partition is complete as soon as the second starts.
+			if rows := countDbRows(t, path.Join(dir, "dump-part-0001.db")); rows != 2 {
+				t.Errorf("Expected 2 rows in the finished partition, got %d", rows)
+			}
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	for _, partition := range manifestPartitions(5, 2, true) {
+		dbPath := path.Join(dir, partition.DB)
+		database, err := sql.Open("sqlite", dbPath)
+		if err != nil {
+			t.Fatalf("sql.Open: %s", err)
+		}
+		var integrity string
+		err = database.QueryRow("PRAGMA integrity_check").Scan(&integrity)
+		if err != nil || integrity != "ok" {
+			t.Errorf("%s: integrity check: %s (%v)", partition.DB, integrity, err)
+		}
+		rows, err := database.Query("SELECT message FROM dump ORDER BY id")
+		if err != nil {
+			t.Fatalf("%s: Query: %s", partition.DB, err)
+		}
+		counter := partition.FirstMessage
+		for rows.Next() {
+			var body string
+			rows.Scan(&body)
+			if expected := fmt.Sprintf("message-%d-body", counter); body != expected {
+				t.Errorf("%s: expected %q, got %q", partition.DB, expected, body)
+			}
+			counter++
+		}
+		rows.Close()
+		database.Close()
+		if counter != partition.LastMessage+1 {
+			t.Errorf("%s: expected messages %d to %d, got up to %d", partition.DB, partition.FirstMessage, partition.LastMessage, counter-1)
+		}
+	}
+}
+
+func TestPartitionedDbWriterGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db-gzip")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*splitEvery = 2
+	*dbGzip = true
+	defer func() {
+		*splitEvery = 0
+		*dbGzip = false
+	}()
+
+	writer, err := openMessageWriter(dir, true)
+	if err != nil {
+		t.Fatalf("openMessageWriter: %s", err)
+	}
+	for counter := uint(0); counter < 3; counter++ {
+		err = writer.WriteMessage(amqp091.Delivery{Body: []byte(fmt.Sprintf("message-%d-body", counter))}, counter)
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	for i, partition := range manifestPartitions(3, 2, true) {
+		if _, err := os.Stat(path.Join(dir, partitionDbName(partition.FirstMessage, 2))); !os.IsNotExist(err) {
+			t.Errorf("Expected the uncompressed %s to be removed, got %v", partitionDbName(partition.FirstMessage, 2), err)
+		}
+		f, err := os.Open(path.Join(dir, partition.DB))
+		if err != nil {
+			t.Fatalf("Open: %s", err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: gzip: %s", partition.DB, err)
+		}
+		data, err := ioutil.ReadAll(gz)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: gzip: %s", partition.DB, err)
+		}
+		dbPath := path.Join(dir, "uncompressed.db")
+		err = ioutil.WriteFile(dbPath, data, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		if rows, expected := countDbRows(t, dbPath), 2-i; rows != expected {
+			t.Errorf("%s: expected %d rows, got %d", partition.DB, expected, rows)
+		}
+		os.Remove(dbPath)
+	}
+}
+
+func TestDumpToDb(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    int
+		acknowledge bool
+	}{
+		{"no ack", 3, false},
+		{"ack", 3, true},
+		{"empty queue", 0, false},
+	}
+	for _, test := range tests {
+		populateTestQueue(t, test.messages)
+		dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-db")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		*ack = test.acknowledge
+		err = dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, dir, true)
+		*ack = false
+		if err != nil {
+			t.Fatalf("%s: dumpMessagesFromQueue: %s", test.name, err)
+		}
+
+		database, err := sql.Open("sqlite", path.Join(dir, "dump.db"))
+		if err != nil {
+			t.Fatalf("sql.Open: %s", err)
+		}
+		rows, err := database.Query("SELECT message, message_id, headers FROM dump ORDER BY id")
+		if err != nil {
+			t.Fatalf("Query: %s", err)
+		}
+		i := 0
+		for rows.Next() {
+			var body, messageID, metadata string
+			rows.Scan(&body, &messageID, &metadata)
+			if body != fmt.Sprintf("message-%d-body", i) || messageID != fmt.Sprintf("msgid-%d", i) {
+				t.Errorf("%s: wrong row %d: %q, %q", test.name, i, body, messageID)
+			}
+			var extras struct {
+				Headers    map[string]interface{}
+				Properties map[string]interface{}
+			}
+			err = json.Unmarshal([]byte(metadata), &extras)
+			if err != nil || extras.Headers["my-header"] != fmt.Sprintf("my-value-%d", i) || extras.Properties["priority"] != 4.0 {
+				t.Errorf("%s: wrong headers and properties in row %d: %s (%v)", test.name, i, metadata, err)
+			}
+			i++
+		}
+		rows.Close()
+		database.Close()
+		if i != test.messages {
+			t.Errorf("%s: expected %d rows, got %d", test.name, test.messages, i)
+		}
+
+		expectedLength := test.messages
+		if test.acknowledge {
+			expectedLength = 0
+		}
+		if length := getTestQueueLength(t); length != expectedLength {
+			t.Errorf("%s: expected %d messages left in the queue, got %d", test.name, expectedLength, length)
+		}
+		deleteTestQueue(t)
+	}
+}
+
+func TestDumpToFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+		full     bool
+	}{
+		{"body only", 3, false},
+		{"full", 3, true},
+		{"empty queue", 0, true},
+	}
+	for _, test := range tests {
+		populateTestQueue(t, test.messages)
+		dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-files")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		*full = test.full
+		err = dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, dir, false)
+		*full = false
+		if err != nil {
+			t.Fatalf("%s: dumpMessagesFromQueue: %s", test.name, err)
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir: %s", err)
+		}
+		expectedFiles := test.messages
+		if test.full {
+			expectedFiles *= 2
+		}
+		if len(files) != expectedFiles {
+			t.Errorf("%s: expected %d files, got %d", test.name, expectedFiles, len(files))
+		}
+		for i := 0; i < test.messages; i++ {
+			verifyFileContent(t, generateFilePath(dir, uint(i)), fmt.Sprintf("message-%d-body", i))
+			if !test.full {
+				continue
+			}
+			headers, properties := getMetadataFromFile(t, generateFilePath(dir, uint(i))+metadataFileSuffix)
+			if headers["my-header"] != fmt.Sprintf("my-value-%d", i) || properties["message_id"] != fmt.Sprintf("msgid-%d", i) {
+				t.Errorf("%s: wrong metadata of message %d: %v, %v", test.name, i, headers, properties)
+			}
+		}
+		if length := getTestQueueLength(t); length != test.messages {
+			t.Errorf("%s: expected the %d messages to stay in the queue, got %d", test.name, test.messages, length)
+		}
+		deleteTestQueue(t)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fetchResult is a return value of a fetchFunc.
+type fetchResult struct {
+	msg amqp091.Delivery
+	ok  bool
+	err error
+}
+
+// mergeFetches runs every fetch in its own goroutine, e.g. one per channel
+// with -channels, and returns a fetchFunc that returns their messages in the
+// order they arrive.  The merged fetch reports no more messages once all of
+// them did, and returns the first error.  With a limit, at most limit
+// messages are fetched in total; messages that were fetched but not returned
+// before stop is called stay un-acked, so they must be fetched with manual
+// acks to be requeued.
+func mergeFetches(fetches []fetchFunc, limit uint) (fetchFunc, func()) {
+	results := make(chan fetchResult)
+	done := make(chan struct{})
+	remaining := int64(limit)
+
+	var wg sync.WaitGroup
+	for _, fetch := range fetches {
+		wg.Add(1)
+		go func(fetch fetchFunc) {
+			defer wg.Done()
+			for {
+				if limit > 0 && atomic.AddInt64(&remaining, -1) < 0 {
+					return
+				}
+				msg, ok, err := fetch()
+				if !ok || err != nil {
+					if err != nil {
+						select {
+						case results <- fetchResult{msg, ok, err}:
+						case <-done:
+						}
+					}
+					return
+				}
+				select {
+				case results <- fetchResult{msg, ok, err}:
+				case <-done:
+					return
+				}
+			}
+		}(fetch)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	return func() (amqp091.Delivery, bool, error) {
+		r, ok := <-results
+		if !ok {
+			return amqp091.Delivery{}, false, nil
+		}
+		if r.err != nil {
+			stop()
+		}
+		return r.msg, r.ok, r.err
+	}, stop
+}
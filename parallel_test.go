@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func testChannelFetches(broker *testBroker, channels int) []fetchFunc {
+	var fetches []fetchFunc
+	for i := 0; i < channels; i++ {
+		fetches = append(fetches, getMessages(broker, testQueueName, false))
+	}
+	return fetches
+}
+
+func TestMergeFetchesLimit(t *testing.T) {
+	broker := newTestBroker(50)
+	fetch, stop := mergeFetches(testChannelFetches(broker, 3), 20)
+	defer stop()
+
+	loop := &dumpLoop{fetch: fetch, writer: &testWriter{}, maxMessages: 20}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 20 {
+		t.Errorf("Expected 20 messages, got %d", received)
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.ready) != 30 {
+		t.Errorf("Expected the channels to fetch exactly 20 messages, %d are left", len(broker.ready))
+	}
+}
+
+func TestMergeFetchesWholeQueue(t *testing.T) {
+	*ack = true
+	defer func() { *ack = false }()
+
+	broker := newTestBroker(50)
+	fetch, stop := mergeFetches(testChannelFetches(broker, 4), 0)
+	defer stop()
+
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: fetch, writer: writer, manualAck: true}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 50 || len(broker.acked) != 50 {
+		t.Errorf("Expected 50 acked messages, got %d and %d acks", received, len(broker.acked))
+	}
+
+	// Every message is dumped exactly once, in any order.
+	bodies := append([]string(nil), writer.bodies...)
+	sort.Strings(bodies)
+	for i := 1; i < len(bodies); i++ {
+		if bodies[i] == bodies[i-1] {
+			t.Errorf("Message dumped twice: %s", bodies[i])
+		}
+	}
+}
+
+func TestMergeFetchesError(t *testing.T) {
+	failing := func() (amqp091.Delivery, bool, error) {
+		return amqp091.Delivery{}, false, errors.New("channel closed")
+	}
+	broker := newTestBroker(1000)
+	fetch, stop := mergeFetches([]fetchFunc{getMessages(broker, testQueueName, false), failing}, 0)
+	defer stop()
+
+	loop := &dumpLoop{fetch: fetch, writer: &testWriter{}}
+	_, err := loop.run()
+	if err == nil || !strings.Contains(err.Error(), "channel closed") {
+		t.Errorf("Expected the error of the failing channel, got %v", err)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	output := run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=0 -output-dir=tmp-test -channels=3")
+	if lines := strings.Count(output, "\n"); lines != 10 {
+		t.Errorf("Expected 10 dumped messages, got: %s", output)
+	}
+}
+
+// BenchmarkMergeFetches compares dumping over one and several channels when
+// every basic.get takes a broker round-trip of about a millisecond.
+func BenchmarkMergeFetches(b *testing.B) {
+	for _, channels := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("channels=%d", channels), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				broker := newTestBroker(100)
+				var fetches []fetchFunc
+				for _, fetch := range testChannelFetches(broker, channels) {
+					fetch := fetch
+					fetches = append(fetches, func() (amqp091.Delivery, bool, error) {
+						time.Sleep(time.Millisecond)
+						return fetch()
+					})
+				}
+				fetch, stop := mergeFetches(fetches, 0)
+				loop := &dumpLoop{fetch: fetch, writer: &testWriter{}}
+				_, err := loop.run()
+				stop()
+				if err != nil {
+					b.Fatalf("run: %s", err)
+				}
+			}
+		})
+	}
+}
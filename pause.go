@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// pauseController holds the fetch loop while an operator has paused the dump.
+// The AMQP connection stays open while paused; the amqp091 library services
+// heartbeats in its own goroutine, so the broker doesn't drop us.
+type pauseController struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newPauseController() *pauseController {
+	p := &pauseController{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pauseController) setPaused(paused bool) {
+	p.mu.Lock()
+	p.paused = paused
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *pauseController) toggle() {
+	p.mu.Lock()
+	p.paused = !p.paused
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// waitWhilePaused blocks until the dump is resumed. It is a no-op on a nil
+// controller, which is used when -pausable isn't set.
+func (p *pauseController) waitWhilePaused(messagesReceived uint) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	noticeLog("Paused after %d messages", messagesReceived)
+	for p.paused {
+		p.cond.Wait()
+	}
+	noticeLog("Resumed after %d messages", messagesReceived)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseController(t *testing.T) {
+	p := newPauseController()
+	p.toggle()
+
+	done := make(chan bool)
+	go func() {
+		p.waitWhilePaused(5)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected waitWhilePaused to block while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.setPaused(false)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected waitWhilePaused to return after resuming")
+	}
+}
+
+func TestNilPauseControllerDoesNotBlock(t *testing.T) {
+	var p *pauseController
+	p.waitWhilePaused(0)
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchPauseSignals toggles the pause state on SIGTSTP (Ctrl-Z) and resumes
+// on SIGCONT, until stop is called at the end of the dump.
+func watchPauseSignals(p *pauseController) (stop func(), err error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTSTP, syscall.SIGCONT)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGCONT {
+				p.setPaused(false)
+			} else {
+				p.toggle()
+			}
+		}
+	}()
+	return func() {
+		// No signal is sent on the channel once signal.Stop returned.
+		signal.Stop(signals)
+		close(signals)
+	}, nil
+}
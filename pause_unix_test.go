@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchPauseSignals(t *testing.T) {
+	p := newPauseController()
+	stop, err := watchPauseSignals(p)
+	if err != nil {
+		t.Fatalf("watchPauseSignals: %s", err)
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGTSTP)
+	for deadline := time.Now().Add(time.Second); !paused(p); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected SIGTSTP to pause the dump")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+}
+
+func TestWatchPauseSignalsStops(t *testing.T) {
+	// The first signal.Notify starts a goroutine of the signal package,
+	// which stays.
+	stop, err := watchPauseSignals(newPauseController())
+	if err != nil {
+		t.Fatalf("watchPauseSignals: %s", err)
+	}
+	stop()
+	time.Sleep(10 * time.Millisecond)
+
+	before := runtime.NumGoroutine()
+	// Like the dumps of -watch or -queue-concurrency.
+	for i := 0; i < 20; i++ {
+		stop, err := watchPauseSignals(newPauseController())
+		if err != nil {
+			t.Fatalf("watchPauseSignals: %s", err)
+		}
+		stop()
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the signal goroutines to end, %d are left", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func paused(p *pauseController) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
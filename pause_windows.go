@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "fmt"
+
+func watchPauseSignals(p *pauseController) (stop func(), err error) {
+	return nil, fmt.Errorf("-pausable is not supported on Windows")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoJSONFileSuffix is appended to the body file name for the JSON form of
+// a protobuf body.
+const protoJSONFileSuffix = "-body.json"
+
+// protoDecoder decodes protobuf message bodies to JSON with the message type
+// of a descriptor set, without generated code.
+type protoDecoder struct {
+	message      protoreflect.MessageDescriptor
+	contentTypes []string
+}
+
+// protoBodies is the decoder of -proto-descriptor, or nil.
+var protoBodies *protoDecoder
+
+// loadProtoDecoder reads the FileDescriptorSet at descriptorPath, as written
+// by protoc --descriptor_set_out --include_imports, and looks up the message
+// type messageName in it. Only bodies with one of the comma-separated
+// contentTypes are decoded.
+func loadProtoDecoder(descriptorPath, messageName, contentTypes string) (*protoDecoder, error) {
+	data, err := ioutil.ReadFile(descriptorPath)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", descriptorPath, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", descriptorPath, err)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("%s: message %q: %s", descriptorPath, messageName, err)
+	}
+	message, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s: %q is not a message type", descriptorPath, messageName)
+	}
+
+	d := &protoDecoder{message: message}
+	for _, contentType := range strings.Split(contentTypes, ",") {
+		if contentType = strings.TrimSpace(contentType); contentType != "" {
+			d.contentTypes = append(d.contentTypes, strings.ToLower(contentType))
+		}
+	}
+	return d, nil
+}
+
+// matches reports whether bodies of contentType are decoded.
+func (d *protoDecoder) matches(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range d.contentTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// decode returns the JSON form of body, with the protobuf JSON mapping.
+func (d *protoDecoder) decode(body []byte) ([]byte, error) {
+	message := dynamicpb.NewMessage(d.message)
+	err := proto.Unmarshal(body, message)
+	if err != nil {
+		return nil, err
+	}
+	data, err := protojson.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	// protojson randomizes its whitespace on purpose, indent it ourselves
+	// so that dumps of the same message are identical.
+	var indented bytes.Buffer
+	err = json.Indent(&indented, data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+// bodyJSON returns the JSON form of the body of msg if it has a matching
+// content type. Bodies that can't be decoded are kept as is with a warning.
+func (d *protoDecoder) bodyJSON(msg amqp091.Delivery) ([]byte, bool) {
+	if d == nil || !d.matches(msg.ContentType) {
+		return nil, false
+	}
+	data, err := d.decode(msg.Body)
+	if err != nil {
+		warningLog("WARNING: message_id %q: can't decode the body as %s, keeping it raw: %s", msg.MessageId, d.message.FullName(), err)
+		return nil, false
+	}
+	return data, true
+}
+
+// replaceProtoBody replaces a protobuf body of msg by its JSON form, for
+// -proto-replace.
+func (d *protoDecoder) replaceProtoBody(msg amqp091.Delivery) amqp091.Delivery {
+	if data, ok := d.bodyJSON(msg); ok {
+		msg.Body = data
+		msg.ContentType = "application/json"
+	}
+	return msg
+}
+
+// saveProtoJSONToFile writes the JSON form of a protobuf body next to the
+// body file.
+func saveProtoJSONToFile(msg amqp091.Delivery, bodyPath string) error {
+	data, ok := protoBodies.bodyJSON(msg)
+	if !ok {
+		return nil
+	}
+
+	filePath := bodyPath + protoJSONFileSuffix
+	err := writeFile(filePath, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(filePath)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testProtoFile is the descriptor protoc compiles from:
+//
+//	syntax = "proto3";
+//	package orders.v1;
+//	message OrderCreated {
+//	  string order_id = 1;
+//	  int64 amount_cents = 2;
+//	  repeated string items = 3;
+//	}
+var testProtoFile = &descriptorpb.FileDescriptorProto{
+	Name:    proto.String("orders.proto"),
+	Package: proto.String("orders.v1"),
+	Syntax:  proto.String("proto3"),
+	MessageType: []*descriptorpb.DescriptorProto{{
+		Name: proto.String("OrderCreated"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			{Name: proto.String("order_id"), JsonName: proto.String("orderId"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			{Name: proto.String("amount_cents"), JsonName: proto.String("amountCents"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			{Name: proto.String("items"), JsonName: proto.String("items"), Number: proto.Int32(3), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()},
+		},
+	}},
+}
+
+// writeTestProtoDescriptor writes the FileDescriptorSet of testProtoFile
+// and returns a sample OrderCreated message.
+func writeTestProtoDescriptor(t *testing.T, descriptorPath string) []byte {
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testProtoFile}})
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	err = ioutil.WriteFile(descriptorPath, data, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	file, err := protodesc.NewFile(testProtoFile, nil)
+	if err != nil {
+		t.Fatalf("NewFile: %s", err)
+	}
+	descriptor := file.Messages().ByName("OrderCreated")
+	message := dynamicpb.NewMessage(descriptor)
+	message.Set(descriptor.Fields().ByName("order_id"), protoreflect.ValueOf("A-1001"))
+	message.Set(descriptor.Fields().ByName("amount_cents"), protoreflect.ValueOf(int64(4250)))
+	items := message.Mutable(descriptor.Fields().ByName("items")).List()
+	items.Append(protoreflect.ValueOf("book"))
+	items.Append(protoreflect.ValueOf("pen"))
+	body, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	return body
+}
+
+func TestProtoDecoder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-proto")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	descriptorPath := path.Join(dir, "orders.pb")
+	body := writeTestProtoDescriptor(t, descriptorPath)
+
+	_, err = loadProtoDecoder(descriptorPath, "orders.v1.Missing", "application/x-protobuf")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown message type")
+	}
+	d, err := loadProtoDecoder(descriptorPath, "orders.v1.OrderCreated", "application/x-protobuf, application/protobuf")
+	if err != nil {
+		t.Fatalf("loadProtoDecoder: %s", err)
+	}
+
+	msg := amqp091.Delivery{ContentType: "application/protobuf; proto=orders.v1.OrderCreated", Body: body}
+	data, ok := d.bodyJSON(msg)
+	expected := "{\n  \"orderId\": \"A-1001\",\n  \"amountCents\": \"4250\",\n  \"items\": [\n    \"book\",\n    \"pen\"\n  ]\n}\n"
+	if !ok || string(data) != expected {
+		t.Errorf("Wrong JSON: expected %q but got %q (%v)", expected, data, ok)
+	}
+
+	replaced := d.replaceProtoBody(msg)
+	if string(replaced.Body) != expected || replaced.ContentType != "application/json" {
+		t.Errorf("Wrong replaced message: %#v", replaced)
+	}
+
+	// Other content types and undecodable bodies are kept as is.
+	if _, ok := d.bodyJSON(amqp091.Delivery{ContentType: "application/json", Body: body}); ok {
+		t.Errorf("Expected only the listed content types to be decoded")
+	}
+	corrupt := amqp091.Delivery{ContentType: "application/x-protobuf", Body: []byte{0x0a, 0xff}}
+	if _, ok := d.bodyJSON(corrupt); ok {
+		t.Errorf("Expected a corrupt body not to be decoded")
+	}
+	if kept := d.replaceProtoBody(corrupt); string(kept.Body) != string(corrupt.Body) || kept.ContentType != corrupt.ContentType {
+		t.Errorf("Expected a corrupt body to be kept raw: %#v", kept)
+	}
+
+	protoBodies = d
+	defer func() { protoBodies = nil }()
+	bodyPath := generateFilePath(dir, 0)
+	err = saveMessageFiles(msg, bodyPath, 0)
+	if err != nil {
+		t.Fatalf("saveMessageFiles: %s", err)
+	}
+	verifyFileContent(t, bodyPath, string(body))
+	verifyFileContent(t, bodyPath+protoJSONFileSuffix, expected)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readQueueNames reads newline-delimited queue names.  Blank lines and lines
+// starting with # are ignored.
+func readQueueNames(r io.Reader) ([]string, error) {
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+// readQueuesFile reads the queue names of -queues-file; "-" reads them from
+// stdin.
+func readQueuesFile(filename string) ([]string, error) {
+	if filename == "-" {
+		return readQueueNames(os.Stdin)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readQueueNames(f)
+}
+
+// queueOutputDir is the output directory of one queue of a multi-queue dump.
+// When outputDir already has a {{.Queue}} placeholder it is used as is.
+func queueOutputDir(outputDir string, queueName string) string {
+	if strings.Contains(outputDir, ".Queue") {
+		return outputDir
+	}
+	return path.Join(outputDir, queueDirName(queueName))
+}
+
+// queueDirName is the sanitized queue name used as directory name, with a
+// warning when it differs from the queue name, so that the dump can still be
+// found.
+func queueDirName(queueName string) string {
+	name := sanitizeFilename(queueName)
+	if name != queueName {
+		warningLog("Queue name %q isn't a safe directory name, using %q", queueName, name)
+	}
+	return name
+}
+
+// dumpQueuesFromFile dumps every queue listed in filename to its own
+// subdirectory of outputDir, up to -queue-concurrency of them at a time.  A
+// failed queue doesn't stop the others; the failures are reported at the
+// end.
+func dumpQueuesFromFile(amqpURI string, filename string, maxMessages uint, outputDir string, db bool) error {
+	if *queue != "" {
+		return fmt.Errorf("-queue and -queues-file can't be combined")
+	}
+	if *queueConcurrency == 0 {
+		return fmt.Errorf("-queue-concurrency must be at least 1")
+	}
+	if *queueConcurrency > 1 && (*sequence || *protoDescriptor != "") {
+		return fmt.Errorf("-queue-concurrency can't be combined with -sequence or -proto-descriptor")
+	}
+	queueNames, err := readQueuesFile(filename)
+	if err != nil {
+		return fmt.Errorf("Queues file: %s", err)
+	}
+	// Parsed before the dumps start, which only read it.
+	filenameTemplate, err = parseFilenameTemplate()
+	if err != nil {
+		return err
+	}
+	if len(queueNames) == 0 {
+		return fmt.Errorf("Queues file: no queue names in %s", filename)
+	}
+
+	started := time.Now()
+	results := dumpQueues(queueNames, *queueConcurrency, func(queueName string) (*dumpSummary, error) {
+		return dumpQueue(amqpURI, queueName, maxMessages, queueOutputDir(outputDir, queueName), db)
+	})
+	var failures []string
+	for _, result := range results {
+		if result.err != nil {
+			failures = append(failures, result.queue)
+		}
+	}
+	noticeLog("Dumped %d of %d queues", len(queueNames)-len(failures), len(queueNames))
+	if *withSummary {
+		writeQueuesSummary(os.Stderr, results, outputDir, started, time.Now())
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to dump %d queues: %s", len(failures), strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// queueResult is the outcome of the dump of one of the queues of
+// -queues-file: its -summary statistics, if the messages were dumped, and
+// its error.
+type queueResult struct {
+	queue   string
+	summary *dumpSummary
+	err     error
+}
+
+// dumpQueues calls dump for every queue, running at most concurrency of them
+// at the same time, and returns their results in the order of queueNames.
+// Each failure is logged as soon as it happens.
+func dumpQueues(queueNames []string, concurrency uint, dump func(queueName string) (*dumpSummary, error)) []queueResult {
+	results := make([]queueResult, len(queueNames))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, queueName := range queueNames {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, queueName string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			verboseLog(fmt.Sprintf("Dumping queue %q", queueName))
+			summary, err := dump(queueName)
+			if err != nil {
+				warningLog("Queue %q: %s", queueName, err)
+			}
+			results[i] = queueResult{queue: queueName, summary: summary, err: err}
+		}(i, queueName)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadQueueNames(t *testing.T) {
+	input := "# incoming queues\nincoming_1\n  incoming_2  \n\n#incoming_3\nevents/eu.west\n"
+	names, err := readQueueNames(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readQueueNames: %s", err)
+	}
+	expected := []string{"incoming_1", "incoming_2", "events/eu.west"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Wrong queue names: expected %q, got %q", expected, names)
+	}
+}
+
+func TestQueueOutputDir(t *testing.T) {
+	tests := []struct {
+		outputDir string
+		queueName string
+		expected  string
+	}{
+		{"/tmp/dump", "incoming_1", "/tmp/dump/incoming_1"},
+		{"/tmp/dump", "events/eu.west", "/tmp/dump/events_eu.west"},
+		{"/tmp/dump", "..", "/tmp/dump/_."},
+		{"/tmp/dump", "commandes.créées", "/tmp/dump/commandes.créées"},
+		{"/tmp/dump", "注文/作成", "/tmp/dump/注文_作成"},
+		{"/tmp/dump", "latin1-\xe9t\xe9", "/tmp/dump/latin1-_t_"},
+		{"/tmp/{{.Queue}}", "incoming_1", "/tmp/{{.Queue}}"},
+	}
+	for _, test := range tests {
+		if dir := queueOutputDir(test.outputDir, test.queueName); dir != test.expected {
+			t.Errorf("queueOutputDir(%q, %q): expected %q, got %q", test.outputDir, test.queueName, test.expected, dir)
+		}
+	}
+}
+
+func TestDumpQueuesConcurrency(t *testing.T) {
+	queueNames := []string{"q1", "q2", "q3", "q4", "q5", "q6", "q7"}
+	for _, concurrency := range []uint{1, 3} {
+		var mu sync.Mutex
+		running, maxRunning := 0, 0
+		var dumped []string
+		results := dumpQueues(queueNames, concurrency, func(queueName string) (*dumpSummary, error) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			dumped = append(dumped, queueName)
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if queueName == "q2" || queueName == "q6" {
+				return nil, fmt.Errorf("queue not found")
+			}
+			return nil, nil
+		})
+		var failures []string
+		for i, result := range results {
+			if result.queue != queueNames[i] {
+				t.Errorf("Concurrency %d: expected result %d for %q, got %q", concurrency, i, queueNames[i], result.queue)
+			}
+			if result.err != nil {
+				failures = append(failures, result.queue)
+			}
+		}
+
+		if maxRunning != int(concurrency) {
+			t.Errorf("Concurrency %d: expected %d queues dumped at the same time, got %d", concurrency, concurrency, maxRunning)
+		}
+		if len(dumped) != len(queueNames) {
+			t.Errorf("Concurrency %d: expected every queue to be dumped, got %q", concurrency, dumped)
+		}
+		if expected := []string{"q2", "q6"}; !reflect.DeepEqual(failures, expected) {
+			t.Errorf("Concurrency %d: expected failures %q, got %q", concurrency, expected, failures)
+		}
+	}
+}
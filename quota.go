@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// routingKeyQuota is the -max-per-routing-key filter: it matches the first
+// max messages of every routing key and skips the later ones, which are
+// handled like the other unmatched messages.
+type routingKeyQuota struct {
+	max     uint
+	dumped  map[string]uint
+	skipped map[string]uint
+}
+
+func newRoutingKeyQuota(max uint) *routingKeyQuota {
+	return &routingKeyQuota{
+		max:     max,
+		dumped:  make(map[string]uint),
+		skipped: make(map[string]uint),
+	}
+}
+
+// matches is a messageFilter.  Added after the other filters, it only counts
+// the messages they matched.
+func (q *routingKeyQuota) matches(msg amqp091.Delivery) bool {
+	if q.dumped[msg.RoutingKey] >= q.max {
+		q.skipped[msg.RoutingKey]++
+		return false
+	}
+	q.dumped[msg.RoutingKey]++
+	return true
+}
+
+// String reports the messages dumped and skipped per routing key, sorted by
+// routing key.
+func (q *routingKeyQuota) String() string {
+	keys := make([]string, 0, len(q.dumped))
+	for key := range q.dumped {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Messages per routing key (at most %d):\n", q.max)
+	for _, key := range keys {
+		name := key
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(&b, "  %6d  %s", q.dumped[key], name)
+		if q.skipped[key] > 0 {
+			fmt.Fprintf(&b, " (%d skipped)", q.skipped[key])
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRoutingKeyQuota(t *testing.T) {
+	broker := newTestBroker(10)
+	routingKeys := []string{"orders.created", "orders.paid", "orders.created", "orders.created", "", "orders.paid", "orders.created", "orders.shipped", "", ""}
+	for i, key := range routingKeys {
+		broker.ready[i].RoutingKey = key
+	}
+
+	quota := newRoutingKeyQuota(2)
+	writer := &testWriter{}
+	loop := &dumpLoop{
+		fetch:     getMessages(broker, testQueueName, false),
+		writer:    writer,
+		filters:   []messageFilter{quota.matches},
+		manualAck: true,
+	}
+	messagesReceived, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if messagesReceived != 7 {
+		t.Errorf("Expected 7 messages dumped, got %d", messagesReceived)
+	}
+	var ids []string
+	for _, msg := range writer.messages {
+		ids = append(ids, msg.MessageId)
+	}
+	if fmt.Sprint(ids) != "[msgid-0 msgid-1 msgid-2 msgid-4 msgid-5 msgid-7 msgid-8]" {
+		t.Errorf("Wrong messages dumped: %v", ids)
+	}
+	if len(broker.acked) != 0 {
+		t.Errorf("Expected the skipped messages to be left for requeuing, got acks %v", broker.acked)
+	}
+
+	expected := "Messages per routing key (at most 2):\n" +
+		"       2  (none) (1 skipped)\n" +
+		"       2  orders.created (2 skipped)\n" +
+		"       2  orders.paid\n" +
+		"       1  orders.shipped\n"
+	if quota.String() != expected {
+		t.Errorf("Wrong report: expected\n%s\ngot\n%s", expected, quota.String())
+	}
+}
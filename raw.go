@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// rawDeliveryFileSuffix is appended to the body file name for the
+// -raw-properties file.
+const rawDeliveryFileSuffix = "-delivery.json"
+
+// rawDelivery is the JSON form of a complete amqp091.Delivery written by
+// -raw-properties.  The shallower Body field hides the body of the embedded
+// delivery, which is saved in its own file.
+type rawDelivery struct {
+	amqp091.Delivery
+	Body *struct{} `json:",omitempty"`
+}
+
+// rawDeliveryJSON encodes every field of msg except the body, with the Go
+// field names of amqp091.Delivery.  The Acknowledger is always null.
+func rawDeliveryJSON(msg amqp091.Delivery) ([]byte, error) {
+	msg.Acknowledger = nil
+	return json.MarshalIndent(rawDelivery{Delivery: msg}, "", "  ")
+}
+
+func saveRawDeliveryToFile(msg amqp091.Delivery, bodyPath string) error {
+	data, err := rawDeliveryJSON(msg)
+	if err != nil {
+		return err
+	}
+
+	filePath := bodyPath + rawDeliveryFileSuffix
+	err = writeFile(filePath, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(filePath)
+
+	return nil
+}
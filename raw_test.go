@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestRawDeliveryJSON(t *testing.T) {
+	msg := amqp091.Delivery{
+		Acknowledger:    &testRequeueQueue{},
+		Headers:         amqp091.Table{"my-header": "my-value"},
+		ContentType:     "text/plain",
+		ContentEncoding: "gzip",
+		DeliveryMode:    2,
+		Priority:        4,
+		CorrelationId:   "corr-1",
+		ReplyTo:         "replies",
+		Expiration:      "60000",
+		MessageId:       "msgid-1",
+		Timestamp:       time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC),
+		Type:            "order.created",
+		UserId:          "guest",
+		AppId:           "shop",
+		ConsumerTag:     "ctag-1",
+		MessageCount:    7,
+		DeliveryTag:     42,
+		Redelivered:     true,
+		Exchange:        "orders",
+		RoutingKey:      "orders.eu",
+		Body:            []byte("message-body"),
+	}
+
+	data, err := rawDeliveryJSON(msg)
+	if err != nil {
+		t.Fatalf("rawDeliveryJSON: %s", err)
+	}
+	var decoded map[string]interface{}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+
+	var roundTrip amqp091.Delivery
+	err = json.Unmarshal(data, &roundTrip)
+	if err != nil {
+		t.Fatalf("Unmarshal delivery: %s", err)
+	}
+
+	deliveryType := reflect.TypeOf(msg)
+	for i := 0; i < deliveryType.NumField(); i++ {
+		field := deliveryType.Field(i)
+		value, ok := decoded[field.Name]
+		switch field.Name {
+		case "Body":
+			if ok {
+				t.Errorf("Body should not be in the raw delivery")
+			}
+			continue
+		case "Acknowledger":
+			if !ok || value != nil {
+				t.Errorf("Acknowledger should be null, got %#v", value)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("Missing field %s", field.Name)
+			continue
+		}
+		expected := reflect.ValueOf(msg).Field(i).Interface()
+		got := reflect.ValueOf(roundTrip).Field(i).Interface()
+		if field.Name == "Headers" {
+			got = amqp091.Table(decoded["Headers"].(map[string]interface{}))
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Wrong %s: expected %#v, got %#v", field.Name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// maxChannelReopens is the number of times in a row the channel is reopened
+// without receiving a message before the error is returned.
+const maxChannelReopens = 3
+
+// channelCloseWait is how long to wait for the close notification of the
+// channel after a fetch failed.
+const channelCloseWait = time.Second
+
+// reopenFunc opens a new channel and returns a fetchFunc on it along with
+// the channel's close notifications.
+type reopenFunc func() (fetchFunc, <-chan *amqp091.Error, error)
+
+// reopenOnChannelError wraps fetch so that when the broker closes the channel
+// with a recoverable (channel-level) error, a new channel is opened with
+// reopen and fetching continues.  Connection errors, and channels closed by
+// the client, are returned as is.
+func reopenOnChannelError(closed <-chan *amqp091.Error, fetch fetchFunc, reopen reopenFunc) fetchFunc {
+	reopens := 0
+	return func() (amqp091.Delivery, bool, error) {
+		for {
+			msg, ok, err := fetch()
+			if err == nil {
+				reopens = 0
+				return msg, ok, nil
+			}
+
+			var closeErr *amqp091.Error
+			select {
+			case closeErr = <-closed:
+			case <-time.After(channelCloseWait):
+			}
+			if closeErr == nil || !closeErr.Recover || reopens >= maxChannelReopens {
+				return msg, ok, err
+			}
+
+			reopens++
+			warningLog("Channel closed by the broker (%s), reopening", closeErr)
+			fetch, closed, err = reopen()
+			if err != nil {
+				return amqp091.Delivery{}, false, fmt.Errorf("Reopen channel: %s", err)
+			}
+		}
+	}
+}
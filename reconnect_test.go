@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// testChannel is a fetchFunc source that fails with a close error after
+// returning its messages.
+type testChannel struct {
+	messages []amqp091.Delivery
+	closeErr *amqp091.Error
+	closed   chan *amqp091.Error
+}
+
+func newTestChannel(closeErr *amqp091.Error, bodies ...string) *testChannel {
+	c := &testChannel{closeErr: closeErr, closed: make(chan *amqp091.Error, 1)}
+	for _, body := range bodies {
+		c.messages = append(c.messages, amqp091.Delivery{Body: []byte(body)})
+	}
+	return c
+}
+
+func (c *testChannel) fetch() (amqp091.Delivery, bool, error) {
+	if len(c.messages) > 0 {
+		msg := c.messages[0]
+		c.messages = c.messages[1:]
+		return msg, true, nil
+	}
+	if c.closeErr == nil {
+		return amqp091.Delivery{}, false, nil
+	}
+	c.closed <- c.closeErr
+	return amqp091.Delivery{}, false, c.closeErr
+}
+
+func fetchAll(fetch fetchFunc) ([]string, error) {
+	var bodies []string
+	for {
+		msg, ok, err := fetch()
+		if err != nil || !ok {
+			return bodies, err
+		}
+		bodies = append(bodies, string(msg.Body))
+	}
+}
+
+func TestReopenOnChannelError(t *testing.T) {
+	channelErr := &amqp091.Error{Code: amqp091.PreconditionFailed, Reason: "PRECONDITION_FAILED", Recover: true}
+	first := newTestChannel(channelErr, "a", "b")
+	second := newTestChannel(nil, "c")
+	reopened := 0
+	fetch := reopenOnChannelError(first.closed, first.fetch, func() (fetchFunc, <-chan *amqp091.Error, error) {
+		reopened++
+		return second.fetch, second.closed, nil
+	})
+
+	bodies, err := fetchAll(fetch)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if fmt.Sprint(bodies) != "[a b c]" || reopened != 1 {
+		t.Errorf("Wrong messages after reopening %d times: %v", reopened, bodies)
+	}
+}
+
+func TestReopenOnChannelErrorFatal(t *testing.T) {
+	connErr := &amqp091.Error{Code: amqp091.ConnectionForced, Reason: "CONNECTION_FORCED", Recover: false}
+	first := newTestChannel(connErr, "a")
+	fetch := reopenOnChannelError(first.closed, first.fetch, func() (fetchFunc, <-chan *amqp091.Error, error) {
+		t.Fatalf("Channel reopened after a connection error")
+		return nil, nil, nil
+	})
+
+	bodies, err := fetchAll(fetch)
+	if err != connErr || fmt.Sprint(bodies) != "[a]" {
+		t.Errorf("Expected the connection error after one message, got %v (%v)", bodies, err)
+	}
+}
+
+func TestReopenOnChannelErrorGivesUp(t *testing.T) {
+	channelErr := &amqp091.Error{Code: amqp091.NotFound, Reason: "NOT_FOUND", Recover: true}
+	first := newTestChannel(channelErr)
+	reopened := 0
+	fetch := reopenOnChannelError(first.closed, first.fetch, func() (fetchFunc, <-chan *amqp091.Error, error) {
+		reopened++
+		c := newTestChannel(channelErr)
+		return c.fetch, c.closed, nil
+	})
+
+	_, err := fetchAll(fetch)
+	if err != channelErr || reopened != maxChannelReopens {
+		t.Errorf("Expected to give up after %d reopens, reopened %d times (%v)", maxChannelReopens, reopened, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// manifestMessage describes one message file of a dump in a manifest
+// regenerated by -repair-manifest.
+type manifestMessage struct {
+	Counter   uint   `json:"counter"`
+	File      string `json:"file"`
+	Bytes     int    `json:"bytes"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// repairManifest rebuilds the manifest.json of a files dump in outputDir
+// from the message and headers+properties files found there, e.g. after the
+// dump was interrupted before the manifest was written. The queue name and
+// timestamps are kept from the previous manifest when it can still be read.
+func repairManifest(outputDir string) error {
+	messages, orphans, err := findDumpedMessages(outputDir)
+	if err != nil {
+		return fmt.Errorf("Repair manifest: %s", err)
+	}
+
+	m, err := readManifest(outputDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warningLog("%s: %s, writing a new one", path.Join(outputDir, manifestFileName), err)
+		}
+		m = &dumpManifest{Output: "files"}
+	}
+	m.MessagesDumped = 0
+	m.Partitions = nil
+	m.Messages = nil
+	m.bytes = 0
+
+	for _, orphan := range orphans {
+		warningLog("%s: no matching message body file, ignored", orphan)
+	}
+
+	for i := range messages {
+		msg := &messages[i]
+		err = loadDumpedMessage(msg)
+		if msg.Publishing.Body == nil && err != nil {
+			warningLog("%s: %s, ignored", msg.BodyPath, err)
+			continue
+		}
+		if err != nil {
+			// The body is still part of the dump.
+			warningLog("%s: %s, message id unknown", msg.BodyPath, err)
+		} else if msg.MetadataPath == "" {
+			verboseLog(fmt.Sprintf("%s: no headers+properties file", msg.BodyPath))
+		}
+
+		file := strings.TrimPrefix(msg.BodyPath, path.Clean(outputDir)+"/")
+		m.Messages = append(m.Messages, manifestMessage{
+			Counter:   msg.Counter,
+			File:      file,
+			Bytes:     len(msg.Publishing.Body),
+			MessageID: msg.Publishing.MessageId,
+		})
+		m.MessagesDumped++
+		m.bytes += uint64(len(msg.Publishing.Body))
+		m.addToPartition(path.Dir(file), msg.Counter)
+	}
+
+	repairedAt := time.Now().UTC()
+	m.RepairedAt = &repairedAt
+	m.BytesDumped = m.bytes
+	if m.FinishedAt.IsZero() {
+		m.FinishedAt = repairedAt
+	}
+
+	verboseLog(fmt.Sprintf("Found %d messages (%d bytes)", m.MessagesDumped, m.bytes))
+	if int(m.MessagesDumped) < m.MessagesAvailable {
+		warningLog("WARNING: found %d of the %d messages available in queue %q",
+			m.MessagesDumped, m.MessagesAvailable, m.Queue)
+	}
+	return writeManifest(outputDir, m)
+}
+
+// addToPartition extends the -split-every partition of dir with counter.
+// Messages directly in the output directory have no partition.
+func (m *dumpManifest) addToPartition(dir string, counter uint) {
+	if dir == "." {
+		return
+	}
+	for i := range m.Partitions {
+		p := &m.Partitions[i]
+		if p.Dir == dir {
+			if counter < p.FirstMessage {
+				p.FirstMessage = counter
+			}
+			if counter > p.LastMessage {
+				p.LastMessage = counter
+			}
+			return
+		}
+	}
+	m.Partitions = append(m.Partitions, manifestPartition{
+		Dir:          dir,
+		FirstMessage: counter,
+		LastMessage:  counter,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestRepairManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-repair")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A -split-every=2 dump interrupted before the manifest was written:
+	// msg-0001 has no headers+properties file and msg-0003 has a corrupted
+	// one.
+	*splitEvery = 2
+	defer func() { *splitEvery = 0 }()
+	for i := 0; i < 4; i++ {
+		filePath := generateFilePath(dir, uint(i))
+		err = os.MkdirAll(path.Dir(filePath), 0775)
+		if err != nil {
+			t.Fatalf("MkdirAll: %s", err)
+		}
+		publishing := makeAmqpMessage(i)
+		err = ioutil.WriteFile(filePath, publishing.Body, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		switch i {
+		case 1:
+		case 3:
+			err = ioutil.WriteFile(filePath+metadataFileSuffix, []byte(`{"properties": {`), 0644)
+		default:
+			err = savePropsAndHeadersToFile(amqp091.Delivery{MessageId: publishing.MessageId}, filePath, uint(i))
+		}
+		if err != nil {
+			t.Fatalf("Writing the headers+properties file: %s", err)
+		}
+	}
+	err = ioutil.WriteFile(path.Join(dir, "msg-0009"+metadataFileSuffix), []byte(`{}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	err = repairManifest(dir)
+	if err != nil {
+		t.Fatalf("repairManifest: %s", err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+
+	if m.Output != "files" || m.MessagesDumped != 4 || m.BytesDumped != 56 || m.RepairedAt == nil {
+		t.Errorf("Wrong manifest: %#v", m)
+	}
+	expectedMessages := []manifestMessage{
+		{Counter: 0, File: "part-0001/msg-0000", Bytes: 14, MessageID: "msgid-0"},
+		{Counter: 1, File: "part-0001/msg-0001", Bytes: 14},
+		{Counter: 2, File: "part-0002/msg-0002", Bytes: 14, MessageID: "msgid-2"},
+		{Counter: 3, File: "part-0002/msg-0003", Bytes: 14},
+	}
+	if !reflect.DeepEqual(m.Messages, expectedMessages) {
+		t.Errorf("Wrong messages: expected %#v but got %#v", expectedMessages, m.Messages)
+	}
+	expectedPartitions := []manifestPartition{
+		{Dir: "part-0001", FirstMessage: 0, LastMessage: 1},
+		{Dir: "part-0002", FirstMessage: 2, LastMessage: 3},
+	}
+	if !reflect.DeepEqual(m.Partitions, expectedPartitions) {
+		t.Errorf("Wrong partitions: expected %#v but got %#v", expectedPartitions, m.Partitions)
+	}
+}
+
+func TestRepairManifestKeepsQueue(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := writeManifest(dir, &dumpManifest{Queue: "incoming_1", Output: "files", MessagesAvailable: 10, MessagesDumped: 1})
+	if err != nil {
+		t.Fatalf("writeManifest: %s", err)
+	}
+	err = repairManifest(dir)
+	if err != nil {
+		t.Fatalf("repairManifest: %s", err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest: %s", err)
+	}
+	if m.Queue != "incoming_1" || m.MessagesAvailable != 10 || m.MessagesDumped != 3 || len(m.Partitions) != 0 {
+		t.Errorf("Wrong manifest: %#v", m)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// replayThrottle spaces out the publishes of a restore, either to a steady
+// rate (-replay-rate) or with a fixed delay between messages (-replay-delay).
+// A nil throttle doesn't wait.
+type replayThrottle struct {
+	clock    watchClock
+	interval time.Duration
+	fixed    bool
+	next     time.Time
+}
+
+func newReplayThrottle(rate float64, delay time.Duration) (*replayThrottle, error) {
+	if rate < 0 || delay < 0 {
+		return nil, fmt.Errorf("-replay-rate and -replay-delay must not be negative")
+	}
+	if rate > 0 && delay > 0 {
+		return nil, fmt.Errorf("-replay-rate and -replay-delay are mutually exclusive")
+	}
+	if rate > 0 {
+		return &replayThrottle{clock: realClock{}, interval: time.Duration(float64(time.Second) / rate)}, nil
+	}
+	if delay > 0 {
+		return &replayThrottle{clock: realClock{}, interval: delay, fixed: true}, nil
+	}
+	return nil, nil
+}
+
+// wait blocks until the next message may be published.  With a rate, the
+// publishes are scheduled at regular intervals from the first one, so slow
+// publishes don't lower the rate; a publish that is late is sent immediately
+// but doesn't cause a burst to catch up.
+func (t *replayThrottle) wait() {
+	if t == nil {
+		return
+	}
+	now := t.clock.Now()
+	if t.next.IsZero() {
+		t.next = now
+	}
+	if t.next.After(now) {
+		<-t.clock.After(t.next.Sub(now))
+		now = t.next
+	}
+	if t.fixed {
+		t.next = t.clock.Now().Add(t.interval)
+	} else if now.Sub(t.next) > t.interval {
+		t.next = now.Add(t.interval)
+	} else {
+		t.next = t.next.Add(t.interval)
+	}
+}
+
+// replayTiming reproduces the gaps between the messages of a dump when
+// restoring it, for -replay-timing=preserve: each message is published when
+// as much time has passed since the first publish as between the first
+// message and this one, divided by -replay-speed.  The gaps are taken from
+// the received_at property that -received-at records, or else from the
+// timestamp property, which only has a resolution of one second.  Messages
+// with neither are published without waiting.  A nil replayTiming doesn't
+// wait.
+type replayTiming struct {
+	clock      watchClock
+	speed      float64
+	start      time.Time
+	first      time.Time
+	warnedNoTS bool
+}
+
+func newReplayTiming(mode string, speed float64) (*replayTiming, error) {
+	switch mode {
+	case "none":
+		if speed != 1 {
+			return nil, fmt.Errorf("-replay-speed requires -replay-timing=preserve")
+		}
+		return nil, nil
+	case "preserve":
+		if speed <= 0 {
+			return nil, fmt.Errorf("-replay-speed must be positive")
+		}
+		return &replayTiming{clock: realClock{}, speed: speed}, nil
+	}
+	return nil, fmt.Errorf("Unknown replay timing %q, expected none or preserve", mode)
+}
+
+// replayTime is the time of msg that -replay-timing=preserve replays from.
+func replayTime(msg *dumpedMessage) time.Time {
+	if !msg.ReceivedAt.IsZero() {
+		return msg.ReceivedAt
+	}
+	return msg.Publishing.Timestamp
+}
+
+// wait blocks until the message with the given replayTime is due.  Like
+// -replay-rate, the publishes are scheduled from the first one, so slow
+// publishes don't accumulate; a message that is already late, or older than
+// the first one, is published immediately.
+func (r *replayTiming) wait(timestamp time.Time) {
+	if r == nil {
+		return
+	}
+	if timestamp.IsZero() {
+		if !r.warnedNoTS {
+			warningLog("Some messages have neither a received_at nor a timestamp property, e.g. because the dump was taken without -full; they are published without delay")
+			r.warnedNoTS = true
+		}
+		return
+	}
+	if r.start.IsZero() {
+		r.start = r.clock.Now()
+		r.first = timestamp
+		return
+	}
+	due := r.start.Add(time.Duration(float64(timestamp.Sub(r.first)) / r.speed))
+	if wait := due.Sub(r.clock.Now()); wait > 0 {
+		<-r.clock.After(wait)
+	}
+}
+
+// restoreTarget publishes the messages of a restore.
+type restoreTarget interface {
+	publish(msg *dumpedMessage) error
+	Close() error
+}
+
+// amqpTarget publishes to a queue through the default exchange, or to
+// -restore-exchange and -restore-routing-key.  Publisher confirms are used
+// so that the tool only exits successfully once the broker has taken
+// responsibility for every message.  Messages to an overridden destination
+// are published as mandatory, so that a message no queue is bound for fails
+// the restore instead of being dropped.
+type amqpTarget struct {
+	conn       *amqp091.Connection
+	channel    *amqp091.Channel
+	confirms   chan amqp091.Confirmation
+	returns    chan amqp091.Return
+	exchange   string
+	routingKey string
+	mandatory  bool
+}
+
+// restoreDestination returns the exchange and routing key to publish the
+// restored messages to, ignoring the ones they were dumped with: by default
+// the default exchange and the queue name, which routes them straight to the
+// queue.
+func restoreDestination(queueName string) (exchange string, routingKey string) {
+	routingKey = queueName
+	if *restoreRouting != "" {
+		routingKey = *restoreRouting
+	}
+	return *restoreExchange, routingKey
+}
+
+func openAmqpTarget(amqpURI, queueName string) (*amqpTarget, error) {
+	if queueName == "" && *restoreExchange == "" {
+		return nil, fmt.Errorf("Must supply queue name")
+	}
+
+	conn, err := dial(amqpURI)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %s", err)
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Confirm: %s", err)
+	}
+	confirms := channel.NotifyPublish(make(chan amqp091.Confirmation, 1))
+	// The broker returns an unroutable message before confirming it.
+	returns := channel.NotifyReturn(make(chan amqp091.Return, 1))
+
+	exchange, routingKey := restoreDestination(queueName)
+	return &amqpTarget{
+		conn:       conn,
+		channel:    channel,
+		confirms:   confirms,
+		returns:    returns,
+		exchange:   exchange,
+		routingKey: routingKey,
+		mandatory:  *restoreExchange != "" || *restoreRouting != "",
+	}, nil
+}
+
+func (t *amqpTarget) publish(msg *dumpedMessage) error {
+	err := t.channel.Publish(t.exchange, t.routingKey, t.mandatory, false, msg.Publishing)
+	if err != nil {
+		return err
+	}
+	confirm, ok := <-t.confirms
+	if !ok {
+		return fmt.Errorf("channel closed")
+	}
+	if !confirm.Ack {
+		return fmt.Errorf("rejected by the broker")
+	}
+	select {
+	case returned := <-t.returns:
+		return fmt.Errorf("unroutable to exchange %q with routing key %q: %s", t.exchange, t.routingKey, returned.ReplyText)
+	default:
+	}
+	return nil
+}
+
+func (t *amqpTarget) Close() error {
+	return t.conn.Close()
+}
+
+// destinationChecker is the part of *amqp091.Channel used to check the
+// destination of a dry run, which tests replace with a fake broker.
+type destinationChecker interface {
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error)
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp091.Table) error
+}
+
+// checkDestination checks that the destination of a restore exists, with a
+// passive declare that doesn't create it: the exchange, or the queue the
+// default exchange routes the routing key to.  Whether a queue is bound for
+// the routing key of another exchange is only known when publishing.
+func checkDestination(channel destinationChecker, exchange, routingKey string) error {
+	if exchange != "" {
+		err := channel.ExchangeDeclarePassive(exchange, "direct", false, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("exchange %q: %s", exchange, err)
+		}
+		return nil
+	}
+	_, err := channel.QueueDeclarePassive(routingKey, false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("queue %q: %s", routingKey, err)
+	}
+	return nil
+}
+
+// dryRunTarget is the restoreTarget of -restore-dry-run: it checks that the
+// destination exists when opened, and then only counts the messages that
+// would be published.
+type dryRunTarget struct {
+	conn       *amqp091.Connection
+	exchange   string
+	routingKey string
+	messages   int
+	bytes      int
+}
+
+func openDryRunTarget(amqpURI, queueName string) (*dryRunTarget, error) {
+	if queueName == "" && *restoreExchange == "" {
+		return nil, fmt.Errorf("Must supply queue name")
+	}
+
+	conn, err := dial(amqpURI)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %s", err)
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	exchange, routingKey := restoreDestination(queueName)
+	err = checkDestination(channel, exchange, routingKey)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Dry run: %s", err)
+	}
+	return &dryRunTarget{conn: conn, exchange: exchange, routingKey: routingKey}, nil
+}
+
+func (t *dryRunTarget) publish(msg *dumpedMessage) error {
+	t.messages++
+	t.bytes += len(msg.Publishing.Body)
+	return nil
+}
+
+func (t *dryRunTarget) Close() error {
+	noticeLog("Dry run: would publish %d messages (%d bytes) to exchange %q with routing key %q", t.messages, t.bytes, t.exchange, t.routingKey)
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+// parseDeliveryMode converts a -force-delivery-mode value to the delivery
+// mode to publish with, or 0 to keep the dumped one.
+func parseDeliveryMode(s string) (uint8, error) {
+	switch s {
+	case "preserve":
+		return 0, nil
+	case "persistent":
+		return amqp091.Persistent, nil
+	case "transient":
+		return amqp091.Transient, nil
+	}
+	return 0, fmt.Errorf("Unknown delivery mode %q, expected preserve, persistent or transient", s)
+}
+
+// restoreMessages publishes the messages of a dump directory to queueName, or
+// to a Kafka topic with -kafka-brokers, in the order of their counters.
+func restoreMessages(amqpURI, queueName, outputDir string) (err error) {
+	throttle, err := newReplayThrottle(*replayRate, *replayDelay)
+	if err != nil {
+		return err
+	}
+	timing, err := newReplayTiming(*replayTimingMode, *replaySpeed)
+	if err != nil {
+		return err
+	}
+	if timing != nil && throttle != nil {
+		return fmt.Errorf("-replay-timing=preserve can't be combined with -replay-rate or -replay-delay")
+	}
+	deliveryMode, err := parseDeliveryMode(*forceDelivery)
+	if err != nil {
+		return err
+	}
+
+	if *restoreTopo && *kafkaBrokers != "" {
+		return fmt.Errorf("-restore-topology can't be combined with -kafka-brokers")
+	}
+	if (*restoreExchange != "" || *restoreRouting != "") && *kafkaBrokers != "" {
+		return fmt.Errorf("-restore-exchange and -restore-routing-key can't be combined with -kafka-brokers")
+	}
+	if *restoreTopo && queueName == "" {
+		return fmt.Errorf("-restore-topology requires -queue")
+	}
+	if *restoreDryRun && (*kafkaBrokers != "" || *restoreTopo || *verifyRestore) {
+		return fmt.Errorf("-restore-dry-run can't be combined with -kafka-brokers, -restore-topology or -verify-restore")
+	}
+	if *verifyRestore && *kafkaBrokers != "" {
+		return fmt.Errorf("-verify-restore can't be combined with -kafka-brokers")
+	}
+	if *verifyRestore && queueName == "" {
+		return fmt.Errorf("-verify-restore requires -queue")
+	}
+	var topology *queueTopology
+	if *restoreTopo {
+		topology, err = readTopology(outputDir)
+		if err != nil {
+			return fmt.Errorf("Restore topology: %s", err)
+		}
+	}
+
+	messages, orphans, err := findDumpedMessages(outputDir)
+	if err != nil {
+		return fmt.Errorf("Restore: %s", err)
+	}
+	if len(orphans) > 0 {
+		return fmt.Errorf("Restore: %s: no matching message body file", orphans[0])
+	}
+
+	var target restoreTarget
+	if *restoreDryRun {
+		target, err = openDryRunTarget(amqpURI, queueName)
+	} else if *kafkaBrokers != "" {
+		target, err = openKafkaWriter(*kafkaBrokers, *kafkaTopic)
+	} else {
+		target, err = openAmqpTarget(amqpURI, queueName)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := target.Close()
+		if err == nil && closeErr != nil {
+			err = closeErr
+		}
+	}()
+
+	if topology != nil {
+		err = declareTopology(target.(*amqpTarget).channel, queueName, topology)
+		if err != nil {
+			return fmt.Errorf("Restore topology: %s", err)
+		}
+	}
+
+	invalid := 0
+	for i := range messages {
+		msg := &messages[i]
+		err = loadDumpedMessage(msg)
+		if err != nil && *restoreDryRun {
+			// Report all the invalid files at once.
+			warningLog("%s: %s", msg.BodyPath, err)
+			invalid++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Restore: %s", err)
+		}
+
+		if deliveryMode != 0 {
+			msg.Publishing.DeliveryMode = deliveryMode
+		}
+
+		if !*restoreDryRun {
+			throttle.wait()
+			timing.wait(replayTime(msg))
+		}
+		err = target.publish(msg)
+		if err != nil {
+			return fmt.Errorf("Publish %s: %s", msg.BodyPath, err)
+		}
+		fmt.Println(msg.BodyPath)
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("Dry run: %d of the %d messages in %q can't be restored", invalid, len(messages), outputDir)
+	}
+	if *restoreDryRun {
+		return nil
+	}
+	verboseLog(fmt.Sprintf("Restored %d messages", len(messages)))
+	if *verifyRestore {
+		return target.(*amqpTarget).verifyRestore(queueName, messages)
+	}
+	return nil
+}
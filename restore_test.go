@@ -0,0 +1,620 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestNewReplayThrottle(t *testing.T) {
+	throttle, err := newReplayThrottle(0, 0)
+	if err != nil || throttle != nil {
+		t.Errorf("Expected no throttle by default, got %v, %v", throttle, err)
+	}
+	throttle.wait()
+
+	_, err = newReplayThrottle(10, time.Second)
+	if err == nil {
+		t.Errorf("Expected -replay-rate and -replay-delay together to be rejected")
+	}
+	_, err = newReplayThrottle(-1, 0)
+	if err == nil {
+		t.Errorf("Expected a negative -replay-rate to be rejected")
+	}
+}
+
+// measurePublishRate returns the rate of the publishes paced by throttle on
+// clock, when each publish takes publishTime.
+func measurePublishRate(throttle *replayThrottle, clock *fakeClock, messages int, publishTime time.Duration) float64 {
+	throttle.clock = clock
+	start := clock.now
+	for i := 0; i < messages; i++ {
+		throttle.wait()
+		clock.now = clock.now.Add(publishTime)
+	}
+	// The first message is sent immediately, so n messages span n-1
+	// intervals, plus the time of the last publish.
+	return float64(messages-1) / (clock.now.Sub(start) - publishTime).Seconds()
+}
+
+func TestReplayRate(t *testing.T) {
+	throttle, err := newReplayThrottle(100, 0)
+	if err != nil {
+		t.Fatalf("newReplayThrottle: %s", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)}
+	// Publishes faster than the rate wait for the next slot.
+	if rate := measurePublishRate(throttle, clock, 31, time.Millisecond); rate != 100 {
+		t.Errorf("Expected a publish rate of 100 messages/sec, got %.1f", rate)
+	}
+}
+
+func TestReplayRateDoesNotBurstAfterSlowPublish(t *testing.T) {
+	throttle, err := newReplayThrottle(100, 0)
+	if err != nil {
+		t.Fatalf("newReplayThrottle: %s", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)}
+	throttle.clock = clock
+	throttle.wait()
+	clock.now = clock.now.Add(100 * time.Millisecond)
+	// The late message is published at once, and the next ones still 10ms
+	// apart instead of catching up on the 9 missed slots.
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		before := clock.now
+		throttle.wait()
+		waits = append(waits, clock.now.Sub(before))
+	}
+	if fmt.Sprint(waits) != "[0s 10ms 10ms 10ms 10ms]" {
+		t.Errorf("Wrong waits after a slow publish: %v", waits)
+	}
+}
+
+func TestReplayDelay(t *testing.T) {
+	throttle, err := newReplayThrottle(0, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("newReplayThrottle: %s", err)
+	}
+	clock := &fakeClock{now: time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)}
+	if rate := measurePublishRate(throttle, clock, 11, 5*time.Millisecond); rate != 50 {
+		t.Errorf("Expected a publish rate of 50 messages/sec, got %.1f", rate)
+	}
+}
+
+func TestReplayRateRequiresRestore(t *testing.T) {
+	*replayRate = 20
+	defer func() { *replayRate = 0 }()
+	err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, "tmp-test", false)
+	if err == nil || !strings.Contains(err.Error(), "-replay-rate and -replay-delay require -restore") {
+		t.Errorf("Expected -replay-rate to be rejected when dumping, got %v", err)
+	}
+}
+
+func TestNewReplayTiming(t *testing.T) {
+	timing, err := newReplayTiming("none", 1)
+	if err != nil || timing != nil {
+		t.Errorf("Expected no timing by default, got %v, %v", timing, err)
+	}
+	timing.wait(time.Now())
+
+	for _, test := range []struct {
+		mode  string
+		speed float64
+	}{
+		{"none", 2},
+		{"preserve", 0},
+		{"preserve", -1},
+		{"original", 1},
+	} {
+		_, err = newReplayTiming(test.mode, test.speed)
+		if err == nil {
+			t.Errorf("Expected -replay-timing=%s -replay-speed=%g to be rejected", test.mode, test.speed)
+		}
+	}
+}
+
+func TestReplayTimingPreservesGaps(t *testing.T) {
+	timing, err := newReplayTiming("preserve", 10)
+	if err != nil {
+		t.Fatalf("newReplayTiming: %s", err)
+	}
+	start := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	timing.clock = clock
+
+	first := time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	ms := func(n int) time.Time { return first.Add(time.Duration(n) * time.Millisecond) }
+	// Gaps of 300ms, 0s and 1.2s at 10 times the original speed, plus a
+	// message without received_at nor timestamp which doesn't wait.
+	messages := []dumpedMessage{
+		{ReceivedAt: ms(0)},
+		{ReceivedAt: ms(300)},
+		{},
+		{ReceivedAt: ms(300)},
+		{ReceivedAt: ms(1500)},
+	}
+	expected := []time.Duration{0, 30 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond, 150 * time.Millisecond}
+	for i := range messages {
+		timing.wait(replayTime(&messages[i]))
+		if elapsed := clock.now.Sub(start); elapsed != expected[i] {
+			t.Errorf("Message %d: expected to be published after %s, got %s", i, expected[i], elapsed)
+		}
+	}
+
+	// A message older than the first one is late, so it doesn't wait.
+	before := clock.now
+	timing.wait(first.Add(-time.Hour))
+	if waited := clock.now.Sub(before); waited != 0 {
+		t.Errorf("Expected a late message to be published immediately, waited %s", waited)
+	}
+}
+
+func TestReplayTime(t *testing.T) {
+	timestamp := time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	receivedAt := timestamp.Add(250 * time.Millisecond)
+	msg := dumpedMessage{Publishing: amqp091.Publishing{Timestamp: timestamp}}
+	if got := replayTime(&msg); !got.Equal(timestamp) {
+		t.Errorf("Expected the timestamp without received_at, got %s", got)
+	}
+	msg.ReceivedAt = receivedAt
+	if got := replayTime(&msg); !got.Equal(receivedAt) {
+		t.Errorf("Expected received_at to take precedence, got %s", got)
+	}
+}
+
+func TestReceivedAtProperty(t *testing.T) {
+	if _, ok := getProperties(amqp091.Delivery{})["received_at"]; ok {
+		t.Errorf("Expected no received_at without -received-at")
+	}
+
+	*recordReceived = true
+	defer func() { *recordReceived = false }()
+	before := time.Now()
+	props := getProperties(amqp091.Delivery{})
+	var msg dumpedMessage
+	err := applyProperties(&msg, map[string]interface{}{"received_at": props["received_at"]})
+	if err != nil {
+		t.Fatalf("applyProperties: %s", err)
+	}
+	if msg.ReceivedAt.Before(before) || msg.ReceivedAt.After(time.Now()) {
+		t.Errorf("Wrong received_at: %v", props["received_at"])
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-restore", "-output-dir="+dir, "-replay-rate=50").CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	if length := getTestQueueLength(t); length != 3 {
+		t.Errorf("Expected 3 restored messages in the queue, got %d", length)
+	}
+
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=3 -output-dir=tmp-test -full")
+	verifyFileContent(t, "tmp-test/msg-0001", "message-1-body")
+	headers, _ := getMetadataFromFile(t, "tmp-test/msg-0001-headers+properties.json")
+	if headers["my-header"] != "my-value-1" {
+		t.Errorf("Wrong restored headers: %v", headers)
+	}
+}
+
+func TestRestoreHeadersFormats(t *testing.T) {
+	for _, format := range []string{"yaml", "msgpack"} {
+		populateTestQueue(t, 3)
+		dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-"+format)
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -output-dir="+dir+" -full -headers-format="+format)
+		deleteTestQueue(t)
+		populateTestQueue(t, 0)
+
+		output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-queue="+testQueueName, "-output-dir="+dir).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: run: %s: %s", format, err, string(output))
+		}
+
+		os.MkdirAll("tmp-test", 0775)
+		run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=3 -output-dir=tmp-test -full")
+		for i := 0; i < 3; i++ {
+			headers, properties := getMetadataFromFile(t, generateFilePath("tmp-test", uint(i))+metadataFileSuffix)
+			if headers["my-header"] != fmt.Sprintf("my-value-%d", i) || properties["priority"] != 4.0 {
+				t.Errorf("%s: wrong restored metadata: headers = %v, properties = %v", format, headers, properties)
+			}
+		}
+		os.RemoveAll("tmp-test")
+		deleteTestQueue(t)
+	}
+}
+
+func TestRestoreGzippedDump(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	gzipDumpFiles(t, dir)
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-queue="+testQueueName, "-output-dir="+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+
+	dumpDir, err := ioutil.TempDir("", "rabbitmq-dump-queue-restored")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	run(t, "rabbitmq-dump-queue -uri="+testAmqpURI+" -queue="+testQueueName+" -output-dir="+dumpDir)
+	for i := 0; i < 3; i++ {
+		verifyFileContent(t, generateFilePath(dumpDir, uint(i)), fmt.Sprintf("message-%d-body", i))
+	}
+}
+
+func TestParseDeliveryMode(t *testing.T) {
+	tests := map[string]uint8{"preserve": 0, "persistent": amqp091.Persistent, "transient": amqp091.Transient}
+	for s, expected := range tests {
+		mode, err := parseDeliveryMode(s)
+		if err != nil || mode != expected {
+			t.Errorf("parseDeliveryMode(%q): expected %d, got %d (%v)", s, expected, mode, err)
+		}
+	}
+	if _, err := parseDeliveryMode("durable"); err == nil {
+		t.Errorf("Expected an error for an unknown delivery mode")
+	}
+}
+
+func TestLoadDumpedMessageKeepsDeliveryMode(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	msg := dumpedMessage{BodyPath: generateFilePath(dir, 0)}
+	err := loadDumpedMessage(&msg)
+	if err != nil {
+		t.Fatalf("loadDumpedMessage: %s", err)
+	}
+	if msg.Publishing.DeliveryMode != amqp091.Persistent {
+		t.Errorf("Expected a persistent message, got delivery mode %d", msg.Publishing.DeliveryMode)
+	}
+}
+
+func TestLoadDumpedMessageKeepsRPCProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-rpc")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	request := amqp091.Delivery{
+		ReplyTo:       "amq.rabbitmq.reply-to.g1h2AA5yZXBseUAyNjMyMzQ3NQAAAAAAAAAB",
+		CorrelationId: "req-42",
+		Body:          []byte(`{"method":"getOrder","id":42}`),
+	}
+	err = ioutil.WriteFile(generateFilePath(dir, 0), request.Body, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = savePropsAndHeadersToFile(request, generateFilePath(dir, 0), 0)
+	if err != nil {
+		t.Fatalf("savePropsAndHeadersToFile: %s", err)
+	}
+
+	msg := dumpedMessage{BodyPath: generateFilePath(dir, 0)}
+	err = loadDumpedMessage(&msg)
+	if err != nil {
+		t.Fatalf("loadDumpedMessage: %s", err)
+	}
+	if msg.Publishing.ReplyTo != request.ReplyTo || msg.Publishing.CorrelationId != request.CorrelationId {
+		t.Errorf("Expected reply_to %q and correlation_id %q, got %q and %q", request.ReplyTo, request.CorrelationId, msg.Publishing.ReplyTo, msg.Publishing.CorrelationId)
+	}
+}
+
+func TestRestoreRPCRequest(t *testing.T) {
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+	conn := dialTestBroker(t)
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %s", err)
+	}
+	err = channel.Publish("", testQueueName, false, false, amqp091.Publishing{
+		ReplyTo:       "rpc-replies",
+		CorrelationId: "req-42",
+		Body:          []byte(`{"method":"getOrder","id":42}`),
+	})
+	if err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-rpc")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=1 -ack -full -output-dir="+dir)
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-restore", "-output-dir="+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+
+	msg, ok, err := channel.Get(testQueueName, true)
+	if err != nil || !ok {
+		t.Fatalf("Get: %v (%v)", err, ok)
+	}
+	if msg.ReplyTo != "rpc-replies" || msg.CorrelationId != "req-42" {
+		t.Errorf("Expected the restored request to keep reply_to and correlation_id, got %q and %q", msg.ReplyTo, msg.CorrelationId)
+	}
+}
+
+func TestRestoreDeliveryMode(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+
+	for _, test := range []struct {
+		flag     string
+		expected float64
+	}{
+		{"-force-delivery-mode=preserve", float64(amqp091.Persistent)},
+		{"-force-delivery-mode=transient", float64(amqp091.Transient)},
+	} {
+		populateTestQueue(t, 0)
+		output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-restore", "-output-dir="+dir, test.flag).CombinedOutput()
+		if err != nil {
+			t.Fatalf("run: %s: %s", err, string(output))
+		}
+		run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=1 -output-dir=tmp-test -full")
+		_, properties := getMetadataFromFile(t, "tmp-test/msg-0000-headers+properties.json")
+		if properties["delivery_mode"] != test.expected {
+			t.Errorf("%s: expected delivery mode %v, got %v", test.flag, test.expected, properties["delivery_mode"])
+		}
+	}
+	deleteTestQueue(t)
+}
+
+func TestRestoreTopology(t *testing.T) {
+	skipWithoutTestBroker(t)
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	err := writeTopology(dir, &queueTopology{
+		Queue:     testQueueName,
+		Arguments: map[string]interface{}{"x-max-length": int64(2)},
+		Bindings:  []topologyBinding{{Source: "amq.direct", RoutingKey: testQueueName}},
+	})
+	if err != nil {
+		t.Fatalf("writeTopology: %s", err)
+	}
+	defer deleteTestQueue(t)
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testQueueName, "-restore", "-restore-topology", "-output-dir="+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	// x-max-length dropped the oldest message.
+	if length := getTestQueueLength(t); length != 2 {
+		t.Errorf("Expected 2 restored messages in the queue, got %d", length)
+	}
+}
+
+func TestRestoreDestination(t *testing.T) {
+	exchange, routingKey := restoreDestination(testQueueName)
+	if exchange != "" || routingKey != testQueueName {
+		t.Errorf("Expected the default exchange and the queue name, got %q and %q", exchange, routingKey)
+	}
+
+	*restoreExchange = "orders.staging"
+	defer func() { *restoreExchange = "" }()
+	exchange, routingKey = restoreDestination(testQueueName)
+	if exchange != "orders.staging" || routingKey != testQueueName {
+		t.Errorf("Expected the exchange override with the queue name, got %q and %q", exchange, routingKey)
+	}
+
+	*restoreRouting = "orders.created"
+	defer func() { *restoreRouting = "" }()
+	exchange, routingKey = restoreDestination(testQueueName)
+	if exchange != "orders.staging" || routingKey != "orders.created" {
+		t.Errorf("Expected both overrides, got %q and %q", exchange, routingKey)
+	}
+}
+
+func TestRestoreExchangeOverride(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+
+	conn := dialTestBroker(t)
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %s", err)
+	}
+	err = channel.QueueBind(testQueueName, "restore-key", "amq.direct", false, nil)
+	if err != nil {
+		t.Fatalf("QueueBind: %s", err)
+	}
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-restore-exchange=amq.direct", "-restore-routing-key=restore-key", "-output-dir="+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	if length := getTestQueueLength(t); length != 3 {
+		t.Errorf("Expected 3 messages restored through amq.direct, got %d", length)
+	}
+
+	output, err = exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-restore-exchange=amq.direct", "-restore-routing-key=unbound-key", "-output-dir="+dir).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "unroutable") {
+		t.Errorf("Expected an unroutable error, got %v: %s", err, output)
+	}
+}
+
+func TestVerifyRestoreChecksums(t *testing.T) {
+	var messages []dumpedMessage
+	for i := 0; i < 3; i++ {
+		messages = append(messages, dumpedMessage{
+			Counter:    uint(i),
+			BodyPath:   fmt.Sprintf("msg-%04d", i),
+			Publishing: amqp091.Publishing{Body: []byte(fmt.Sprintf("message-%d-body", i))},
+		})
+	}
+
+	broker := newTestBroker(3)
+	restored, err := fetchChecksums(getMessages(broker, testQueueName, false))
+	if err != nil {
+		t.Fatalf("fetchChecksums: %s", err)
+	}
+	if len(broker.acked) > 0 {
+		t.Errorf("Expected the destination queue messages not to be acked, got %v", broker.acked)
+	}
+	// The broker may deliver the messages in another order.
+	restored[0], restored[2] = restored[2], restored[0]
+	if discrepancies := compareRestore(messages, restored); len(discrepancies) != 0 {
+		t.Errorf("Expected a successful restore, got %v", discrepancies)
+	}
+
+	// A lossy restore: message 1 was lost and message 2 published twice.
+	kept := bodyChecksum([]byte("message-0-body"))
+	lost := bodyChecksum([]byte("message-1-body"))
+	duplicate := bodyChecksum([]byte("message-2-body"))
+	discrepancies := compareRestore(messages, []string{kept, duplicate, duplicate, duplicate})
+	expected := []string{
+		"3 messages in the dump, 4 in the destination queue",
+		"missing 1 of msg-0001 (body sha256 " + lost + ")",
+		"2 unexpected messages with body sha256 " + duplicate,
+	}
+	if lost > duplicate {
+		expected[1], expected[2] = expected[2], expected[1]
+	}
+	if strings.Join(discrepancies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong discrepancies:\nexpected %q\ngot      %q", expected, discrepancies)
+	}
+}
+
+func TestVerifyRestore(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-verify-restore", "-queue="+testQueueName, "-output-dir="+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	if !strings.Contains(string(output), "the 3 messages of queue") {
+		t.Errorf("Expected a verified restore, got: %s", output)
+	}
+	if length := getTestQueueLength(t); length != 3 {
+		t.Errorf("Expected the verification to leave the 3 messages in the queue, got %d", length)
+	}
+
+	// Restoring again doubles every message in the queue.
+	output, err = exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-verify-restore", "-queue="+testQueueName, "-output-dir="+dir).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "3 messages in the dump, 6 in the destination queue") {
+		t.Errorf("Expected a failed verification, got %v: %s", err, output)
+	}
+}
+
+// fakeDestinations is a destinationChecker where only the listed queues and
+// exchanges exist.
+type fakeDestinations struct {
+	queues    map[string]bool
+	exchanges map[string]bool
+}
+
+func (f *fakeDestinations) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp091.Table) (amqp091.Queue, error) {
+	if !f.queues[name] {
+		return amqp091.Queue{}, fmt.Errorf("NOT_FOUND - no queue '%s'", name)
+	}
+	return amqp091.Queue{Name: name}, nil
+}
+
+func (f *fakeDestinations) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp091.Table) error {
+	if !f.exchanges[name] {
+		return fmt.Errorf("NOT_FOUND - no exchange '%s'", name)
+	}
+	return nil
+}
+
+func TestCheckDestination(t *testing.T) {
+	broker := &fakeDestinations{queues: map[string]bool{"orders": true}, exchanges: map[string]bool{"amq.direct": true}}
+	if err := checkDestination(broker, "", "orders"); err != nil {
+		t.Errorf("Expected an existing queue, got %s", err)
+	}
+	if err := checkDestination(broker, "amq.direct", "no-such-queue"); err != nil {
+		t.Errorf("Expected an existing exchange, got %s", err)
+	}
+	if err := checkDestination(broker, "", "no-such-queue"); err == nil || !strings.Contains(err.Error(), `queue "no-such-queue"`) {
+		t.Errorf("Expected a missing queue, got %v", err)
+	}
+	if err := checkDestination(broker, "no-such-exchange", "orders"); err == nil || !strings.Contains(err.Error(), `exchange "no-such-exchange"`) {
+		t.Errorf("Expected a missing exchange, got %v", err)
+	}
+}
+
+func TestDryRunTargetDoesNotPublish(t *testing.T) {
+	target := &dryRunTarget{exchange: "", routingKey: "orders"}
+	for i := 0; i < 3; i++ {
+		publishing := makeAmqpMessage(i)
+		err := target.publish(&dumpedMessage{Publishing: publishing})
+		if err != nil {
+			t.Fatalf("publish: %s", err)
+		}
+	}
+	if target.messages != 3 || target.bytes != 3*len("message-0-body") {
+		t.Errorf("Expected 3 messages of %d bytes, got %d of %d bytes", 3*len("message-0-body"), target.messages, target.bytes)
+	}
+
+	if err := target.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+}
+
+func TestRestoreDryRun(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	populateTestQueue(t, 0)
+	defer deleteTestQueue(t)
+
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-restore-dry-run", "-queue="+testQueueName, "-output-dir="+dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	if !strings.Contains(string(output), "would publish 3 messages") {
+		t.Errorf("Expected the dry run report, got: %s", output)
+	}
+	if length := getTestQueueLength(t); length != 0 {
+		t.Errorf("Expected the dry run not to publish, got %d messages in the queue", length)
+	}
+
+	err = ioutil.WriteFile(generateFilePath(dir, 1)+metadataSuffix(), []byte("{not json"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	output, err = exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-restore-dry-run", "-queue="+testQueueName, "-output-dir="+dir).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), generateFilePath(dir, 1)+": ") || !strings.Contains(string(output), "1 of the 3 messages") {
+		t.Errorf("Expected the invalid message to be reported, got %v: %s", err, output)
+	}
+	if length := getTestQueueLength(t); length != 0 {
+		t.Errorf("Expected the dry run not to publish, got %d messages in the queue", length)
+	}
+
+	output, err = exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-restore", "-restore-dry-run", "-queue=no-such-queue", "-output-dir="+dir).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), `queue "no-such-queue"`) {
+		t.Errorf("Expected a missing destination queue, got %v: %s", err, output)
+	}
+}
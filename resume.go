@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// afterMessageID wraps fetch so that it skips the messages from the head of
+// the queue up to and including the one with message ID id, and then returns
+// the rest.  The skipped messages must have been fetched with manual acks:
+// they are left un-acked and requeued when the connection closes, except
+// that they are acked on streams, which need acks to keep delivering, and
+// requeued right away in a -consume peek.  When no message has the ID, the
+// whole queue is scanned and nothing is returned.
+func afterMessageID(fetch fetchFunc, id string) fetchFunc {
+	found := false
+	return func() (amqp091.Delivery, bool, error) {
+		if found {
+			return fetch()
+		}
+		skipped := 0
+		for {
+			msg, ok, err := fetch()
+			if err != nil || !ok {
+				if err == nil {
+					warningLog("Message ID %q not found in %d messages, nothing to dump", id, skipped)
+				}
+				return msg, ok, err
+			}
+			err = skipScanned(msg)
+			if err != nil {
+				return msg, false, fmt.Errorf("Ack: %s", err)
+			}
+			skipped++
+			if msg.MessageId == id {
+				found = true
+				verboseLog(fmt.Sprintf("Skipped %d messages up to message ID %q", skipped, id))
+				return fetch()
+			}
+		}
+	}
+}
+
+// skipScanned disposes of a message that was read but isn't dumped, without
+// removing it from the queue.
+func skipScanned(msg amqp091.Delivery) error {
+	if *streamOffset != "" {
+		return msg.Ack(false)
+	}
+	if requeuesEachMessage() {
+		return msg.Nack(false, true)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestAfterMessageID(t *testing.T) {
+	*ack = true
+	defer func() { *ack = false }()
+
+	broker := newTestBroker(10)
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: afterMessageID(getMessages(broker, testQueueName, false), "msgid-3"), writer: writer, maxMessages: 4, manualAck: true}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	expected := "[message-4-body message-5-body message-6-body message-7-body]"
+	if received != 4 || fmt.Sprint(writer.bodies) != expected {
+		t.Errorf("Expected the 4 messages after msgid-3, got %d: %v", received, writer.bodies)
+	}
+	// Delivery tags 1-4 are the skipped messages, which stay in the queue.
+	if fmt.Sprint(broker.acked) != "[5 6 7 8]" || len(broker.requeued) != 0 {
+		t.Errorf("Expected only the dumped messages to be acked, got acks %v", broker.acked)
+	}
+}
+
+func TestAfterMessageIDNotFound(t *testing.T) {
+	broker := newTestBroker(5)
+	writer := &testWriter{}
+	loop := &dumpLoop{fetch: afterMessageID(getMessages(broker, testQueueName, false), "msgid-42"), writer: writer, manualAck: true}
+	received, err := loop.run()
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if received != 0 || len(broker.ready) != 0 {
+		t.Errorf("Expected the whole queue to be scanned and nothing dumped, got %d", received)
+	}
+}
+
+func TestAfterMessageIDLast(t *testing.T) {
+	broker := newTestBroker(5)
+	loop := &dumpLoop{fetch: afterMessageID(getMessages(broker, testQueueName, false), "msgid-4"), writer: &testWriter{}, manualAck: true}
+	received, err := loop.run()
+	if err != nil || received != 0 {
+		t.Errorf("Expected nothing after the last message, got %d (%v)", received, err)
+	}
+}
+
+func TestAfterMessageIDSkipsAndRequeues(t *testing.T) {
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	output := run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -max-messages=2 -output-dir=tmp-test -after-message-id=msgid-6")
+	expectedOutput := "tmp-test/msg-0000\ntmp-test/msg-0001\n"
+	if output != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0000", "message-7-body")
+	verifyFileContent(t, "tmp-test/msg-0001", "message-8-body")
+}
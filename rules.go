@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rabbitmq/amqp091-go"
+	"gopkg.in/yaml.v3"
+)
+
+// ruleFile is the content of a -rules-file, in YAML or JSON.
+type ruleFile struct {
+	Rules []filterRule `yaml:"rules"`
+}
+
+// filterRule is a named condition of a -rules-file.
+type filterRule struct {
+	Name          string `yaml:"name"`
+	ruleCondition `yaml:",inline"`
+}
+
+// ruleCondition is one test on a message, or a group of conditions that must
+// all hold (all), of which one must hold (any), or that must not hold (not).
+// Exactly one field is set.
+type ruleCondition struct {
+	RoutingKey   *string         `yaml:"routing_key"`
+	Exchange     *string         `yaml:"exchange"`
+	Header       *fieldMatch     `yaml:"header"`
+	Property     *fieldMatch     `yaml:"property"`
+	BodyContains *string         `yaml:"body_contains"`
+	BodyRegexp   *string         `yaml:"body_regexp"`
+	All          []ruleCondition `yaml:"all"`
+	Any          []ruleCondition `yaml:"any"`
+	Not          *ruleCondition  `yaml:"not"`
+}
+
+// fieldMatch tests a header or property: its value must be equal to equals,
+// or match regexp, or, if neither is given, the field must be present.
+type fieldMatch struct {
+	Name   string  `yaml:"name"`
+	Equals *string `yaml:"equals"`
+	Regexp *string `yaml:"regexp"`
+}
+
+// ruleSet is the -rules-file filter: a message matches if it matches at
+// least one of the rules.  It counts the messages each rule matched.
+type ruleSet struct {
+	names    []string
+	rules    []messageFilter
+	matched  []uint
+	messages uint
+}
+
+func loadRuleSet(filePath string) (*ruleSet, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuleSet(data)
+}
+
+// parseRuleSet parses a rules file.  JSON is valid YAML, so both are read by
+// the YAML decoder; unknown fields are rejected to catch typos.
+func parseRuleSet(data []byte) (*ruleSet, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var file ruleFile
+	err := decoder.Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+
+	s := &ruleSet{matched: make([]uint, len(file.Rules))}
+	for i, rule := range file.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		filter, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		s.names = append(s.names, name)
+		s.rules = append(s.rules, filter)
+	}
+	return s, nil
+}
+
+func (c *ruleCondition) compile() (messageFilter, error) {
+	set := 0
+	for _, isSet := range []bool{c.RoutingKey != nil, c.Exchange != nil, c.Header != nil, c.Property != nil,
+		c.BodyContains != nil, c.BodyRegexp != nil, c.All != nil, c.Any != nil, c.Not != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("a condition needs exactly one of routing_key, exchange, header, property, body_contains, body_regexp, all, any or not, got %d", set)
+	}
+
+	switch {
+	case c.RoutingKey != nil:
+		routingKey := *c.RoutingKey
+		return func(msg amqp091.Delivery) bool { return msg.RoutingKey == routingKey }, nil
+	case c.Exchange != nil:
+		exchange := *c.Exchange
+		return func(msg amqp091.Delivery) bool { return msg.Exchange == exchange }, nil
+	case c.Header != nil:
+		match, err := c.Header.compile()
+		if err != nil {
+			return nil, fmt.Errorf("header: %s", err)
+		}
+		name := c.Header.Name
+		return func(msg amqp091.Delivery) bool {
+			v, ok := msg.Headers[name]
+			return match(fmt.Sprint(v), ok)
+		}, nil
+	case c.Property != nil:
+		if !isMessageProperty(c.Property.Name) {
+			return nil, fmt.Errorf("property: unknown property %q", c.Property.Name)
+		}
+		match, err := c.Property.compile()
+		if err != nil {
+			return nil, fmt.Errorf("property: %s", err)
+		}
+		name := c.Property.Name
+		return func(msg amqp091.Delivery) bool {
+			return match(messageProperty(msg, name))
+		}, nil
+	case c.BodyContains != nil:
+		substring := []byte(*c.BodyContains)
+		return func(msg amqp091.Delivery) bool { return bytes.Contains(msg.Body, substring) }, nil
+	case c.BodyRegexp != nil:
+		re, err := regexp.Compile(*c.BodyRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("body_regexp: %s", err)
+		}
+		return func(msg amqp091.Delivery) bool { return re.Match(msg.Body) }, nil
+	case c.Not != nil:
+		filter, err := c.Not.compile()
+		if err != nil {
+			return nil, fmt.Errorf("not: %s", err)
+		}
+		return func(msg amqp091.Delivery) bool { return !filter(msg) }, nil
+	}
+
+	conditions, all := c.All, true
+	if c.Any != nil {
+		conditions, all = c.Any, false
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("empty all or any")
+	}
+	var filters []messageFilter
+	for i := range conditions {
+		filter, err := conditions[i].compile()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	if all {
+		return func(msg amqp091.Delivery) bool { return matchesFilters(filters, msg) }, nil
+	}
+	return func(msg amqp091.Delivery) bool {
+		for _, filter := range filters {
+			if filter(msg) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// compile returns the test of a header or property value; present is false
+// when the message doesn't have the field.
+func (f *fieldMatch) compile() (func(value string, present bool) bool, error) {
+	if f.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if f.Equals != nil && f.Regexp != nil {
+		return nil, fmt.Errorf("%s: equals and regexp are mutually exclusive", f.Name)
+	}
+	if f.Equals != nil {
+		equals := *f.Equals
+		return func(value string, present bool) bool { return present && value == equals }, nil
+	}
+	if f.Regexp != nil {
+		re, err := regexp.Compile(*f.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name, err)
+		}
+		return func(value string, present bool) bool { return present && re.MatchString(value) }, nil
+	}
+	return func(value string, present bool) bool { return present }, nil
+}
+
+var messagePropertyNames = []string{"app_id", "content_encoding", "content_type", "correlation_id", "delivery_mode",
+	"expiration", "message_id", "priority", "reply_to", "type", "user_id"}
+
+func isMessageProperty(name string) bool {
+	for _, property := range messagePropertyNames {
+		if name == property {
+			return true
+		}
+	}
+	return false
+}
+
+// messageProperty returns a property of msg as text, with the names of the
+// headers+properties files, and false when it is unset.  Like when it is
+// written, an empty string property is unset; numeric ones are always set.
+func messageProperty(msg amqp091.Delivery, name string) (string, bool) {
+	var value string
+	switch name {
+	case "app_id":
+		value = msg.AppId
+	case "content_encoding":
+		value = msg.ContentEncoding
+	case "content_type":
+		value = msg.ContentType
+	case "correlation_id":
+		value = msg.CorrelationId
+	case "delivery_mode":
+		return strconv.Itoa(int(msg.DeliveryMode)), true
+	case "expiration":
+		value = msg.Expiration
+	case "message_id":
+		value = msg.MessageId
+	case "priority":
+		return strconv.Itoa(int(msg.Priority)), true
+	case "reply_to":
+		value = msg.ReplyTo
+	case "type":
+		value = msg.Type
+	case "user_id":
+		value = msg.UserId
+	}
+	return value, value != ""
+}
+
+// matches is a messageFilter.  Every rule is evaluated, so that the counts
+// of the report are right when several rules match a message.
+func (s *ruleSet) matches(msg amqp091.Delivery) bool {
+	s.messages++
+	matched := false
+	for i, rule := range s.rules {
+		if rule(msg) {
+			s.matched[i]++
+			matched = true
+		}
+	}
+	return matched
+}
+
+// String reports how many messages each rule matched, in the order of the
+// rules file.
+func (s *ruleSet) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Messages matched per rule (of %d):\n", s.messages)
+	for i, name := range s.names {
+		fmt.Fprintf(&b, "  %6d  %s\n", s.matched[i], name)
+	}
+	return b.String()
+}
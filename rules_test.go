@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const testRulesYAML = `
+rules:
+  - name: acme orders
+    all:
+      - routing_key: orders.created
+      - header: {name: tenant, equals: acme}
+  - name: errors
+    any:
+      - body_regexp: '"status": *"error"'
+      - property: {name: type, regexp: '^error\.'}
+  - name: untraced
+    not:
+      header: {name: trace_id}
+`
+
+func TestRulesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-rules")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	rulesPath := path.Join(dir, "rules.yaml")
+	err = ioutil.WriteFile(rulesPath, []byte(testRulesYAML), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	rules, err := loadRuleSet(rulesPath)
+	if err != nil {
+		t.Fatalf("loadRuleSet: %s", err)
+	}
+	traced := amqp091.Table{"trace_id": "t1"}
+	tests := []struct {
+		msg      amqp091.Delivery
+		expected bool
+	}{
+		{amqp091.Delivery{RoutingKey: "orders.created", Headers: amqp091.Table{"tenant": "acme", "trace_id": "t1"}}, true},
+		{amqp091.Delivery{RoutingKey: "orders.created", Headers: amqp091.Table{"tenant": "globex", "trace_id": "t2"}}, false},
+		{amqp091.Delivery{Headers: traced, Body: []byte(`{"status": "error"}`)}, true},
+		{amqp091.Delivery{Headers: traced, Type: "error.timeout"}, true},
+		{amqp091.Delivery{Headers: traced, Type: "info.error"}, false},
+		// Matches both "errors" and "untraced".
+		{amqp091.Delivery{Body: []byte(`{"status":"error"}`)}, true},
+	}
+	for i, test := range tests {
+		if matched := rules.matches(test.msg); matched != test.expected {
+			t.Errorf("Message %d: expected %v, got %v", i, test.expected, matched)
+		}
+	}
+
+	expected := "Messages matched per rule (of 6):\n" +
+		"       1  acme orders\n" +
+		"       3  errors\n" +
+		"       1  untraced\n"
+	if rules.String() != expected {
+		t.Errorf("Wrong report:\nexpected %q\ngot      %q", expected, rules.String())
+	}
+}
+
+func TestRulesFileJSON(t *testing.T) {
+	rules, err := parseRuleSet([]byte(`{"rules": [{"property": {"name": "priority", "equals": "9"}}, {"exchange": "audit"}]}`))
+	if err != nil {
+		t.Fatalf("parseRuleSet: %s", err)
+	}
+	if !rules.matches(amqp091.Delivery{Priority: 9}) || !rules.matches(amqp091.Delivery{Exchange: "audit"}) || rules.matches(amqp091.Delivery{Priority: 1}) {
+		t.Errorf("Wrong matches: %s", rules)
+	}
+	if !strings.Contains(rules.String(), "  rule 2\n") {
+		t.Errorf("Expected unnamed rules to be numbered, got %q", rules.String())
+	}
+}
+
+func TestInvalidRulesFile(t *testing.T) {
+	for _, rules := range []string{
+		`rules: []`,
+		`rules: [{name: typo, routing_kye: orders}]`,
+		`rules: [{name: two, routing_key: a, exchange: b}]`,
+		`rules: [{name: none}]`,
+		`rules: [{name: empty, all: []}]`,
+		`rules: [{name: nested, any: [{header: {equals: x}}]}]`,
+		`rules: [{name: unknown, property: {name: colour}}]`,
+		`rules: [{name: both, header: {name: a, equals: x, regexp: y}}]`,
+		`rules: [{name: regexp, body_regexp: "("}]`,
+	} {
+		_, err := parseRuleSet([]byte(rules))
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", rules)
+		}
+	}
+}
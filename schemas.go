@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const schemaReportFileName = "header-schemas.json"
+
+// headerSchema is an entry of the -header-schemas report: a distinct set of
+// header names, how many messages had exactly these headers and the headers
+// of the first one, whose files are kept as an example.
+type headerSchema struct {
+	Headers      []string               `json:"headers"`
+	Count        uint                   `json:"count"`
+	File         string                 `json:"file"`
+	FirstMessage uint                   `json:"first_message"`
+	Example      map[string]interface{} `json:"example,omitempty"`
+}
+
+// schemaReport is written to header-schemas.json, with the schemas by
+// decreasing count.
+type schemaReport struct {
+	Messages      uint            `json:"messages"`
+	UniqueSchemas int             `json:"unique_schemas"`
+	Schemas       []*headerSchema `json:"schemas"`
+}
+
+// schemaWriter groups the messages by the names of their headers, and saves
+// the first message of each group like the files output does.
+type schemaWriter struct {
+	files    *filesWriter
+	messages uint
+	schemas  map[string]*headerSchema
+}
+
+func newSchemaWriter(outputDir string) *schemaWriter {
+	return &schemaWriter{files: newFilesWriter(outputDir, 1), schemas: make(map[string]*headerSchema)}
+}
+
+// headerNames returns the sorted names of the headers of a message.  Nested
+// tables count as one header.
+func headerNames(headers amqp091.Table) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w *schemaWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	names := headerNames(msg.Headers)
+	key := fmt.Sprintf("%q", names)
+	w.messages++
+	if schema, ok := w.schemas[key]; ok {
+		schema.Count++
+		return nil
+	}
+
+	bodyPath, err := w.files.writeMessage(msg, counter)
+	if err != nil {
+		return err
+	}
+	w.schemas[key] = &headerSchema{
+		Headers:      names,
+		Count:        1,
+		File:         path.Base(bodyPath),
+		FirstMessage: counter,
+		Example:      encodableHeaders(msg.Headers),
+	}
+	return nil
+}
+
+func (w *schemaWriter) report() schemaReport {
+	report := schemaReport{Messages: w.messages, UniqueSchemas: len(w.schemas), Schemas: []*headerSchema{}}
+	for _, schema := range w.schemas {
+		report.Schemas = append(report.Schemas, schema)
+	}
+	sort.Slice(report.Schemas, func(i, j int) bool {
+		a, b := report.Schemas[i], report.Schemas[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.FirstMessage < b.FirstMessage
+	})
+	return report
+}
+
+// Close writes the report.
+func (w *schemaWriter) Close() error {
+	err := w.files.Close()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(w.report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	reportPath := path.Join(w.files.outputDir, schemaReportFileName)
+	err = writeFile(reportPath, append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Header schemas report: %s", err)
+	}
+	fmt.Println(reportPath)
+	return nil
+}
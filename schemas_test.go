@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestSchemaWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-schemas")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	headers := []amqp091.Table{
+		{"tenant": "acme", "trace_id": "a1"},
+		nil,
+		// Same names in another order and with other values.
+		{"trace_id": "b2", "tenant": "globex"},
+		{"tenant": "acme"},
+		{"tenant": "initech", "trace_id": "c3"},
+		{},
+	}
+	writer := newSchemaWriter(dir)
+	for i, h := range headers {
+		err = writer.WriteMessage(amqp091.Delivery{Headers: h, Body: []byte(fmt.Sprintf("message-%d-body", i))}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, schemaReportFileName))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	var report schemaReport
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if report.Messages != 6 || report.UniqueSchemas != 3 || len(report.Schemas) != 3 {
+		t.Fatalf("Wrong report: %s", data)
+	}
+	expected := []headerSchema{
+		{Headers: []string{"tenant", "trace_id"}, Count: 3, File: "msg-0000", FirstMessage: 0, Example: map[string]interface{}{"tenant": "acme", "trace_id": "a1"}},
+		{Headers: []string{}, Count: 2, File: "msg-0001", FirstMessage: 1},
+		{Headers: []string{"tenant"}, Count: 1, File: "msg-0003", FirstMessage: 3, Example: map[string]interface{}{"tenant": "acme"}},
+	}
+	for i, schema := range expected {
+		if !reflect.DeepEqual(*report.Schemas[i], schema) {
+			t.Errorf("Wrong schema %d: expected %+v but got %+v", i, schema, *report.Schemas[i])
+		}
+		verifyFileContent(t, path.Join(dir, schema.File), fmt.Sprintf("message-%d-body", schema.FirstMessage))
+	}
+	if _, err := os.Stat(path.Join(dir, "msg-0002")); !os.IsNotExist(err) {
+		t.Errorf("Expected only the first message of each schema to be saved, got %v", err)
+	}
+}
+
+func TestHeaderSchemasKeepsQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-schemas")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	populateTestQueue(t, 5)
+	defer deleteTestQueue(t)
+
+	run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -header-schemas -output-dir="+dir)
+	data, err := ioutil.ReadFile(path.Join(dir, schemaReportFileName))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	var report schemaReport
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if report.Messages != 5 || report.UniqueSchemas != 1 || report.Schemas[0].Count != 5 {
+		t.Errorf("Wrong report: %s", data)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// sequenceTotal is the number of messages the current dump is expected to
+// write, included in the -sequence metadata, or -1 when it isn't known.
+var sequenceTotal = -1
+
+// expectedTotal returns the number of messages a dump of a queue holding
+// queueMessages messages will write, or -1 when it can't be known in
+// advance: filters skip an unknown number of messages, and a stream offset
+// starts at an unknown position.
+func expectedTotal(queueMessages int, maxMessages uint, filtered bool) int {
+	if filtered || *streamOffset != "" {
+		return -1
+	}
+	if maxMessages > 0 && uint(queueMessages) > maxMessages {
+		return int(maxMessages)
+	}
+	return queueMessages
+}
+
+// inspectTotal sets sequenceTotal for a -sequence dump of queueName.
+func inspectTotal(channel *amqp091.Channel, queueName string, maxMessages uint, filtered bool) error {
+	sequenceTotal = -1
+	queue, err := channel.QueueInspect(queueName)
+	if err != nil {
+		return err
+	}
+	sequenceTotal = expectedTotal(queue.Messages, maxMessages, filtered)
+	return nil
+}
+
+// addSequence adds the -sequence fields to the extras of message counter:
+// "seq", the counter, and "total" when it is known.
+func addSequence(extras map[string]interface{}, counter uint) {
+	if !*sequence {
+		return
+	}
+	extras["seq"] = counter
+	if sequenceTotal >= 0 {
+		extras["total"] = sequenceTotal
+	}
+}
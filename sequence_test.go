@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestExpectedTotal(t *testing.T) {
+	tests := []struct {
+		queueMessages int
+		maxMessages   uint
+		filtered      bool
+		expected      int
+	}{
+		{25, 10, false, 10},
+		{5, 10, false, 5},
+		{25, 0, false, 25},
+		{25, 10, true, -1},
+	}
+	for _, test := range tests {
+		total := expectedTotal(test.queueMessages, test.maxMessages, test.filtered)
+		if total != test.expected {
+			t.Errorf("expectedTotal(%d, %d, %v): expected %d, got %d", test.queueMessages, test.maxMessages, test.filtered, test.expected, total)
+		}
+	}
+}
+
+func TestSequenceMetadata(t *testing.T) {
+	*sequence = true
+	sequenceTotal = 3
+	defer func() {
+		*sequence = false
+		sequenceTotal = -1
+	}()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-sequence")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	database, err := sql.Open("sqlite", path.Join(dir, "dump.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	defer database.Close()
+	err = setupDb(database, nil, false)
+	if err != nil {
+		t.Fatalf("setupDb: %s", err)
+	}
+
+	for counter := uint(0); counter < 3; counter++ {
+		msg := amqp091.Delivery{Headers: amqp091.Table{}, Body: []byte("body")}
+		err = savePropsAndHeadersToFile(msg, generateFilePath(dir, counter), counter)
+		if err != nil {
+			t.Fatalf("savePropsAndHeadersToFile: %s", err)
+		}
+		_, err = saveMessageToDb(database, msg, counter)
+		if err != nil {
+			t.Fatalf("saveMessageToDb: %s", err)
+		}
+	}
+
+	rows, err := database.Query("SELECT headers FROM dump ORDER BY rowid")
+	if err != nil {
+		t.Fatalf("Query: %s", err)
+	}
+	defer rows.Close()
+	for counter := 0; counter < 3; counter++ {
+		var fromDb string
+		if !rows.Next() {
+			t.Fatalf("Missing db row %d", counter)
+		}
+		err = rows.Scan(&fromDb)
+		if err != nil {
+			t.Fatalf("Scan: %s", err)
+		}
+		fromFile, err := ioutil.ReadFile(generateFilePath(dir, uint(counter)) + metadataFileSuffix)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+
+		for _, data := range []string{fromDb, string(fromFile)} {
+			var metadata struct {
+				Seq   *int `json:"seq"`
+				Total *int `json:"total"`
+			}
+			err = json.Unmarshal([]byte(data), &metadata)
+			if err != nil {
+				t.Fatalf("Unmarshal: %s", err)
+			}
+			if metadata.Seq == nil || *metadata.Seq != counter || metadata.Total == nil || *metadata.Total != 3 {
+				t.Errorf("Wrong sequence fields of message %d: %s", counter, data)
+			}
+		}
+	}
+}
+
+func TestSequenceMetadataVerifies(t *testing.T) {
+	*sequence = true
+	*jsonRoot = "flat"
+	defer func() {
+		*sequence = false
+		*jsonRoot = "nested"
+	}()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-sequence")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := amqp091.Delivery{ContentType: "text/plain", Body: []byte("body")}
+	err = ioutil.WriteFile(generateFilePath(dir, 0), msg.Body, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = savePropsAndHeadersToFile(msg, generateFilePath(dir, 0), 0)
+	if err != nil {
+		t.Fatalf("savePropsAndHeadersToFile: %s", err)
+	}
+	err = verifyDump(dir)
+	if err != nil {
+		t.Errorf("verifyDump: %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fetchSingleMessage returns the only message of the queue.  An empty queue
+// is an error, and so is a second message unless first is set, in which
+// case the first message is returned regardless.  The messages are fetched
+// without acknowledging them, so after an error they return to the queue
+// when the connection closes.
+func fetchSingleMessage(fetch fetchFunc, first bool) (amqp091.Delivery, error) {
+	msg, ok, err := fetch()
+	if err != nil {
+		return msg, fmt.Errorf("Queue get: %s", err)
+	}
+	if !ok {
+		return msg, fmt.Errorf("-single: the queue is empty")
+	}
+	if first {
+		return msg, nil
+	}
+
+	_, ok, err = fetch()
+	if err != nil {
+		return msg, fmt.Errorf("Queue get: %s", err)
+	}
+	if ok {
+		return msg, fmt.Errorf("-single: the queue has more than one message (use -single-first to dump the first one)")
+	}
+	return msg, nil
+}
+
+// writeSingleMessage writes the body of msg to stdout and, with -full, its
+// headers and properties to stderr, so that the body can be piped on its
+// own.
+func writeSingleMessage(msg amqp091.Delivery, stdout io.Writer, stderr io.Writer) error {
+	_, err := stdout.Write(fileBody(msg))
+	if err != nil {
+		return err
+	}
+	if !*full {
+		return nil
+	}
+	data, _, err := propsAndHeaders(msg, 0)
+	if err != nil {
+		return err
+	}
+	_, err = stderr.Write(append(data, '\n'))
+	return err
+}
+
+// dumpSingleMessage writes the only message of queueName to stdout instead
+// of a file, e.g. to look at an RPC reply.  With -ack or -on-dump the message
+// is disposed of once written, like in a normal dump.
+func dumpSingleMessage(amqpURI string, queueName string) error {
+	if queueName == "" {
+		return fmt.Errorf("Must supply queue name")
+	}
+	if *queuesFile != "" || *watchMode {
+		return fmt.Errorf("-single can't be combined with -queues-file or -watch")
+	}
+
+	conn, err := dial(amqpURI)
+	if err != nil {
+		return fmt.Errorf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Channel: %s", err)
+	}
+
+	msg, err := fetchSingleMessage(getMessages(channel, queueName, false), *singleFirst)
+	if err != nil {
+		return err
+	}
+	err = writeSingleMessage(msg, os.Stdout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("-single: %s", err)
+	}
+	err = acknowledgeSaved(msg, true)
+	if err != nil {
+		return fmt.Errorf("Ack: %s", err)
+	}
+	return nil
+}
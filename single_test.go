@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestFetchSingleMessage(t *testing.T) {
+	tests := []struct {
+		messages int
+		first    bool
+		err      string
+	}{
+		{0, false, "the queue is empty"},
+		{0, true, "the queue is empty"},
+		{1, false, ""},
+		{1, true, ""},
+		{3, false, "more than one message"},
+		{3, true, ""},
+	}
+	for _, test := range tests {
+		broker := newTestBroker(test.messages)
+		msg, err := fetchSingleMessage(getMessages(broker, testQueueName, false), test.first)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%d messages (first %v): expected error %q, got %v", test.messages, test.first, test.err, err)
+			}
+		} else if err != nil || msg.MessageId != "msgid-0" {
+			t.Errorf("%d messages (first %v): expected msgid-0, got %q (%v)", test.messages, test.first, msg.MessageId, err)
+		}
+		if len(broker.acked) > 0 {
+			t.Errorf("%d messages (first %v): expected no acks, got %v", test.messages, test.first, broker.acked)
+		}
+	}
+}
+
+func TestWriteSingleMessage(t *testing.T) {
+	msg := amqp091.Delivery{
+		CorrelationId: "req-42",
+		Headers:       amqp091.Table{"status": "ok"},
+		Body:          []byte(`{"result":42}`),
+	}
+
+	var stdout, stderr bytes.Buffer
+	err := writeSingleMessage(msg, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("writeSingleMessage: %s", err)
+	}
+	if stdout.String() != `{"result":42}` || stderr.Len() != 0 {
+		t.Errorf("Expected only the body, got %q and %q", stdout.String(), stderr.String())
+	}
+
+	*full = true
+	defer func() { *full = false }()
+	stdout.Reset()
+	err = writeSingleMessage(msg, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("writeSingleMessage: %s", err)
+	}
+	if stdout.String() != `{"result":42}` {
+		t.Errorf("Wrong body: %q", stdout.String())
+	}
+	var extras map[string]interface{}
+	err = json.Unmarshal(stderr.Bytes(), &extras)
+	if err != nil {
+		t.Fatalf("Unmarshal %q: %s", stderr.String(), err)
+	}
+	props, _ := extras["properties"].(map[string]interface{})
+	if props["correlation_id"] != "req-42" {
+		t.Errorf("Wrong metadata: %v", extras)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// bodySpill limits the memory used by the messages buffered with -tail-n.
+// Bodies are kept in memory until they add up to -buffer-limit bytes; the
+// bodies of the next messages are written to files in a temporary directory
+// and read back when the message is returned. A nil bodySpill keeps
+// everything in memory.
+type bodySpill struct {
+	limit    uint64
+	inMemory uint64
+	dir      string
+	files    uint
+}
+
+// bufferedMessage is a message held by the -tail-n ring buffer, with its
+// body either in msg.Body or in the file spillPath.
+type bufferedMessage struct {
+	msg       amqp091.Delivery
+	bodySize  int
+	spillPath string
+}
+
+func newBodySpill(limit uint64) *bodySpill {
+	if limit == 0 {
+		return nil
+	}
+	return &bodySpill{limit: limit}
+}
+
+// store buffers msg, spilling its body to disk if the limit is reached.
+func (s *bodySpill) store(msg amqp091.Delivery) (bufferedMessage, error) {
+	b := bufferedMessage{msg: msg, bodySize: len(msg.Body)}
+	if s == nil {
+		return b, nil
+	}
+	if s.inMemory+uint64(len(msg.Body)) <= s.limit {
+		s.inMemory += uint64(len(msg.Body))
+		return b, nil
+	}
+
+	if s.dir == "" {
+		dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-spill")
+		if err != nil {
+			return b, fmt.Errorf("Buffer limit: %s", err)
+		}
+		s.dir = dir
+		verboseLog(fmt.Sprintf("Buffered bodies exceed %d bytes, spilling to %s", s.limit, dir))
+	}
+	b.spillPath = path.Join(s.dir, fmt.Sprintf("body-%d", s.files))
+	s.files++
+	err := ioutil.WriteFile(b.spillPath, msg.Body, 0600)
+	if err != nil {
+		os.Remove(b.spillPath)
+		return b, fmt.Errorf("Buffer limit: %s", err)
+	}
+	b.msg.Body = nil
+	return b, nil
+}
+
+// load returns the buffered message with its body, which is no longer
+// counted in the buffer.
+func (s *bodySpill) load(b bufferedMessage) (amqp091.Delivery, error) {
+	if b.spillPath == "" {
+		s.release(b)
+		return b.msg, nil
+	}
+	body, err := ioutil.ReadFile(b.spillPath)
+	if err != nil {
+		return b.msg, fmt.Errorf("Buffer limit: %s", err)
+	}
+	os.Remove(b.spillPath)
+	b.msg.Body = body
+	return b.msg, nil
+}
+
+// release forgets a buffered message that won't be returned.
+func (s *bodySpill) release(b bufferedMessage) {
+	if s == nil {
+		return
+	}
+	if b.spillPath != "" {
+		os.Remove(b.spillPath)
+		return
+	}
+	s.inMemory -= uint64(b.bodySize)
+}
+
+// Close removes the spilled bodies that were not read back.
+func (s *bodySpill) Close() error {
+	if s == nil || s.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// dumpSummary accumulates the statistics printed at the end of a dump with
+// -summary.  A nil summary ignores them.
+type dumpSummary struct {
+	started time.Time
+	output  string
+	dumped  uint
+	bytes   uint64
+	skipped map[string]uint
+	ages    *messageAges
+}
+
+func newDumpSummary(output string) *dumpSummary {
+	s := &dumpSummary{
+		started: time.Now(),
+		output:  output,
+		skipped: make(map[string]uint),
+	}
+	if *ageStats {
+		s.ages = &messageAges{}
+	}
+	return s
+}
+
+// outputLocation describes where the messages of a dump are written.
+func outputLocation(outputDir string, db bool) string {
+	switch {
+	case *webhookURL != "":
+		return *webhookURL
+	case *outputCommand != "":
+		return fmt.Sprintf("command %q", *outputCommand)
+	case *kafkaBrokers != "":
+		return fmt.Sprintf("Kafka topic %q", *kafkaTopic)
+	case db && *splitEvery > 0 && *dbGzip:
+		return path.Join(outputDir, "dump-part-*.db.gz")
+	case db && *splitEvery > 0:
+		return path.Join(outputDir, "dump-part-*.db")
+	case db:
+		return path.Join(outputDir, "dump.db")
+	case isNamedPipe(outputDir):
+		return outputDir
+	case *output == "ndjson":
+		return ndjsonFilePath(outputDir)
+	case *output == "framed":
+		return framedFilePath(outputDir)
+	case *output == "zip":
+		return zipFilePath(outputDir)
+	case *output == "concat":
+		return concatFilePath(outputDir)
+	case *output == "html":
+		return htmlReportPath(outputDir)
+	default:
+		return outputDir
+	}
+}
+
+func (s *dumpSummary) saved(bodySize int) {
+	if s == nil {
+		return
+	}
+	s.dumped++
+	s.bytes += uint64(bodySize)
+}
+
+// received records the age of a dumped message with -age-stats.
+func (s *dumpSummary) received(timestamp time.Time, receivedAt time.Time) {
+	if s == nil {
+		return
+	}
+	s.ages.add(timestamp, receivedAt)
+}
+
+// saveFailed counts a message that was counted as saved but failed later, in
+// the background.
+func (s *dumpSummary) saveFailed() {
+	if s == nil {
+		return
+	}
+	s.dumped--
+	s.skip("failed")
+}
+
+func (s *dumpSummary) skip(reason string) {
+	if s == nil {
+		return
+	}
+	s.skipped[reason]++
+}
+
+// add counts the messages of other, the summary of another queue, in s.
+func (s *dumpSummary) add(other *dumpSummary) {
+	s.dumped += other.dumped
+	s.bytes += other.bytes
+	for reason, n := range other.skipped {
+		s.skipped[reason] += n
+	}
+	if s.ages != nil && other.ages != nil {
+		s.ages.ages = append(s.ages.ages, other.ages.ages...)
+		s.ages.missing += other.ages.missing
+	}
+}
+
+// writeQueuesSummary prints the -summary of a -queues-file dump: the
+// messages and bytes of each queue, then the totals of all of them.
+func writeQueuesSummary(w io.Writer, results []queueResult, output string, started time.Time, now time.Time) error {
+	total := newDumpSummary(output)
+	total.started = started
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		status := ""
+		if result.err != nil {
+			status = " (failed)"
+		}
+		if result.summary == nil {
+			fmt.Fprintf(tw, "Queue %q:\tfailed\n", result.queue)
+			continue
+		}
+		fmt.Fprintf(tw, "Queue %q:\t%d messages, %d bytes%s\n", result.queue, result.summary.dumped, result.summary.bytes, status)
+		total.add(result.summary)
+	}
+	total.writeRows(tw, now)
+	return tw.Flush()
+}
+
+// write prints the summary as an aligned table.
+func (s *dumpSummary) write(w io.Writer, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	s.writeRows(tw, now)
+	return tw.Flush()
+}
+
+func (s *dumpSummary) writeRows(tw io.Writer, now time.Time) {
+	duration := now.Sub(s.started)
+	rate := 0.0
+	if duration > 0 {
+		rate = float64(s.dumped) / duration.Seconds()
+	}
+
+	fmt.Fprintf(tw, "Messages dumped:\t%d\n", s.dumped)
+	reasons := make([]string, 0, len(s.skipped))
+	for reason := range s.skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(tw, "Skipped (%s):\t%d\n", reason, s.skipped[reason])
+	}
+	fmt.Fprintf(tw, "Bytes written:\t%d\n", s.bytes)
+	fmt.Fprintf(tw, "Duration:\t%s\n", duration.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Average rate:\t%.1f messages/s\n", rate)
+	if s.ages != nil {
+		fmt.Fprintf(tw, "Message age:\t%s\n", s.ages)
+	}
+	fmt.Fprintf(tw, "Output:\t%s\n", s.output)
+}
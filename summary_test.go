@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpSummary(t *testing.T) {
+	s := newDumpSummary("/tmp/dump")
+	s.started = time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		s.saved(100)
+	}
+	s.skip("filtered out")
+	s.skip("filtered out")
+	s.skip("failed")
+
+	var out bytes.Buffer
+	err := s.write(&out, s.started.Add(2*time.Second))
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	expected := "" +
+		"Messages dumped:         50\n" +
+		"Skipped (failed):        1\n" +
+		"Skipped (filtered out):  2\n" +
+		"Bytes written:           5000\n" +
+		"Duration:                2s\n" +
+		"Average rate:            25.0 messages/s\n" +
+		"Output:                  /tmp/dump\n"
+	if out.String() != expected {
+		t.Errorf("Wrong summary: expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestWriteQueuesSummary(t *testing.T) {
+	started := time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	var results []queueResult
+	for i, queueName := range []string{"incoming_1", "incoming_2"} {
+		s := newDumpSummary("/tmp/dump/" + queueName)
+		for j := 0; j <= i; j++ {
+			s.saved(100)
+		}
+		s.skip("filtered out")
+		results = append(results, queueResult{queue: queueName, summary: s})
+	}
+	results = append(results, queueResult{queue: "missing", err: errors.New("queue not found")})
+
+	var out bytes.Buffer
+	err := writeQueuesSummary(&out, results, "/tmp/dump", started, started.Add(time.Second))
+	if err != nil {
+		t.Fatalf("writeQueuesSummary: %s", err)
+	}
+	expected := "" +
+		"Queue \"incoming_1\":      1 messages, 100 bytes\n" +
+		"Queue \"incoming_2\":      2 messages, 200 bytes\n" +
+		"Queue \"missing\":         failed\n" +
+		"Messages dumped:         3\n" +
+		"Skipped (filtered out):  2\n" +
+		"Bytes written:           300\n" +
+		"Duration:                1s\n" +
+		"Average rate:            3.0 messages/s\n" +
+		"Output:                  /tmp/dump\n"
+	if out.String() != expected {
+		t.Errorf("Wrong summary: expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestDumpSummaryNil(t *testing.T) {
+	var s *dumpSummary
+	s.saved(100)
+	s.skip("filtered out")
+}
+
+func TestOutputLocation(t *testing.T) {
+	if location := outputLocation("/tmp/dump", true); location != "/tmp/dump/dump.db" {
+		t.Errorf("Wrong db location: %s", location)
+	}
+	*output = "ndjson"
+	defer func() { *output = "files" }()
+	if location := outputLocation("/tmp/dump", false); !strings.HasSuffix(location, ".ndjson") {
+		t.Errorf("Wrong ndjson location: %s", location)
+	}
+}
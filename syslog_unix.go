@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "log/syslog"
+
+// openSyslog connects to the syslog daemon at address over network, or to
+// the local one when network is empty.
+func openSyslog(network, address string) (eventLogger, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_USER, "rabbitmq-dump-queue")
+}
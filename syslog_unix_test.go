@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	logger, err := openSyslog("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("openSyslog: %s", err)
+	}
+	err = logger.Warning("Message 3 failed: disk full")
+	if err != nil {
+		t.Fatalf("Warning: %s", err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	// <12> is the warning severity (4) of the user facility (1 * 8).
+	line := string(buf[:n])
+	if !strings.HasPrefix(line, "<12>") || !strings.Contains(line, "rabbitmq-dump-queue") || !strings.HasSuffix(strings.TrimSpace(line), "Message 3 failed: disk full") {
+		t.Errorf("Wrong syslog line: %q", line)
+	}
+}
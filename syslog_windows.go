@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "fmt"
+
+func openSyslog(network, address string) (eventLogger, error) {
+	return nil, fmt.Errorf("-syslog is not supported on Windows")
+}
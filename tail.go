@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// lastMessages wraps fetch so that it returns only the last n messages of
+// the queue.  The first call reads the whole queue, keeping the n most recent
+// messages in a ring buffer; the dropped messages stay un-acked and are
+// requeued when the connection closes.  With ackScanned every message is
+// acked as soon as it is read, which stream consumers need to keep receiving
+// messages, and the returned messages can't be acked again.  The bodies
+// beyond the limit of spill are kept on disk.  The messages are returned in
+// queue order, or reordered according to order (see reorder).
+func lastMessages(fetch fetchFunc, n uint, ackScanned bool, spill *bodySpill, order string) fetchFunc {
+	var ring []bufferedMessage
+	var positions []int
+	var next, start uint
+	scanned := false
+	return func() (amqp091.Delivery, bool, error) {
+		if !scanned {
+			ring = make([]bufferedMessage, 0, n)
+			for {
+				msg, ok, err := fetch()
+				if err != nil {
+					return msg, false, err
+				}
+				if !ok {
+					break
+				}
+				if ackScanned {
+					err = msg.Ack(false)
+					if err != nil {
+						return msg, false, err
+					}
+					msg.Acknowledger = ackedMessage{}
+				}
+				if uint(len(ring)) == n {
+					spill.release(ring[start])
+				}
+				buffered, err := spill.store(msg)
+				if err != nil {
+					return msg, false, err
+				}
+				if uint(len(ring)) < n {
+					ring = append(ring, buffered)
+				} else {
+					ring[start] = buffered
+					start = (start + 1) % n
+				}
+			}
+			scanned = true
+			verboseLog("Reached the end of the queue")
+			positions = make([]int, len(ring))
+			for i := range positions {
+				positions[i] = int((start + uint(i)) % uint(len(ring)))
+			}
+			reorder(positions, order)
+		}
+		if next >= uint(len(ring)) {
+			return amqp091.Delivery{}, false, nil
+		}
+		msg, err := spill.load(ring[positions[next]])
+		if err != nil {
+			return msg, false, err
+		}
+		next++
+		return msg, true, nil
+	}
+}
+
+// shuffleRand is the source of -order=shuffle.
+var shuffleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// reorder sorts the buffered messages for -order: fifo keeps them in queue
+// order, reverse returns the newest first and shuffle in random order.
+func reorder(positions []int, order string) {
+	switch order {
+	case "reverse":
+		for i, j := 0, len(positions)-1; i < j; i, j = i+1, j-1 {
+			positions[i], positions[j] = positions[j], positions[i]
+		}
+	case "shuffle":
+		shuffleRand.Shuffle(len(positions), func(i, j int) {
+			positions[i], positions[j] = positions[j], positions[i]
+		})
+	}
+}
+
+// ackedMessage is the Acknowledger of messages that were already acked.
+type ackedMessage struct{}
+
+func (ackedMessage) Ack(tag uint64, multiple bool) error                { return nil }
+func (ackedMessage) Nack(tag uint64, multiple bool, requeue bool) error { return nil }
+func (ackedMessage) Reject(tag uint64, requeue bool) error              { return nil }
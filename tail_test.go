@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"sort"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// testFetch returns a fetchFunc returning the given number of messages.
+func testFetch(count int) fetchFunc {
+	i := 0
+	return func() (amqp091.Delivery, bool, error) {
+		if i >= count {
+			return amqp091.Delivery{}, false, nil
+		}
+		i++
+		return amqp091.Delivery{Body: []byte(fmt.Sprint(i))}, true, nil
+	}
+}
+
+func TestLastMessages(t *testing.T) {
+	tests := []struct {
+		count    int
+		n        uint
+		expected string
+	}{
+		{10, 3, "[8 9 10]"},
+		{3, 3, "[1 2 3]"},
+		{2, 5, "[1 2]"},
+		{0, 5, "[]"},
+	}
+	for _, test := range tests {
+		bodies, err := fetchAll(lastMessages(testFetch(test.count), test.n, false, nil, "fifo"))
+		if err != nil {
+			t.Fatalf("fetch: %s", err)
+		}
+		if got := fmt.Sprint(bodies); got != test.expected {
+			t.Errorf("Last %d of %d messages: expected %s, got %s", test.n, test.count, test.expected, got)
+		}
+	}
+}
+
+func TestLastMessagesOrder(t *testing.T) {
+	for order, expected := range map[string]string{
+		"fifo":    "[6 7 8 9 10]",
+		"reverse": "[10 9 8 7 6]",
+	} {
+		bodies, err := fetchAll(lastMessages(testFetch(10), 5, false, nil, order))
+		if err != nil {
+			t.Fatalf("fetch: %s", err)
+		}
+		if got := fmt.Sprint(bodies); got != expected {
+			t.Errorf("Order %s: expected %s, got %s", order, expected, got)
+		}
+	}
+
+	shuffleRand = rand.New(rand.NewSource(1))
+	bodies, err := fetchAll(lastMessages(testFetch(10), 5, false, nil, "shuffle"))
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	shuffled := fmt.Sprint(bodies)
+	sort.Strings(bodies)
+	if shuffled == "[6 7 8 9 10]" || fmt.Sprint(bodies) != "[10 6 7 8 9]" {
+		t.Errorf("Expected the last 5 messages in another order, got %s", shuffled)
+	}
+}
+
+func TestLastMessagesSpill(t *testing.T) {
+	// Bodies "1" to "20": only the first 4 bytes of the buffered bodies stay
+	// in memory.
+	spill := newBodySpill(4)
+	defer spill.Close()
+	fetch := lastMessages(testFetch(20), 5, false, spill, "fifo")
+
+	msg, ok, err := fetch()
+	if err != nil || !ok {
+		t.Fatalf("fetch: %v %s", ok, err)
+	}
+	if string(msg.Body) != "16" {
+		t.Errorf("Wrong first message: %q", msg.Body)
+	}
+	if spill.dir == "" {
+		t.Fatalf("Expected bodies to be spilled to disk")
+	}
+	// The ring holds 5 messages, two of them in memory; the spilled bodies
+	// of dropped messages must have been removed.
+	entries, err := ioutil.ReadDir(spill.dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 spilled bodies left, got %d", len(entries))
+	}
+
+	bodies, err := fetchAll(fetch)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if got := fmt.Sprint(bodies); got != "[17 18 19 20]" {
+		t.Errorf("Wrong messages: %s", got)
+	}
+
+	dir := spill.dir
+	err = spill.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the spill directory to be removed: %v", err)
+	}
+}
+
+func TestTailClassicQueue(t *testing.T) {
+	populateTestQueue(t, 10)
+	defer deleteTestQueue(t)
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	output := run(t, "-uri="+testAmqpURI+" -queue="+testQueueName+" -tail-n=3 -output-dir=tmp-test")
+	expectedOutput := "tmp-test/msg-0000\n" +
+		"tmp-test/msg-0001\n" +
+		"tmp-test/msg-0002\n"
+	if output != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0000", "message-7-body")
+	verifyFileContent(t, "tmp-test/msg-0002", "message-9-body")
+}
+
+func TestTailStreamQueue(t *testing.T) {
+	conn := dialTestBroker(t)
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel: %s", err)
+	}
+
+	_, err = channel.QueueDeclare(testStreamName, true, false, false, false, amqp091.Table{"x-queue-type": "stream"})
+	if err != nil {
+		t.Skipf("Stream queues not supported by the broker: %s", err)
+	}
+
+	defer func() {
+		channel, err := conn.Channel()
+		if err == nil {
+			channel.QueueDelete(testStreamName, false, false, false)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		err = channel.Publish("", testStreamName, false, false, makeAmqpMessage(i))
+		if err != nil {
+			t.Fatalf("Publish: %s", err)
+		}
+	}
+
+	os.MkdirAll("tmp-test", 0775)
+	defer os.RemoveAll("tmp-test")
+	output, err := exec.Command("./rabbitmq-dump-queue", "-uri="+testAmqpURI, "-queue="+testStreamName, "-consume", "-stream-offset=first", "-idle-timeout=1s", "-tail-n=2", "-output-dir=tmp-test").CombinedOutput()
+	if err != nil {
+		t.Fatalf("run: %s: %s", err, string(output))
+	}
+	expectedOutput := "tmp-test/msg-0000\n" +
+		"tmp-test/msg-0001\n"
+	if string(output) != expectedOutput {
+		t.Errorf("Wrong output: expected '%s' but got '%s'", expectedOutput, output)
+	}
+	verifyFileContent(t, "tmp-test/msg-0000", "message-3-body")
+	verifyFileContent(t, "tmp-test/msg-0001", "message-4-body")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// isAllowedHostname reports whether host is listed in -tls-allowed-hostnames.
+func isAllowedHostname(host string) bool {
+	for _, allowed := range strings.Split(*tlsAllowedHosts, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHostnameMismatch replaces the certificate verification of tlsConfig
+// with verifyCertificateChain, which checks the certificate chain against
+// the configured CAs like the standard verification but doesn't require the
+// certificate to be issued for the broker's hostname.
+func allowHostnameMismatch(tlsConfig *tls.Config) {
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = verifyCertificateChain(tlsConfig.RootCAs)
+}
+
+// verifyCertificateChain returns a VerifyPeerCertificate callback checking
+// that the broker's certificate chains up to roots (the system CAs when nil),
+// ignoring its CN and SANs.
+func verifyCertificateChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("TLS: the broker sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("TLS: broker certificate: %s", err)
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("TLS: broker certificate: %s", err)
+		}
+		return nil
+	}
+}
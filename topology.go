@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const topologyFileName = "topology.json"
+
+// queueTopology is the declaration of a dumped queue and its bindings, so
+// that -restore-topology can recreate the queue before republishing.
+type queueTopology struct {
+	Queue      string                 `json:"queue"`
+	Vhost      string                 `json:"vhost"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Arguments  map[string]interface{} `json:"arguments"`
+	Bindings   []topologyBinding      `json:"bindings"`
+}
+
+// topologyBinding binds the queue to the Source exchange.
+type topologyBinding struct {
+	Source     string                 `json:"source"`
+	RoutingKey string                 `json:"routing_key"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// managementBinding is the subset of the management HTTP API binding object
+// that we use.
+type managementBinding struct {
+	Source          string                 `json:"source"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// fetchTopology reads the declaration and bindings of a queue from the
+// management HTTP API. The implicit binding of every queue to the default
+// exchange is left out.
+func fetchTopology(managementURL string, amqpURI string, queueName string) (*queueTopology, error) {
+	uri, err := amqp091.ParseURI(amqpURI)
+	if err != nil {
+		return nil, err
+	}
+	queuePath := "/api/queues/" + url.PathEscape(uri.Vhost) + "/" + url.PathEscape(queueName)
+
+	var queue struct {
+		Name       string                 `json:"name"`
+		Vhost      string                 `json:"vhost"`
+		Durable    bool                   `json:"durable"`
+		AutoDelete bool                   `json:"auto_delete"`
+		Arguments  map[string]interface{} `json:"arguments"`
+	}
+	err = getManagementJSON(managementURL, uri, queuePath, &queue)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []managementBinding
+	err = getManagementJSON(managementURL, uri, queuePath+"/bindings", &bindings)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &queueTopology{
+		Queue:      queue.Name,
+		Vhost:      queue.Vhost,
+		Durable:    queue.Durable,
+		AutoDelete: queue.AutoDelete,
+		Arguments:  convertJSONNumbers(nonNilMap(queue.Arguments)).(map[string]interface{}),
+		Bindings:   []topologyBinding{},
+	}
+	for _, b := range bindings {
+		if b.Source == "" || b.DestinationType != "queue" {
+			continue
+		}
+		t.Bindings = append(t.Bindings, topologyBinding{
+			Source:     b.Source,
+			RoutingKey: b.RoutingKey,
+			Arguments:  convertJSONNumbers(nonNilMap(b.Arguments)).(map[string]interface{}),
+		})
+	}
+	return t, nil
+}
+
+func nonNilMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
+
+func writeTopology(outputDir string, t *queueTopology) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path.Join(outputDir, topologyFileName), append(data, '\n'))
+}
+
+// readTopology reads the topology.json of a dump. Integer arguments such as
+// x-max-length are kept as integers, since RabbitMQ refuses them as floats.
+func readTopology(outputDir string) (*queueTopology, error) {
+	data, err := ioutil.ReadFile(path.Join(outputDir, topologyFileName))
+	if err != nil {
+		return nil, err
+	}
+	var t queueTopology
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	t.Arguments = convertJSONNumbers(nonNilMap(t.Arguments)).(map[string]interface{})
+	for i := range t.Bindings {
+		t.Bindings[i].Arguments = convertJSONNumbers(nonNilMap(t.Bindings[i].Arguments)).(map[string]interface{})
+	}
+	return &t, nil
+}
+
+// declareTopology declares queueName with the durability and arguments of
+// t and binds it like the dumped queue. The exchanges must already exist.
+func declareTopology(channel *amqp091.Channel, queueName string, t *queueTopology) error {
+	_, err := channel.QueueDeclare(queueName, t.Durable, t.AutoDelete, false, false, amqp091.Table(t.Arguments))
+	if err != nil {
+		return fmt.Errorf("Queue declare: %s", err)
+	}
+	for _, b := range t.Bindings {
+		err = channel.QueueBind(queueName, b.RoutingKey, b.Source, false, amqp091.Table(b.Arguments))
+		if err != nil {
+			return fmt.Errorf("Queue bind to exchange %q: %s", b.Source, err)
+		}
+	}
+	verboseLog(fmt.Sprintf("Declared queue %q with %d bindings", queueName, len(t.Bindings)))
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	gzipSuffix                = ".gz"
+	metadataFileSuffix        = "-headers+properties.json"
+	yamlMetadataFileSuffix    = "-headers+properties.yaml"
+	msgpackMetadataFileSuffix = "-headers+properties.msgpack"
+)
+
+// metadataFormats are the -headers-format values, in the order in which
+// loadDumpedMessage looks for their headers+properties file.
+var metadataFormats = []string{"json", "yaml", "msgpack"}
+
+// timestampLayout matches the format produced by time.Time.String(), which is
+// how getProperties writes the timestamp property.
+const timestampLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+var (
+	bodyFileRegexp     = regexp.MustCompile(`^msg-(\d+)(\.eml)?(\.gz)?$`)
+	metadataFileRegexp = regexp.MustCompile(`^(msg-\d+(?:\.eml)?)(?:` + regexp.QuoteMeta(metadataFileSuffix) + `|` +
+		regexp.QuoteMeta(yamlMetadataFileSuffix) + `|` + regexp.QuoteMeta(msgpackMetadataFileSuffix) + `)(?:\.gz)?$`)
+	partitionDirRegexp = regexp.MustCompile(`^part-\d+$`)
+)
+
+// dumpedMessage is a message read back from a dump directory.
+type dumpedMessage struct {
+	Counter      uint
+	BodyPath     string
+	MetadataPath string
+	Exchange     string
+	RoutingKey   string
+	Publishing   amqp091.Publishing
+	// ReceivedAt is when the dump got the message, if recorded.
+	ReceivedAt time.Time
+}
+
+// findDumpedMessages lists the message body files in outputDir, including
+// its -split-every subdirectories and the files listed in its filename
+// index, ordered by counter. Metadata files without a corresponding body
+// file are returned separately as orphans.
+func findDumpedMessages(outputDir string) ([]dumpedMessage, []string, error) {
+	messages, orphans, err := findDumpedMessagesInDir(outputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	named, err := readFilenameIndex(outputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages = append(messages, named...)
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Counter < messages[j].Counter })
+	return messages, orphans, nil
+}
+
+func findDumpedMessagesInDir(outputDir string) ([]dumpedMessage, []string, error) {
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bodies := make(map[string]bool)
+	var messages []dumpedMessage
+	var metadataFiles []string
+	var orphans []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if partitionDirRegexp.MatchString(entry.Name()) {
+				partMessages, partOrphans, err := findDumpedMessagesInDir(path.Join(outputDir, entry.Name()))
+				if err != nil {
+					return nil, nil, err
+				}
+				messages = append(messages, partMessages...)
+				orphans = append(orphans, partOrphans...)
+			}
+			continue
+		}
+		name := entry.Name()
+		if m := bodyFileRegexp.FindStringSubmatch(name); m != nil {
+			counter, err := strconv.ParseUint(m[1], 10, 0)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", name, err)
+			}
+			bodies[strings.TrimSuffix(name, gzipSuffix)] = true
+			messages = append(messages, dumpedMessage{
+				Counter:  uint(counter),
+				BodyPath: path.Join(outputDir, name),
+			})
+		} else if metadataFileRegexp.MatchString(name) {
+			metadataFiles = append(metadataFiles, name)
+		}
+	}
+
+	for _, name := range metadataFiles {
+		bodyName := metadataFileRegexp.FindStringSubmatch(name)[1]
+		if !bodies[bodyName] {
+			orphans = append(orphans, path.Join(outputDir, name))
+		}
+	}
+	return messages, orphans, nil
+}
+
+// loadDumpedMessage reads the body and, if present, the headers+properties
+// file of a dumped message in any -headers-format and reconstructs the
+// corresponding Publishing. Either file may have been compressed after the
+// dump, e.g. with gzip -r, and is then decompressed.
+func loadDumpedMessage(msg *dumpedMessage) error {
+	body, err := readDumpFile(msg.BodyPath)
+	if err != nil {
+		return err
+	}
+	msg.Publishing.Body = body
+
+	bodyPath := strings.TrimSuffix(msg.BodyPath, gzipSuffix)
+	for _, format := range metadataFormats {
+		metadataPath := bodyPath + metadataSuffixFor(format)
+		data, err := readDumpFile(metadataPath)
+		if os.IsNotExist(err) {
+			metadataPath += gzipSuffix
+			data, err = readDumpFile(metadataPath)
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msg.MetadataPath = metadataPath
+
+		if format != "json" {
+			data, err = metadataToJSON(format, data)
+		}
+		if err == nil {
+			err = applyMetadata(msg, data)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", metadataPath, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// metadataToJSON converts a YAML or msgpack headers+properties file to the
+// JSON read by applyMetadata, so that every -headers-format is restored the
+// same way.
+func metadataToJSON(format string, data []byte) ([]byte, error) {
+	var metadata map[string]interface{}
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &metadata)
+	case "msgpack":
+		err = msgpack.Unmarshal(data, &metadata)
+	default:
+		return nil, fmt.Errorf("unknown headers format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(metadata)
+}
+
+// readDumpFile reads a body or headers+properties file of a dump,
+// decompressing it if its name ends with .gz.
+func readDumpFile(filePath string) ([]byte, error) {
+	if !strings.HasSuffix(filePath, gzipSuffix) {
+		return ioutil.ReadFile(filePath)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// applyMetadata fills in the Publishing, exchange and routing key of msg from
+// the headers+properties JSON written by getExtras.
+func applyMetadata(msg *dumpedMessage, data []byte) error {
+	var metadata map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&metadata)
+	if err != nil {
+		return err
+	}
+
+	// Files written with -json-root=flat have the properties at the top
+	// level instead of under a "properties" key, next to the headers and
+	// the -sequence fields.
+	properties := make(map[string]interface{})
+	if nested, ok := metadata["properties"]; ok {
+		properties, ok = nested.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("wrong data type for 'properties'")
+		}
+	} else {
+		for k, v := range metadata {
+			switch k {
+			case "headers", "seq", "total":
+			default:
+				properties[k] = v
+			}
+		}
+	}
+
+	err = applyProperties(msg, properties)
+	if err != nil {
+		return err
+	}
+
+	if metadata["headers"] != nil {
+		headers, ok := convertJSONNumbers(metadata["headers"]).(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("wrong data type for 'headers'")
+		}
+		msg.Publishing.Headers = amqp091.Table(headers)
+		err = msg.Publishing.Headers.Validate()
+		if err != nil {
+			return fmt.Errorf("headers: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// applyProperties fills in the Publishing fields of msg from the properties
+// map written by getProperties.
+func applyProperties(msg *dumpedMessage, props map[string]interface{}) error {
+	p := &msg.Publishing
+	stringFields := map[string]*string{
+		"app_id":           &p.AppId,
+		"content_encoding": &p.ContentEncoding,
+		"content_type":     &p.ContentType,
+		"correlation_id":   &p.CorrelationId,
+		"expiration":       &p.Expiration,
+		"message_id":       &p.MessageId,
+		"reply_to":         &p.ReplyTo,
+		"type":             &p.Type,
+		"user_id":          &p.UserId,
+		"exchange":         &msg.Exchange,
+		"routing_key":      &msg.RoutingKey,
+	}
+
+	for key, value := range props {
+		if field, ok := stringFields[key]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("property %q: expected a string but got %v", key, value)
+			}
+			*field = s
+			continue
+		}
+
+		switch key {
+		case "delivery_mode":
+			n, err := propertyUint8(value)
+			if err != nil || n > amqp091.Persistent {
+				return fmt.Errorf("property %q: invalid delivery mode %v", key, value)
+			}
+			p.DeliveryMode = n
+		case "priority":
+			// AMQP allows 0-255; the broker caps it to the queue's
+			// x-max-priority when publishing.
+			n, err := propertyUint8(value)
+			if err != nil {
+				return fmt.Errorf("property %q: invalid priority %v", key, value)
+			}
+			p.Priority = n
+		case "timestamp":
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("property %q: expected a string but got %v", key, value)
+			}
+			ts, err := time.Parse(timestampLayout, s)
+			if err != nil {
+				return fmt.Errorf("property %q: %s", key, err)
+			}
+			p.Timestamp = ts
+		case "received_at":
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("property %q: expected a string but got %v", key, value)
+			}
+			receivedAt, err := time.Parse(timestampLayout, s)
+			if err != nil {
+				return fmt.Errorf("property %q: %s", key, err)
+			}
+			msg.ReceivedAt = receivedAt
+		case "expiration_ms", "expires_at":
+			// Derived from the expiration property when dumping.
+		default:
+			return fmt.Errorf("unknown property %q", key)
+		}
+	}
+
+	return nil
+}
+
+// propertyUint8 accepts both JSON numbers and numeric strings (as written with
+// -numbers-as-strings).
+func propertyUint8(value interface{}) (uint8, error) {
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return 0, fmt.Errorf("expected a number but got %v", value)
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	return uint8(n), err
+}
+
+// convertJSONNumbers replaces json.Number values with int64 when they are
+// integers and with float64 otherwise, so that they are valid AMQP table
+// values.
+func convertJSONNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = convertJSONNumbers(item)
+		}
+		return t
+	case []interface{}:
+		for i, item := range t {
+			t[i] = convertJSONNumbers(item)
+		}
+		return t
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	default:
+		return v
+	}
+}
+
+// verifyDump checks that every message in a dump directory can be read and
+// turned back into a valid Publishing, without connecting to the broker.
+func verifyDump(outputDir string) error {
+	messages, orphans, err := findDumpedMessages(outputDir)
+	if err != nil {
+		return fmt.Errorf("Verify: %s", err)
+	}
+
+	errorLog, err := openErrorFile(*errorFile)
+	if err != nil {
+		return fmt.Errorf("Error file: %s", err)
+	}
+	defer errorLog.Close()
+
+	failures := 0
+	for _, orphan := range orphans {
+		warningLog("%s: no matching message body file", orphan)
+		failures++
+	}
+
+	for i := range messages {
+		err = loadDumpedMessage(&messages[i])
+		if err != nil {
+			warningLog("%s: %s", messages[i].BodyPath, err)
+			failures++
+			if errorLog != nil {
+				err = errorLog.record(messages[i].Counter, messages[i].Publishing.MessageId, err)
+				if err != nil {
+					return fmt.Errorf("Error file: %s", err)
+				}
+			}
+			continue
+		}
+		verboseLog(fmt.Sprintf("%s: OK", messages[i].BodyPath))
+	}
+
+	verboseLog(fmt.Sprintf("Verified %d messages", len(messages)))
+	if failures > 0 {
+		return fmt.Errorf("Verify: %d problems found in %q", failures, outputDir)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func writeTestDump(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-verify")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		publishing := makeAmqpMessage(i)
+		msg := amqp091.Delivery{
+			Headers:      publishing.Headers,
+			ContentType:  publishing.ContentType,
+			Priority:     publishing.Priority,
+			MessageId:    publishing.MessageId,
+			DeliveryMode: amqp091.Persistent,
+			Timestamp:    time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC),
+			Body:         publishing.Body,
+		}
+		err = ioutil.WriteFile(generateFilePath(dir, uint(i)), msg.Body, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		err = savePropsAndHeadersToFile(msg, generateFilePath(dir, uint(i)), uint(i))
+		if err != nil {
+			t.Fatalf("savePropsAndHeadersToFile: %s", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadDumpedMessages(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	messages, orphans, err := findDumpedMessages(dir)
+	if err != nil {
+		t.Fatalf("findDumpedMessages: %s", err)
+	}
+	if len(messages) != 3 || len(orphans) != 0 {
+		t.Fatalf("Expected 3 messages and no orphans, got %d and %v", len(messages), orphans)
+	}
+
+	msg := messages[1]
+	err = loadDumpedMessage(&msg)
+	if err != nil {
+		t.Fatalf("loadDumpedMessage: %s", err)
+	}
+	p := msg.Publishing
+	if string(p.Body) != "message-1-body" ||
+		p.MessageId != "msgid-1" ||
+		p.ContentType != "text/plain" ||
+		p.Priority != 4 ||
+		p.DeliveryMode != amqp091.Persistent ||
+		!p.Timestamp.Equal(time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)) {
+		t.Errorf("Wrong publishing: %#v", p)
+	}
+	if p.Headers["my-header"] != "my-value-1" {
+		t.Errorf("Wrong header value: headers = %#v", p.Headers)
+	}
+}
+
+// gzipDumpFiles compresses every file of a dump directory in place, like
+// gzip -r does.
+func gzipDumpFiles(t *testing.T, dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	for _, entry := range entries {
+		filePath := path.Join(dir, entry.Name())
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(data)
+		writer.Close()
+		err = ioutil.WriteFile(filePath+".gz", compressed.Bytes(), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		os.Remove(filePath)
+	}
+}
+
+func TestLoadGzippedDump(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+	gzipDumpFiles(t, dir)
+
+	messages, orphans, err := findDumpedMessages(dir)
+	if err != nil {
+		t.Fatalf("findDumpedMessages: %s", err)
+	}
+	if len(messages) != 3 || len(orphans) != 0 {
+		t.Fatalf("Expected 3 messages and no orphans, got %d and %v", len(messages), orphans)
+	}
+
+	msg := messages[1]
+	err = loadDumpedMessage(&msg)
+	if err != nil {
+		t.Fatalf("loadDumpedMessage: %s", err)
+	}
+	if msg.BodyPath != path.Join(dir, "msg-0001.gz") || msg.MetadataPath != path.Join(dir, "msg-0001"+metadataFileSuffix+".gz") {
+		t.Errorf("Wrong files: %s and %s", msg.BodyPath, msg.MetadataPath)
+	}
+	p := msg.Publishing
+	if string(p.Body) != "message-1-body" || p.MessageId != "msgid-1" || p.Headers["my-header"] != "my-value-1" {
+		t.Errorf("Wrong publishing: %#v", p)
+	}
+
+	err = verifyDump(dir)
+	if err != nil {
+		t.Errorf("Expected the gzipped dump to verify, got: %s", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "msg-0002.gz"), []byte("not gzip"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = verifyDump(dir)
+	if err == nil {
+		t.Errorf("Expected verification of a corrupted gzip file to fail")
+	}
+}
+
+func TestVerifyValidDump(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := verifyDump(dir)
+	if err != nil {
+		t.Errorf("Expected dump to verify, got: %s", err)
+	}
+}
+
+func TestVerifyCorruptedSidecar(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(path.Join(dir, "msg-0001"+metadataFileSuffix), []byte(`{"properties": {`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	err = verifyDump(dir)
+	if err == nil {
+		t.Errorf("Expected verification of a corrupted sidecar to fail")
+	}
+}
+
+func TestVerifyInvalidProperty(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(path.Join(dir, "msg-0002"+metadataFileSuffix), []byte(`{"properties": {"priority": 300}, "headers": {}}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	err = verifyDump(dir)
+	if err == nil {
+		t.Errorf("Expected verification of an invalid priority to fail")
+	}
+}
+
+func TestVerifyPriorityAboveNine(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(path.Join(dir, "msg-0002"+metadataFileSuffix), []byte(`{"properties": {"priority": 42}, "headers": {}}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	err = verifyDump(dir)
+	if err != nil {
+		t.Errorf("Expected priority 42 to be valid: %s", err)
+	}
+}
+
+func TestLoadDumpedMessageHeadersFormats(t *testing.T) {
+	defer func() { *headersFormat = "json" }()
+	for _, format := range metadataFormats {
+		*headersFormat = format
+		dir := writeTestDump(t)
+		defer os.RemoveAll(dir)
+
+		messages, orphans, err := findDumpedMessages(dir)
+		if err != nil || len(messages) != 3 || len(orphans) != 0 {
+			t.Fatalf("%s: expected 3 messages and no orphans, got %d and %v (%v)", format, len(messages), orphans, err)
+		}
+		msg := messages[1]
+		err = loadDumpedMessage(&msg)
+		if err != nil {
+			t.Fatalf("%s: loadDumpedMessage: %s", format, err)
+		}
+		p := msg.Publishing
+		if msg.MetadataPath != generateFilePath(dir, 1)+metadataSuffixFor(format) ||
+			p.Priority != 4 ||
+			p.DeliveryMode != amqp091.Persistent ||
+			!p.Timestamp.Equal(time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)) ||
+			p.Headers["my-header"] != "my-value-1" {
+			t.Errorf("%s: wrong message loaded from %s: %#v", format, msg.MetadataPath, p)
+		}
+
+		err = os.Remove(generateFilePath(dir, 0))
+		if err != nil {
+			t.Fatalf("Remove: %s", err)
+		}
+		_, orphans, err = findDumpedMessages(dir)
+		if err != nil || len(orphans) != 1 || orphans[0] != generateFilePath(dir, 0)+metadataSuffixFor(format) {
+			t.Errorf("%s: expected the sidecar of the removed body to be an orphan, got %v (%v)", format, orphans, err)
+		}
+	}
+}
+
+func TestVerifyOrphanSidecar(t *testing.T) {
+	dir := writeTestDump(t)
+	defer os.RemoveAll(dir)
+
+	err := os.Remove(path.Join(dir, "msg-0000"))
+	if err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+
+	err = verifyDump(dir)
+	if err == nil {
+		t.Errorf("Expected verification of a sidecar without body to fail")
+	}
+}
+
+func TestLoadFlatDumpedMessage(t *testing.T) {
+	*jsonRoot = "flat"
+	dir := writeTestDump(t)
+	*jsonRoot = "nested"
+	defer os.RemoveAll(dir)
+
+	msg := dumpedMessage{BodyPath: generateFilePath(dir, 2)}
+	err := loadDumpedMessage(&msg)
+	if err != nil {
+		t.Fatalf("loadDumpedMessage: %s", err)
+	}
+	if msg.Publishing.MessageId != "msgid-2" || msg.Publishing.Headers["my-header"] != "my-value-2" {
+		t.Errorf("Wrong publishing: %#v", msg.Publishing)
+	}
+}
+
+func TestZeroAndEmptyPropertiesRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-verify")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := amqp091.Delivery{
+		Headers:       amqp091.Table{"my-header": "my-value"},
+		Priority:      0,
+		CorrelationId: "",
+		ContentType:   "text/plain",
+		Body:          []byte("body"),
+	}
+	err = ioutil.WriteFile(generateFilePath(dir, 0), msg.Body, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = savePropsAndHeadersToFile(msg, generateFilePath(dir, 0), 0)
+	if err != nil {
+		t.Fatalf("savePropsAndHeadersToFile: %s", err)
+	}
+
+	_, properties := getMetadataFromFile(t, generateFilePath(dir, 0)+metadataFileSuffix)
+	if properties["priority"] != 0.0 || properties["delivery_mode"] != 0.0 {
+		t.Errorf("Expected zero priority and delivery_mode to be kept: %#v", properties)
+	}
+
+	restored := dumpedMessage{BodyPath: generateFilePath(dir, 0)}
+	err = loadDumpedMessage(&restored)
+	if err != nil {
+		t.Fatalf("loadDumpedMessage: %s", err)
+	}
+	p := restored.Publishing
+	if p.Priority != 0 || p.CorrelationId != "" || p.ContentType != "text/plain" || string(p.Body) != "body" {
+		t.Errorf("Wrong restored publishing: %#v", p)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func bodyChecksum(body []byte) string {
+	// Reading from memory can't fail.
+	sum, _ := hashReader(bytes.NewReader(body))
+	return sum
+}
+
+// fetchChecksums reads every message of a queue with fetch, without
+// acknowledging them, and returns the checksums of their bodies.  The
+// messages return to the queue when the channel is closed.
+func fetchChecksums(fetch fetchFunc) ([]string, error) {
+	var checksums []string
+	for {
+		msg, ok, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return checksums, nil
+		}
+		checksums = append(checksums, bodyChecksum(msg.Body))
+	}
+}
+
+// compareRestore compares the bodies of the restored messages to the
+// checksums of the messages found in the destination queue, and describes
+// each body that is missing from the queue or that the queue has more often
+// than the dump.  Messages are compared as a multiset, since the broker may
+// reorder them, e.g. by priority.
+func compareRestore(messages []dumpedMessage, restored []string) []string {
+	counts := make(map[string]int)
+	files := make(map[string][]string)
+	for _, msg := range messages {
+		checksum := bodyChecksum(msg.Publishing.Body)
+		counts[checksum]++
+		files[checksum] = append(files[checksum], msg.BodyPath)
+	}
+	for _, checksum := range restored {
+		counts[checksum]--
+	}
+
+	var discrepancies []string
+	if len(messages) != len(restored) {
+		discrepancies = append(discrepancies, fmt.Sprintf("%d messages in the dump, %d in the destination queue", len(messages), len(restored)))
+	}
+	var checksums []string
+	for checksum := range counts {
+		checksums = append(checksums, checksum)
+	}
+	sort.Strings(checksums)
+	for _, checksum := range checksums {
+		switch n := counts[checksum]; {
+		case n > 0:
+			discrepancies = append(discrepancies, fmt.Sprintf("missing %d of %s (body sha256 %s)", n, strings.Join(files[checksum], ", "), checksum))
+		case n < 0:
+			discrepancies = append(discrepancies, fmt.Sprintf("%d unexpected messages with body sha256 %s", -n, checksum))
+		}
+	}
+	return discrepancies
+}
+
+// verifyRestore reads back the destination queue of a restore on a new
+// channel and checks that it holds exactly the restored messages.  The
+// messages are left in the queue.
+func (t *amqpTarget) verifyRestore(queueName string, messages []dumpedMessage) error {
+	channel, err := t.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Verify restore: Channel: %s", err)
+	}
+	restored, err := fetchChecksums(getMessages(channel, queueName, false))
+	if err != nil {
+		channel.Close()
+		return fmt.Errorf("Verify restore: Get: %s", err)
+	}
+	err = channel.Close()
+	if err != nil {
+		return fmt.Errorf("Verify restore: %s", err)
+	}
+
+	discrepancies := compareRestore(messages, restored)
+	for _, discrepancy := range discrepancies {
+		warningLog("Verify restore: %s", discrepancy)
+	}
+	if len(discrepancies) > 0 {
+		return fmt.Errorf("Verify restore: queue %q doesn't match the dump", queueName)
+	}
+	noticeLog("Verified restore: the %d messages of queue %q match the dump", len(restored), queueName)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchClock is the time source of -watch and of the pacing of -restore,
+// replaced in tests.
+type watchClock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// watch calls dump every interval, starting immediately, until stop is
+// closed. Runs never overlap: the start times a run overran are skipped,
+// and the next run starts at the next start time on the schedule. A failed
+// run is reported and doesn't stop the schedule.
+func watch(clock watchClock, interval time.Duration, stop <-chan struct{}, dump func(started time.Time) error) {
+	next := clock.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		started := clock.Now()
+		err := dump(started)
+		if err != nil {
+			warningLog("Scheduled dump started at %s failed: %s", started.Format(time.RFC3339), err)
+		}
+
+		next = next.Add(interval)
+		skipped := 0
+		for !next.After(clock.Now()) {
+			next = next.Add(interval)
+			skipped++
+		}
+		if skipped > 0 {
+			noticeLog("The dump took longer than -interval, skipped %d scheduled runs", skipped)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-clock.After(next.Sub(clock.Now())):
+		}
+	}
+}
+
+// watchOutputDir is the output directory of the run started at started: a
+// timestamped subdirectory of outputDir, unless outputDir has a {{.Time}} or
+// {{.Timestamp}} placeholder to tell the runs apart.  {{.Queue}} and
+// {{.Date}} alone are the same for every run of a day.
+func watchOutputDir(outputDir string, started time.Time) string {
+	if strings.Contains(outputDir, ".Time") {
+		return outputDir
+	}
+	return path.Join(outputDir, started.UTC().Format("20060102T150405Z"))
+}
+
+// watchDumps re-runs the dump of queueName or of the -queues-file queues
+// every -interval until interrupted, each run writing to its own directory
+// with its own manifest. An interrupt lets the current run finish, a second
+// one aborts it.
+func watchDumps(amqpURI string, queueName string, maxMessages uint, outputDir string, db bool) error {
+	if *watchInterval <= 0 {
+		return fmt.Errorf("-watch requires a positive -interval")
+	}
+	if isNamedPipe(outputDir) {
+		return fmt.Errorf("-watch requires -output-dir to be a directory")
+	}
+	*withManifest = true
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		noticeLog("Interrupted, stopping after the current run (interrupt again to abort it)")
+		close(stop)
+		<-signals
+		errorLogExit(fmt.Errorf("Interrupted"))
+	}()
+
+	watch(realClock{}, *watchInterval, stop, func(started time.Time) error {
+		runDir := watchOutputDir(outputDir, started)
+		verboseLog(fmt.Sprintf("Scheduled dump to %s", runDir))
+		if *queuesFile != "" {
+			return dumpQueuesFromFile(amqpURI, *queuesFile, maxMessages, runDir, db)
+		}
+		return dumpMessagesFromQueue(amqpURI, queueName, maxMessages, runDir, db)
+	})
+	return nil
+}
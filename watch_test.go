@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a watchClock whose time only moves when told to: After
+// advances it by the waited duration and fires at once.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	fired := make(chan time.Time, 1)
+	fired <- c.now
+	return fired
+}
+
+func TestWatch(t *testing.T) {
+	start := time.Date(2021, 12, 27, 13, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	stop := make(chan struct{})
+
+	// The second run takes 25 minutes, overrunning the 10-minute schedule:
+	// the runs at 13:20 and 13:30 are skipped.
+	durations := []time.Duration{time.Minute, 25 * time.Minute, 2 * time.Minute, time.Minute}
+	var starts []string
+	watch(clock, 10*time.Minute, stop, func(started time.Time) error {
+		starts = append(starts, started.Format("15:04"))
+		clock.now = clock.now.Add(durations[len(starts)-1])
+		if len(starts) == len(durations) {
+			close(stop)
+		}
+		if len(starts) == 3 {
+			return fmt.Errorf("queue not found")
+		}
+		return nil
+	})
+
+	expected := "[13:00 13:10 13:40 13:50]"
+	if fmt.Sprint(starts) != expected {
+		t.Errorf("Wrong run start times: expected %s but got %v", expected, starts)
+	}
+}
+
+func TestWatchOutputDir(t *testing.T) {
+	started := time.Date(2021, 12, 27, 13, 4, 5, 0, time.UTC)
+	if dir := watchOutputDir("/tmp/dumps", started); dir != "/tmp/dumps/20211227T130405Z" {
+		t.Errorf("Wrong run directory: %s", dir)
+	}
+	if dir := watchOutputDir("/tmp/{{.Date}}-{{.Time}}", started); dir != "/tmp/{{.Date}}-{{.Time}}" {
+		t.Errorf("Expected placeholders to be left to resolveOutputDir: %s", dir)
+	}
+	// Every run of a day would overwrite the previous one.
+	if dir := watchOutputDir("/tmp/{{.Date}}/{{.Queue}}", started); dir != "/tmp/{{.Date}}/{{.Queue}}/20211227T130405Z" {
+		t.Errorf("Expected a run directory without a time placeholder: %s", dir)
+	}
+}
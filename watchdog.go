@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+var errRuntimeExceeded = errors.New("runtime exceeded")
+
+// startWatchdog calls abort from a separate goroutine once maxRuntime has
+// elapsed, unless the returned cancel function is called first. A zero
+// maxRuntime disables the watchdog.
+func startWatchdog(maxRuntime time.Duration, abort func()) (context.Context, context.CancelFunc) {
+	if maxRuntime <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), maxRuntime)
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			abort()
+		}
+	}()
+	return ctx, cancel
+}
+
+// fetchWithContext wraps fetch so that a call blocked on an unresponsive
+// broker returns errRuntimeExceeded as soon as ctx is done.
+func fetchWithContext(ctx context.Context, fetch fetchFunc) fetchFunc {
+	type result struct {
+		msg amqp091.Delivery
+		ok  bool
+		err error
+	}
+	return func() (amqp091.Delivery, bool, error) {
+		if ctx.Err() != nil {
+			return amqp091.Delivery{}, false, errRuntimeExceeded
+		}
+		results := make(chan result, 1)
+		go func() {
+			msg, ok, err := fetch()
+			results <- result{msg, ok, err}
+		}()
+		select {
+		case r := <-results:
+			return r.msg, r.ok, r.err
+		case <-ctx.Done():
+			return amqp091.Delivery{}, false, errRuntimeExceeded
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestWatchdogAbortsSlowFetch(t *testing.T) {
+	aborted := make(chan bool)
+	ctx, cancel := startWatchdog(50*time.Millisecond, func() { close(aborted) })
+	defer cancel()
+
+	// A fetch that hangs like a Get on an unresponsive broker, until the
+	// watchdog closes the connection.
+	slowFetch := func() (amqp091.Delivery, bool, error) {
+		<-aborted
+		time.Sleep(time.Second)
+		return amqp091.Delivery{}, false, amqp091.ErrClosed
+	}
+
+	start := time.Now()
+	_, _, err := fetchWithContext(ctx, slowFetch)()
+	if err != errRuntimeExceeded {
+		t.Errorf("Expected errRuntimeExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected fetch to be interrupted quickly, took %s", elapsed)
+	}
+
+	// The fetch returns as soon as the deadline passes, which may be just
+	// before the watchdog goroutine calls abort.
+	select {
+	case <-aborted:
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("Expected the watchdog to call abort")
+	}
+
+	_, _, err = fetchWithContext(ctx, slowFetch)()
+	if err != errRuntimeExceeded {
+		t.Errorf("Expected errRuntimeExceeded after the deadline, got %v", err)
+	}
+}
+
+func TestWatchdogNotTriggeredWhenCancelled(t *testing.T) {
+	aborted := false
+	ctx, cancel := startWatchdog(50*time.Millisecond, func() { aborted = true })
+
+	fastFetch := func() (amqp091.Delivery, bool, error) {
+		return amqp091.Delivery{Body: []byte("body")}, true, nil
+	}
+	msg, ok, err := fetchWithContext(ctx, fastFetch)()
+	if err != nil || !ok || string(msg.Body) != "body" {
+		t.Errorf("Wrong fetch result: %#v, %v, %v", msg, ok, err)
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if aborted {
+		t.Errorf("Expected abort not to be called after cancel")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// webhookBackoff is the delay before the first retry of a failed POST; it
+// doubles for every further retry.
+const webhookBackoff = 500 * time.Millisecond
+
+// webhookWriter POSTs every message as a JSON document to an HTTP endpoint.
+// With a concurrency above 1 the requests are sent in the background and
+// their failures are collected until flush is called.
+type webhookWriter struct {
+	url     string
+	headers http.Header
+	client  *http.Client
+	retries int
+	backoff time.Duration
+
+	slots    chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	failures []error
+}
+
+func openWebhookWriter(url string) (*webhookWriter, error) {
+	headers := make(http.Header)
+	for _, header := range webhookHeaderFlags {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid webhook header %q, expected 'Name: value'", header)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if *webhookParallel < 1 {
+		return nil, fmt.Errorf("-webhook-concurrency must be at least 1")
+	}
+
+	w := &webhookWriter{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		retries: int(*webhookRetries),
+		backoff: webhookBackoff,
+	}
+	if *webhookParallel > 1 {
+		w.slots = make(chan struct{}, *webhookParallel)
+	}
+	return w, nil
+}
+
+// webhookPayload is the ndjson record of msg with its counter.
+func webhookPayload(msg amqp091.Delivery, counter uint) map[string]interface{} {
+	payload := ndjsonRecord(msg)
+	payload["counter"] = counter
+	return payload
+}
+
+func (w *webhookWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	data, err := json.Marshal(webhookPayload(msg, counter))
+	if err != nil {
+		return newDumpError("webhook", msg, counter, err)
+	}
+
+	if w.slots == nil {
+		err = w.post(data)
+		if err != nil {
+			return newDumpError("webhook", msg, counter, err)
+		}
+		return nil
+	}
+
+	w.slots <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.wg.Done()
+		}()
+		err := w.post(data)
+		if err != nil {
+			w.mu.Lock()
+			w.failures = append(w.failures, newDumpError("webhook", msg, counter, err))
+			w.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// post sends data, retrying network errors, 429 and 5xx responses with an
+// exponential backoff.
+func (w *webhookWriter) post(data []byte) error {
+	for attempt := 0; ; attempt++ {
+		retryable, err := w.postOnce(data)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= w.retries {
+			return err
+		}
+		verboseLog(fmt.Sprintf("Webhook: %s, retrying", err))
+		time.Sleep(w.backoff << uint(attempt))
+	}
+}
+
+func (w *webhookWriter) postOnce(data []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("HTTP %s", resp.Status)
+}
+
+// flush waits for the requests sent in the background and returns their
+// failures.
+func (w *webhookWriter) flush() []error {
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	failures := w.failures
+	w.failures = nil
+	return failures
+}
+
+func (w *webhookWriter) Close() error {
+	if failures := w.flush(); len(failures) > 0 {
+		return fmt.Errorf("Webhook: %d messages not delivered, first: %s", len(failures), failures[0])
+	}
+	return nil
+}
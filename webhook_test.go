@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestWebhookWriter(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []map[string]interface{}
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Wrong request headers: %v", r.Header)
+		}
+		// The first attempt fails and must be retried.
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			t.Errorf("Decode: %s", err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	webhookHeaderFlags = stringListFlag{"Authorization: Bearer secret"}
+	defer func() { webhookHeaderFlags = nil }()
+
+	writer, err := openWebhookWriter(server.URL)
+	if err != nil {
+		t.Fatalf("openWebhookWriter: %s", err)
+	}
+	writer.backoff = time.Millisecond
+	for i := 0; i < 2; i++ {
+		msg := makeAmqpMessage(i)
+		err = writer.WriteMessage(amqp091.Delivery{Headers: msg.Headers, MessageId: msg.MessageId, Body: msg.Body}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if attempts != 3 || len(payloads) != 2 {
+		t.Fatalf("Expected 3 attempts and 2 payloads, got %d and %v", attempts, payloads)
+	}
+	properties := payloads[1]["properties"].(map[string]interface{})
+	if payloads[1]["body"] != "message-1-body" || payloads[1]["counter"] != 1.0 || properties["message_id"] != "msgid-1" {
+		t.Errorf("Wrong payload: %#v", payloads[1])
+	}
+}
+
+func TestWebhookWriterFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	writer, err := openWebhookWriter(server.URL)
+	if err != nil {
+		t.Fatalf("openWebhookWriter: %s", err)
+	}
+	err = writer.WriteMessage(amqp091.Delivery{MessageId: "msgid-7", Body: []byte("body")}, 7)
+	var dumpErr *DumpError
+	if !errors.As(err, &dumpErr) || dumpErr.Counter != 7 || dumpErr.MessageID != "msgid-7" {
+		t.Errorf("Expected a DumpError for a 400 response, got %v", err)
+	}
+}
+
+func TestWebhookWriterConcurrency(t *testing.T) {
+	var inFlight, maxInFlight, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if atomic.AddInt32(&requests, 1) == 5 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	*webhookParallel = 3
+	defer func() { *webhookParallel = 1 }()
+
+	writer, err := openWebhookWriter(server.URL)
+	if err != nil {
+		t.Fatalf("openWebhookWriter: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		err = writer.WriteMessage(amqp091.Delivery{Body: []byte("body")}, uint(i))
+		if err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+	failures := writer.flush()
+	if len(failures) != 1 {
+		t.Errorf("Expected 1 failure, got %v", failures)
+	}
+	if requests != 10 || maxInFlight > 3 || maxInFlight < 2 {
+		t.Errorf("Expected 10 requests with at most 3 in flight, got %d and %d", requests, maxInFlight)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Errorf("Close after flush: %s", err)
+	}
+}
+
+func TestWebhookFailureRequeuesMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload["body"] == "message-1-body" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	*ack = true
+	defer func() { *ack = false }()
+
+	for _, continueOnFailure := range []bool{false, true} {
+		writer, err := openWebhookWriter(server.URL)
+		if err != nil {
+			t.Fatalf("openWebhookWriter: %s", err)
+		}
+		broker := newTestBroker(3)
+		// As set up by dumpMessagesFromQueue for -webhook-url: the messages
+		// are acked once the webhook accepted them.
+		loop := &dumpLoop{fetch: getMessages(broker, testQueueName, false), writer: writer, manualAck: true}
+		expectedAcks := "[1]"
+		if continueOnFailure {
+			loop.errorLog = newStderrRecorder()
+			expectedAcks = "[1 3]"
+		}
+		_, err = loop.run()
+		if continueOnFailure != (err == nil) {
+			t.Errorf("Continue %v: unexpected error %v", continueOnFailure, err)
+		}
+		got := fmt.Sprintf("acked %v, requeued %v", broker.acked, broker.requeued)
+		if expected := "acked " + expectedAcks + ", requeued [2]"; got != expected {
+			t.Errorf("Continue %v: expected %s, got %s", continueOnFailure, expected, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func zipFilePath(outputDir string) string {
+	return path.Join(outputDir, "dump.zip")
+}
+
+// zipWriter writes all messages to a single zip archive, with the same
+// msg-NNNN body entries and -full metadata entries as the files output.  The
+// archive is only readable once Close wrote its central directory.
+type zipWriter struct {
+	file    *os.File
+	archive *zip.Writer
+	method  uint16
+}
+
+// openZipWriter creates the archive; level is a compress/flate level, 0
+// stores the entries uncompressed.
+func openZipWriter(filePath string, level int) (*zipWriter, error) {
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return nil, fmt.Errorf("zip: invalid compression level %d, expected -1 to 9", level)
+	}
+	file, _, err := openOutputFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("zip: %s", err)
+	}
+	w := &zipWriter{file: file, archive: zip.NewWriter(file), method: zip.Deflate}
+	if level == flate.NoCompression {
+		w.method = zip.Store
+	} else {
+		w.archive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return w, nil
+}
+
+func (w *zipWriter) writeEntry(name string, modified time.Time, data []byte) error {
+	entry, err := w.archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   w.method,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+func (w *zipWriter) WriteMessage(msg amqp091.Delivery, counter uint) error {
+	name := fmt.Sprintf("msg-%04d", counter)
+	modified := msg.Timestamp
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+
+	err := w.writeEntry(name, modified, msg.Body)
+	if err == nil && *full {
+		var data []byte
+		var suffix string
+		data, suffix, err = propsAndHeaders(msg, counter)
+		if err == nil {
+			err = w.writeEntry(name+suffix, modified, data)
+		}
+	}
+	if errors.Is(err, syscall.EPIPE) {
+		return errReaderClosed
+	}
+	if err != nil {
+		return newDumpError("zip", msg, counter, err)
+	}
+	return nil
+}
+
+func (w *zipWriter) Close() error {
+	err := w.archive.Close()
+	closeErr := w.file.Close()
+	if errors.Is(err, syscall.EPIPE) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("zip: %s", err)
+	}
+	return closeErr
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestZipWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-dump-queue-zip")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*full = true
+	defer func() { *full = false }()
+
+	for _, level := range []int{-1, 0, 9} {
+		writer, err := openZipWriter(zipFilePath(dir), level)
+		if err != nil {
+			t.Fatalf("openZipWriter: %s", err)
+		}
+		timestamp := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+		messages := []amqp091.Delivery{
+			{MessageId: "msgid-0", Timestamp: timestamp, Body: []byte(`{"id":1}`)},
+			{MessageId: "msgid-1", Body: []byte{0xff, 0x00, '\n', 0xfe}},
+		}
+		for i, msg := range messages {
+			err = writer.WriteMessage(msg, uint(i))
+			if err != nil {
+				t.Fatalf("WriteMessage: %s", err)
+			}
+		}
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+
+		archive, err := zip.OpenReader(zipFilePath(dir))
+		if err != nil {
+			t.Fatalf("OpenReader: %s", err)
+		}
+		expectedNames := []string{"msg-0000", "msg-0000-headers+properties.json", "msg-0001", "msg-0001-headers+properties.json"}
+		if len(archive.File) != len(expectedNames) {
+			t.Fatalf("Expected %d entries with level %d, got %d", len(expectedNames), level, len(archive.File))
+		}
+		entries := make(map[string][]byte)
+		for i, entry := range archive.File {
+			if entry.Name != expectedNames[i] {
+				t.Errorf("Wrong entry %d: expected %q but got %q", i, expectedNames[i], entry.Name)
+			}
+			if (level == 0) != (entry.Method == zip.Store) {
+				t.Errorf("Wrong method %d of entry %q with level %d", entry.Method, entry.Name, level)
+			}
+			file, err := entry.Open()
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+			entries[entry.Name], err = ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				t.Fatalf("ReadAll %q: %s", entry.Name, err)
+			}
+		}
+		if !archive.File[0].Modified.Equal(timestamp) {
+			t.Errorf("Expected the message timestamp as modification time, got %s", archive.File[0].Modified)
+		}
+		archive.Close()
+
+		for i, msg := range messages {
+			if string(entries[expectedNames[2*i]]) != string(msg.Body) {
+				t.Errorf("Wrong body of message %d: %q", i, entries[expectedNames[2*i]])
+			}
+			var extras map[string]interface{}
+			err = json.Unmarshal(entries[expectedNames[2*i+1]], &extras)
+			if err != nil {
+				t.Fatalf("Unmarshal: %s", err)
+			}
+			props, _ := extras["properties"].(map[string]interface{})
+			if props["message_id"] != msg.MessageId {
+				t.Errorf("Wrong metadata of message %d: %v", i, extras)
+			}
+		}
+	}
+
+	_, err = openZipWriter(zipFilePath(dir), 10)
+	if err == nil {
+		t.Errorf("Expected an error for compression level 10")
+	}
+}
+
+func TestZipRejectsRemovingMessages(t *testing.T) {
+	*output = "zip"
+	defer func() { *output = "files" }()
+	for _, set := range []func() func(){
+		func() func() { *ack = true; return func() { *ack = false } },
+		func() func() { *onDump = "ack"; return func() { *onDump = "" } },
+		func() func() { *onDump = "nack-discard"; return func() { *onDump = "" } },
+		func() func() { *purgeMatched = true; return func() { *purgeMatched = false } },
+	} {
+		reset := set()
+		err := dumpMessagesFromQueue(testAmqpURI, testQueueName, 0, "tmp-test", false)
+		reset()
+		if err == nil || !strings.Contains(err.Error(), "-output=zip can't be combined") {
+			t.Errorf("Expected -output=zip to be rejected, got %v", err)
+		}
+	}
+}